@@ -3,6 +3,8 @@ module github.com/caser789/jotto
 go 1.16
 
 require (
-	github.com/golang/protobuf v1.3.2 // indirect
-	github.com/gorilla/mux v1.8.0 // indirect
+	github.com/go-redis/redis v6.15.9+incompatible
+	github.com/golang/protobuf v1.3.2
+	github.com/gorilla/mux v1.8.0
+	github.com/rs/xid v1.6.0
 )
@@ -3,7 +3,9 @@ package jotto
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -15,12 +17,17 @@ type Application interface {
 	Run() error
 	Reload() error
 	Shutdown(timeout time.Duration) error
+	Close() error
 	Execute(ctx context.Context, processor Processor, request, response interface{}) (int32, context.Context)
 
 	Protocol() string
 	Address() string
 	Routes() map[Route]Processor
 	Jobs() map[int]QueueProcessor
+	RegisterCallback(jobType int, processor QueueCallbackProcessor)
+	Callbacks() map[int]QueueCallbackProcessor
+	SetRetryPolicy(jobType int, policy *RetryPolicy)
+	RetryPolicy(jobType int) *RetryPolicy
 
 	Settings() Configuration
 
@@ -32,6 +39,7 @@ type Application interface {
 
 	Cache(name string) CacheDriver
 	Queue(name string) *Queue
+	Metrics() *MetricsRegistry
 
 	GetListener() (net.Listener, error)
 	SetListener(net.Listener)
@@ -147,9 +155,18 @@ type BaseApplication struct {
 	// Background daemons
 	daemons map[string]Daemon
 
-	cache map[string]CacheDriver
-	queue map[string]*Queue
-	jobs  map[int]QueueProcessor
+	// Cache and queue instances, swapped as a whole on reload
+	services      sync.RWMutex
+	reloading     sync.Mutex
+	cache         map[string]CacheDriver
+	queue         map[string]*Queue
+	cacheSettings map[string]string
+	queueSettings map[string]string
+
+	jobs          map[int]QueueProcessor
+	retryPolicies map[int]*RetryPolicy
+	metrics       *MetricsRegistry
+	redis         *RedisRegistry
 
 	listener net.Listener
 	runner   Runner
@@ -173,7 +190,12 @@ func NewApplication(settings Configuration, routes map[Route]Processor, jobs map
 		cache:          make(map[string]CacheDriver),
 		queue:          make(map[string]*Queue),
 		jobs:           jobs,
+		retryPolicies:  make(map[int]*RetryPolicy),
+		metrics:        NewMetricsRegistry(),
+		redis:          NewRedisRegistry(),
 		daemons:        make(map[string]Daemon),
+
+		queueCallbackProcessor: make(map[int]QueueCallbackProcessor),
 	}
 
 	app.container = NewContainer(app)
@@ -205,6 +227,29 @@ func (app *BaseApplication) Jobs() map[int]QueueProcessor {
 	return app.jobs
 }
 
+// RegisterCallback registers the processor of batch callback jobs of type `jobType`
+func (app *BaseApplication) RegisterCallback(jobType int, processor QueueCallbackProcessor) {
+	app.queueCallbackProcessor[jobType] = processor
+}
+
+// Callbacks returns the processors of batch callback jobs
+func (app *BaseApplication) Callbacks() map[int]QueueCallbackProcessor {
+	return app.queueCallbackProcessor
+}
+
+// SetRetryPolicy sets how failed jobs of type `jobType` are retried
+func (app *BaseApplication) SetRetryPolicy(jobType int, policy *RetryPolicy) {
+	app.retryPolicies[jobType] = policy
+}
+
+// RetryPolicy returns the retry policy of jobs of type `jobType`, DefaultRetryPolicy when none is set
+func (app *BaseApplication) RetryPolicy(jobType int) *RetryPolicy {
+	if policy, ok := app.retryPolicies[jobType]; ok {
+		return policy
+	}
+	return DefaultRetryPolicy
+}
+
 // On registers an event listener
 func (app *BaseApplication) On(event Event, listener Listener) {
 	app.eventBus.On(event, listener)
@@ -286,7 +331,41 @@ func (app *BaseApplication) Shutdown(timeout time.Duration) (err error) {
 		fmt.Printf("stopping daemon %s", daemon.Name())
 		daemon.Cancel()
 	}
-	return app.runner.Shutdown(timeout)
+
+	err = app.runner.Shutdown(timeout)
+	app.Close()
+
+	return
+}
+
+// Close closes the cache and queue drivers and their connections
+func (app *BaseApplication) Close() (err error) {
+	app.services.RLock()
+	defer app.services.RUnlock()
+
+	closed := make(map[interface{}]bool)
+
+	closeDriver := func(driver interface{}) {
+		if closer, ok := driver.(io.Closer); ok && !closed[driver] {
+			closed[driver] = true
+			if er := closer.Close(); er != nil && err == nil {
+				err = er
+			}
+		}
+	}
+
+	for _, driver := range app.cache {
+		closeDriver(driver)
+	}
+	for _, queue := range app.queue {
+		closeDriver(queue.Driver())
+	}
+
+	if er := app.redis.Close(); er != nil && err == nil {
+		err = er
+	}
+
+	return
 }
 
 // Execute executes a processor
@@ -317,20 +396,41 @@ func (app *BaseApplication) Reload() (err error) {
 	return
 }
 
+// Cache returns the cache named `name`, or a NullDriver when there is none.
+// Configured caches are wrapped, in a MetricsDriver at least; they all forward
+// PubSub, use UnwrapCache to reach the concrete driver, e.g. a *RedisDriver.
+//
+// Look the cache up for every use rather than holding it: a reload replacing
+// it closes the old driver once the operations running on it are done. Locks,
+// object caches and rate limiters created with NewAppLock, NewAppObjectCache
+// and NewAppRateLimiter look it up for every call.
 func (app *BaseApplication) Cache(name string) CacheDriver {
+	app.services.RLock()
+	defer app.services.RUnlock()
+
 	if c, ok := app.cache[name]; ok {
 		return c
 	}
 	return NewNullDriver(name)
 }
 
+// Queue returns the queue named `name`, nil when there is none. As with Cache,
+// look it up for every use, a queue replaced on reload has its driver closed.
 func (app *BaseApplication) Queue(name string) *Queue {
+	app.services.RLock()
+	defer app.services.RUnlock()
+
 	if q, ok := app.queue[name]; ok {
 		return q
 	}
 	return nil
 }
 
+// Metrics returns the registry holding the metrics of every cache
+func (app *BaseApplication) Metrics() *MetricsRegistry {
+	return app.metrics
+}
+
 func (app *BaseApplication) GetListener() (listener net.Listener, err error) {
 	if app.listener != nil {
 		return app.listener, nil
@@ -376,28 +476,173 @@ func (app *BaseApplication) GetDaemon(name string) (daemon Daemon, err error) {
 	return daemon, nil
 }
 
-// Initialize external services such as cache, queue
+// circuitStateChanged - fire the event matching the new state of a cache circuit breaker
+func (app *BaseApplication) circuitStateChanged(name string, from, to CircuitState) {
+	switch to {
+	case CircuitOpen:
+		app.Fire(CircuitOpenEvent, name, from, to)
+	case CircuitHalfOpen:
+		app.Fire(CircuitHalfOpenEvent, name, from, to)
+	case CircuitClosed:
+		app.Fire(CircuitCloseEvent, name, from, to)
+	}
+}
+
+// Initialize external services such as cache, queue. On reload, instances
+// whose settings did not change are kept; the others are created anew and
+// swapped in at once, then the replaced drivers are closed in the background
+// once the operations running on them are done.
 func (app *BaseApplication) initializeServices() {
+	app.reloading.Lock()
+	defer app.reloading.Unlock()
+
+	caches := make(map[string]CacheDriver)
+	cacheSettings := make(map[string]string)
+
 	for _, c := range app.settings.Motto().Cache {
-		switch c.Driver {
-		case "redis":
-			app.cache[c.Name] = NewRedisDriver(c.Name, c.Redis)
-		case "memcached":
-		default:
-			// pass
+		fingerprint := settingsFingerprint(c)
+
+		driver, ok := app.cache[c.Name]
+		if !ok || app.cacheSettings[c.Name] != fingerprint {
+			if driver = app.newCacheDriver(c); driver == nil {
+				continue
+			}
 		}
+
+		caches[c.Name] = driver
+		cacheSettings[c.Name] = fingerprint
 	}
 
+	queues := make(map[string]*Queue)
+	queueSettings := make(map[string]string)
+
 	for _, q := range app.settings.Motto().Queue {
+		fingerprint := settingsFingerprint(q)
+		queueSettings[q.Name] = fingerprint
+
+		if app.queueSettings[q.Name] == fingerprint {
+			for _, name := range q.Queues {
+				key := q.Name + ":" + name
+				if existing, ok := app.queue[key]; ok {
+					queues[key] = existing
+				}
+			}
+			continue
+		}
+
 		switch q.Driver {
 		case "redis":
-			driver := NewRedisDriver(q.Name, q.Redis)
+			driver := app.redis.Driver(q.Name, q.Redis)
 			for _, name := range q.Queues {
 				key := q.Name + ":" + name
-				app.queue[key] = NewQueue(name, driver)
+				queues[key] = NewQueue(name, driver)
+			}
+		case "memory":
+			// Jobs only live in this process, keep the existing driver on reload
+			// and apply the new settings to it
+			var driver *MemoryDriver
+			for _, name := range q.Queues {
+				if existing, ok := app.queue[q.Name+":"+name]; ok {
+					if md, ok := existing.Driver().(*MemoryDriver); ok {
+						driver = md
+						break
+					}
+				}
+			}
+			if driver == nil {
+				driver = NewMemoryDriver(q.Name, q.Memory)
+			} else {
+				driver.configure(q.Memory)
+			}
+			for _, name := range q.Queues {
+				key := q.Name + ":" + name
+				queues[key] = NewQueue(name, driver)
 			}
 		default:
 			// pass
 		}
 	}
+
+	retiredCaches := make(map[string]CacheDriver)
+	for name, driver := range app.cache {
+		if caches[name] != driver {
+			retiredCaches[name] = driver
+		}
+	}
+
+	retiredQueues := make(map[string]*Queue)
+	for key, queue := range app.queue {
+		if queues[key] != queue {
+			retiredQueues[key] = queue
+		}
+	}
+
+	inUse := make(map[QueueDriver]bool)
+	for _, queue := range queues {
+		inUse[queue.Driver()] = true
+	}
+
+	app.services.Lock()
+	app.cache, app.cacheSettings = caches, cacheSettings
+	app.queue, app.queueSettings = queues, queueSettings
+	app.services.Unlock()
+
+	if len(retiredCaches) > 0 || len(retiredQueues) > 0 {
+		go app.retire(retiredCaches, retiredQueues, inUse)
+	}
+}
+
+// newCacheDriver - create the driver of a cache instance, nil if its driver is unknown
+func (app *BaseApplication) newCacheDriver(c *CacheSettings) CacheDriver {
+	var driver CacheDriver
+
+	switch c.Driver {
+	case "redis":
+		driver = app.redis.Driver(c.Name, c.Redis)
+	case "memory":
+		driver = NewMemoryDriver(c.Name, c.Memory)
+	case "memcached":
+		driver = NewMemcachedDriver(c.Name, c.Memcached)
+	default:
+		return nil
+	}
+
+	if prefixed, ok := driver.(interface{ SetPrefix(string) }); ok && c.Prefix != "" {
+		prefixed.SetPrefix(c.Prefix)
+	}
+	if c.CircuitBreaker != nil {
+		breaker := NewCircuitBreakerDriver(c.Name, driver, c.CircuitBreaker)
+		breaker.Breaker().OnStateChange(app.circuitStateChanged)
+		driver = breaker
+	}
+	if c.Local != nil {
+		driver = NewTieredDriver(c.Name, driver, c.Local)
+	}
+
+	if c.GetVia != nil {
+		loader := NewLoaderDriver(driver, c.GetVia)
+		loader.OnRefreshError(func(key string, err error) {
+			app.MakeLogger(nil).Errorf("motto|cache|refresh_failed|cache=%s,key=%s,err=%v", c.Name, key, err)
+		})
+		driver = loader
+	}
+
+	return NewMetricsDriver(driver, app.metrics.Cache(c.Name))
+}
+
+// UnwrapCache - the driver wrapped by the metrics, loader, tiered and circuit
+// breaker layers of `driver`, to type assert it:
+//
+//	redis, ok := jotto.UnwrapCache(app.Cache("default")).(*jotto.RedisDriver)
+func UnwrapCache(driver CacheDriver) CacheDriver {
+	for {
+		switch wrapper := driver.(type) {
+		case interface{ Driver() CacheDriver }:
+			driver = wrapper.Driver()
+		case *TieredDriver:
+			driver = wrapper.Remote()
+		default:
+			return driver
+		}
+	}
 }
@@ -97,3 +97,114 @@ func TestDaemonCanBeCancelled(t *testing.T) {
 	assert.True(t, done)
 	assert.False(t, timeout)
 }
+
+func TestReloadSwapsChangedInstancesOnly(t *testing.T) {
+	cfg := motto.NewDefaultSettings()
+	cfg.Motto().Cache = []*motto.CacheSettings{
+		{Name: "kept", Driver: "memory", Memory: &motto.MemorySettings{}},
+		{Name: "changed", Driver: "memory", Memory: &motto.MemorySettings{}},
+	}
+	cfg.Motto().Queue = []*motto.QueueSettings{
+		{Name: "memory", Driver: "memory", Queues: []string{"jobs"}, Memory: &motto.MemorySettings{}},
+	}
+	app := motto.NewApplication(cfg, nil, nil, nil)
+	defer app.Close()
+
+	assert.Nil(t, app.Boot())
+
+	kept, changed, queue := app.Cache("kept"), app.Cache("changed"), app.Queue("memory:jobs")
+	assert.Nil(t, kept.Set("key", "value", time.Minute))
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				app.Cache("changed").Set("key", "value", time.Minute)
+				app.Queue("memory:jobs").Stats()
+			}
+		}
+	}()
+
+	for i := 1; i <= 10; i++ {
+		cfg.Motto().Cache[1].Memory = &motto.MemorySettings{MaxEntries: i}
+		assert.Nil(t, app.Reload())
+	}
+	close(stop)
+	<-done
+
+	assert.Same(t, kept, app.Cache("kept"))
+	assert.Same(t, queue, app.Queue("memory:jobs"))
+	assert.NotSame(t, changed, app.Cache("changed"))
+
+	value, err := app.Cache("kept").Get("key")
+	assert.Nil(t, err)
+	assert.Equal(t, "value", value)
+}
+
+func TestReloadAppliesMemoryQueueSettings(t *testing.T) {
+	cfg := motto.NewDefaultSettings()
+	cfg.Motto().Queue = []*motto.QueueSettings{
+		{Name: "memory", Driver: "memory", Queues: []string{"jobs"}, Memory: &motto.MemorySettings{}},
+	}
+	app := motto.NewApplication(cfg, nil, nil, nil)
+	defer app.Close()
+
+	assert.Nil(t, app.Boot())
+	assert.Nil(t, app.Queue("memory:jobs").Enqueue(&motto.Job{Payload: "kept"}))
+
+	cfg.Motto().Queue[0].Memory = &motto.MemorySettings{VisibilityTimeout: 7, Blocking: true, ReadTimeout: 1, JanitorInterval: -1}
+	assert.Nil(t, app.Reload())
+
+	// The jobs are kept, the new settings apply
+	Q := app.Queue("memory:jobs")
+	assert.Equal(t, 7*time.Second, Q.VisibilityTimeout())
+
+	job, err := Q.Dequeue()
+	assert.Nil(t, err)
+	assert.Equal(t, "kept", job.Payload)
+
+	start := time.Now()
+	_, err = Q.Dequeue()
+	assert.Equal(t, motto.ErrorQueueEmpty, err)
+	assert.True(t, time.Since(start) >= 900*time.Millisecond)
+}
+
+func TestAppHoldersFollowReloadedCaches(t *testing.T) {
+	cfg := motto.NewDefaultSettings()
+	cfg.Motto().Cache = []*motto.CacheSettings{
+		{Name: "default", Driver: "memory", Memory: &motto.MemorySettings{}},
+	}
+	app := motto.NewApplication(cfg, nil, nil, nil)
+	defer app.Close()
+
+	assert.Nil(t, app.Boot())
+
+	objects := motto.NewAppObjectCache(app, "default", motto.JSONCodec)
+	limiter := motto.NewAppRateLimiter(app, "default", "login", &motto.RateLimit{Limit: 1, Period: time.Minute})
+	lock := motto.NewAppLock(app, "default", "leader", nil)
+
+	cfg.Motto().Cache[0].Memory = &motto.MemorySettings{MaxEntries: 100}
+	assert.Nil(t, app.Reload())
+
+	// Every call goes to the cache in place now
+	assert.Nil(t, objects.SetObject("user", map[string]string{"name": "jotto"}, time.Minute))
+	_, err := app.Cache("default").Get("user")
+	assert.Nil(t, err)
+
+	result, err := limiter.Allow("jotto")
+	assert.Nil(t, err)
+	assert.True(t, result.Allowed)
+	has, _ := app.Cache("default").Has(limiter.Key("jotto"))
+	assert.True(t, has)
+
+	acquired, err := lock.TryAcquire()
+	assert.Nil(t, err)
+	assert.True(t, acquired)
+	value, _ := app.Cache("default").Get("leader")
+	assert.Equal(t, lock.Token(), value)
+}
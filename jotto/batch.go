@@ -0,0 +1,142 @@
+package jotto
+
+import (
+	"time"
+)
+
+// CacheItem - a key/value pair with its own expiration, used by `MSet`
+type CacheItem struct {
+	Key        string
+	Value      string
+	Expiration time.Duration
+}
+
+// CacheBatch queues up cache operations and sends them together on `Exec`.
+// Results are only available after `Exec` returns.
+type CacheBatch interface {
+	Get(key string) *CacheResult
+	Set(key, value string, expiration time.Duration) *CacheResult
+	Del(key string) *CacheResult
+	Incr(key string) *CacheResult
+	Decr(key string) *CacheResult
+	Expire(key string, expiry time.Duration) *CacheResult
+
+	// Exec - send all queued operations. The returned error is the first
+	// error other than a cache miss; check each result for its own error.
+	Exec() error
+}
+
+// CacheResult - the result of an operation queued in a CacheBatch
+type CacheResult struct {
+	value  string
+	number int64
+	ok     bool
+	err    error
+}
+
+// Result - the string value of a `Get`
+func (r *CacheResult) Result() (string, error) {
+	return r.value, r.err
+}
+
+// Int - the value of an `Incr` or `Decr`
+func (r *CacheResult) Int() (int64, error) {
+	return r.number, r.err
+}
+
+// Bool - the result of a `Del` or `Expire`
+func (r *CacheResult) Bool() (bool, error) {
+	return r.ok, r.err
+}
+
+// Err - the error of the operation, if any
+func (r *CacheResult) Err() error {
+	return r.err
+}
+
+// sequentialBatch emulates a batch for drivers without pipelining by
+// running the queued operations one by one on `Exec`.
+type sequentialBatch struct {
+	driver     CacheDriver
+	operations []func() error
+}
+
+func newSequentialBatch(driver CacheDriver) *sequentialBatch {
+	return &sequentialBatch{driver: driver}
+}
+
+func (b *sequentialBatch) queue(operation func(result *CacheResult) error) *CacheResult {
+	result := &CacheResult{}
+
+	b.operations = append(b.operations, func() error {
+		result.err = operation(result)
+		return result.err
+	})
+
+	return result
+}
+
+func (b *sequentialBatch) Get(key string) *CacheResult {
+	return b.queue(func(result *CacheResult) (err error) {
+		result.value, err = b.driver.Get(key)
+		return
+	})
+}
+
+func (b *sequentialBatch) Set(key, value string, expiration time.Duration) *CacheResult {
+	return b.queue(func(result *CacheResult) error {
+		return b.driver.Set(key, value, expiration)
+	})
+}
+
+func (b *sequentialBatch) Del(key string) *CacheResult {
+	return b.queue(func(result *CacheResult) (err error) {
+		result.ok, err = b.driver.Del(key)
+		return
+	})
+}
+
+func (b *sequentialBatch) Incr(key string) *CacheResult {
+	return b.queue(func(result *CacheResult) (err error) {
+		result.number, err = b.driver.Incr(key)
+		return
+	})
+}
+
+func (b *sequentialBatch) Decr(key string) *CacheResult {
+	return b.queue(func(result *CacheResult) (err error) {
+		result.number, err = b.driver.Decr(key)
+		return
+	})
+}
+
+func (b *sequentialBatch) Expire(key string, expiry time.Duration) *CacheResult {
+	return b.queue(func(result *CacheResult) (err error) {
+		result.ok, err = b.driver.Expire(key, expiry)
+		return
+	})
+}
+
+func (b *sequentialBatch) Exec() (err error) {
+	operations := b.operations
+	b.operations = nil
+
+	for _, operation := range operations {
+		if er := operation(); er != nil && !IsCacheMiss(er) && err == nil {
+			err = er
+		}
+	}
+
+	return
+}
+
+// mset - emulate MSet with one Set per item
+func mset(driver CacheDriver, items []*CacheItem) error {
+	for _, item := range items {
+		if err := driver.Set(item.Key, item.Value, item.Expiration); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
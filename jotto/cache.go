@@ -2,8 +2,12 @@ package jotto
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"git.garena.com/shopee/go-shopeelib/logger"
@@ -14,7 +18,8 @@ import (
 type CacheDriver interface {
 	Get(key string) (value string, err error)
 	// GetVia - get the `key` from cache, if not set, call `handler` to
-	// get the value and put it into the cache afterwards.
+	// get the value and put it into the cache afterwards. Concurrent
+	// misses on the same key within a process only call `handler` once.
 	GetVia(key string, handler func() (value string, expiration time.Duration, err error)) (string, error)
 	Set(key, value string, expiration time.Duration) error
 	SetNX(key, value string, expiration time.Duration) (bool, error)
@@ -30,7 +35,79 @@ type CacheDriver interface {
 	// Guard - guard the execution of the `handler` function with a lock
 	// under the hood, check if the `key` is set in cache, if yes, `handler`
 	// will not be executed; otherwise, set the key and execute `handler`.
+	//
+	// Deprecated: use `NewLock`, which can also wait for and extend the lock.
 	Guard(key string, expiration time.Duration, handler func() error) error
+	// CompareAndDelete - delete `key` only if it holds `value`
+	CompareAndDelete(key, value string) (bool, error)
+	// CompareAndExpire - set the expire time of `key` only if it holds `value`
+	CompareAndExpire(key, value string, expiry time.Duration) (bool, error)
+	// MGet - get multiple keys at once, missing keys are left out of `values`
+	MGet(keys ...string) (values map[string]string, err error)
+	// MSet - put multiple items at once, each with its own expiration
+	MSet(items ...*CacheItem) error
+	// MDel - delete multiple keys at once and return how many existed
+	MDel(keys ...string) (int64, error)
+	// Batch - start a batch of operations sent in as few round trips as possible
+	Batch() CacheBatch
+
+	// HGet - get `field` of the hash at `key`, a missing field is a cache miss
+	HGet(key, field string) (string, error)
+	// HSet - set `field` of the hash at `key`
+	HSet(key, field, value string) error
+	// HDel - delete `fields` of the hash at `key` and return how many existed
+	HDel(key string, fields ...string) (int64, error)
+	// HGetAll - get all fields of the hash at `key`
+	HGetAll(key string) (map[string]string, error)
+	// HIncrBy - add `delta` to the integer in `field` of the hash at `key`
+	HIncrBy(key, field string, delta int64) (int64, error)
+
+	// ZAdd - add or update `members` of the sorted set at `key` and return how many were added
+	ZAdd(key string, members ...ZMember) (int64, error)
+	// ZRange - members from `start` to `stop` (inclusive, negative counts from the end) by ascending score
+	ZRange(key string, start, stop int64) ([]ZMember, error)
+	// ZRevRange - like ZRange, by descending score
+	ZRevRange(key string, start, stop int64) ([]ZMember, error)
+	// ZRank - the rank of `member` by ascending score, a missing member is a cache miss
+	ZRank(key, member string) (int64, error)
+
+	// LPush - prepend `values` to the list at `key` and return its length
+	LPush(key string, values ...string) (int64, error)
+	// RPush - append `values` to the list at `key` and return its length
+	RPush(key string, values ...string) (int64, error)
+	// LPop - remove and return the first element, an empty list is a cache miss
+	LPop(key string) (string, error)
+	// RPop - remove and return the last element, an empty list is a cache miss
+	RPop(key string) (string, error)
+	// LRange - elements from `start` to `stop` (inclusive, negative counts from the end)
+	LRange(key string, start, stop int64) ([]string, error)
+	// LTrim - keep only the elements from `start` to `stop`
+	LTrim(key string, start, stop int64) error
+
+	// Throttle - atomically count a request against the rate limit held at `key`
+	Throttle(key string, limit *RateLimit) (*RateLimitResult, error)
+}
+
+// ZMember - a member of a sorted set with its score
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+var (
+	// ErrorCacheMiss - the key does not exist in the cache
+	ErrorCacheMiss = errors.New("cache miss")
+
+	// ErrorCacheWrongType - the key holds a different kind of value than the operation expects
+	ErrorCacheWrongType = errors.New("operation against a key holding the wrong kind of value")
+
+	// ErrorCacheUnsupported - the cache driver does not support the operation
+	ErrorCacheUnsupported = errors.New("operation not supported by the cache driver")
+)
+
+// IsCacheMiss - check if `err` reports a missing key, whichever driver returned it
+func IsCacheMiss(err error) bool {
+	return err == ErrorCacheMiss || err == redis.Nil
 }
 
 // RedisDriver implements both the CacheDriver and QueueDriver interface
@@ -38,126 +115,712 @@ type RedisDriver struct {
 	name     string
 	settings *RedisSettings
 	client   redis.UniversalClient
+	flight   flightGroup
+	prefix   string
+
+	// release - give up the client, closing it if the driver owns it
+	release func() error
+	once    sync.Once
 }
 
-// NewRedisDriver - create a Redis driver
+// NewRedisDriver - create a Redis driver. Depending on `settings` the client
+// talks to a single node, a cluster (several addresses) or the master
+// monitored by Sentinel (`MasterName` set, addresses of the sentinels).
 func NewRedisDriver(name string, settings *RedisSettings) *RedisDriver {
-	addrs := strings.Split(settings.Address, ";")
-	client := redis.NewUniversalClient(&redis.UniversalOptions{
-		Addrs:        addrs,
+	rd := newRedisDriver(name, settings, redis.NewUniversalClient(redisOptions(settings)))
+	rd.release = rd.client.Close
+
+	return rd
+}
+
+func newRedisDriver(name string, settings *RedisSettings, client redis.UniversalClient) *RedisDriver {
+	return &RedisDriver{
+		name:     name,
+		settings: settings,
+		client:   client,
+	}
+}
+
+// Client - the go-redis client, possibly shared with other drivers
+func (rd *RedisDriver) Client() redis.UniversalClient {
+	return rd.client
+}
+
+// Close - release the Redis client, it is closed once no other driver shares it
+func (rd *RedisDriver) Close() (err error) {
+	rd.once.Do(func() {
+		if rd.release != nil {
+			err = rd.release()
+		}
+	})
+
+	return
+}
+
+// redisOptions - translate `settings` into go-redis options
+func redisOptions(settings *RedisSettings) *redis.UniversalOptions {
+	options := &redis.UniversalOptions{
+		Addrs:        strings.Split(settings.Address, ";"),
 		Password:     settings.Password,
 		DB:           settings.Database,
 		DialTimeout:  time.Second * time.Duration(settings.DialTimeout),
 		ReadTimeout:  time.Second * time.Duration(settings.ReadTimeout),
 		WriteTimeout: time.Second * time.Duration(settings.WriteTimeout),
-	})
+		PoolSize:     settings.PoolSize,
+		MinIdleConns: settings.MinIdleConns,
+		MasterName:   settings.MasterName,
+	}
 
-	return &RedisDriver{
-		name:     name,
-		settings: settings,
-		client:   client,
+	if settings.Username != "" {
+		// go-redis only sends AUTH with a password, authenticate as the ACL user instead
+		options.Password = ""
+		options.OnConnect = func(conn *redis.Conn) error {
+			return conn.Do("auth", settings.Username, settings.Password).Err()
+		}
+	}
+
+	if settings.TLS != nil {
+		config, err := settings.TLS.config()
+
+		if err != nil {
+			// Fail every connection rather than silently talking in plain text
+			options.OnConnect = func(conn *redis.Conn) error {
+				return err
+			}
+		}
+
+		options.TLSConfig = config
 	}
+
+	return options
 }
 
 /* CacheDriver */
 
-// Get - retrieve `key` from Redis
-func (rd *RedisDriver) Get(key string) (value string, err error) {
-	return rd.client.Get(key).Result()
+// SetPrefix - scope all cache keys of this driver under `prefix`.
+// Queues are not affected, they are already namespaced by their names.
+func (rd *RedisDriver) SetPrefix(prefix string) {
+	rd.prefix = prefix
 }
 
-// GetVia - retrieve `key` from Redis
-func (rd *RedisDriver) GetVia(key string, handler func() (string, time.Duration, error)) (value string, err error) {
-	value, err = rd.client.Get(key).Result()
+// Prefix - the prefix applied to cache keys
+func (rd *RedisDriver) Prefix() string {
+	return rd.prefix
+}
 
-	if err != nil && err != redis.Nil {
-		return "", err
-	}
+func (rd *RedisDriver) cacheKey(key string) string {
+	return rd.prefix + key
+}
 
-	value, expiration, err := handler()
+func (rd *RedisDriver) cacheKeys(keys []string) []string {
+	if rd.prefix == "" {
+		return keys
+	}
 
-	if err != nil {
-		return "", err
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = rd.prefix + key
 	}
 
-	return value, rd.Set(key, value, expiration)
+	return prefixed
+}
+
+// Get - retrieve `key` from Redis
+func (rd *RedisDriver) Get(key string) (value string, err error) {
+	return rd.client.Get(rd.cacheKey(key)).Result()
+}
+
+// GetVia - retrieve `key` from Redis, call `handler` to fill it in on a miss
+func (rd *RedisDriver) GetVia(key string, handler func() (string, time.Duration, error)) (value string, err error) {
+	return getVia(rd, &rd.flight, key, handler)
 }
 
 // Set - put `key` into Redis
 func (rd *RedisDriver) Set(key string, value string, expiration time.Duration) (err error) {
-	_, err = rd.client.Set(key, value, expiration).Result()
+	_, err = rd.client.Set(rd.cacheKey(key), value, expiration).Result()
 
 	return
 }
 
 // SetNX - put `key` into Redis if `key` is not exist
 func (rd *RedisDriver) SetNX(key string, value string, expiration time.Duration) (bool, error) {
-	return rd.client.SetNX(key, value, expiration).Result()
+	return rd.client.SetNX(rd.cacheKey(key), value, expiration).Result()
 }
 
 // Has - check if `key` exists in Redis
 func (rd *RedisDriver) Has(key string) (bool, error) {
-	err := rd.client.Get(key).Err()
+	err := rd.client.Get(rd.cacheKey(key)).Err()
 
 	return err == nil, err
 }
 
 // Del - delete `keys` from Redis
 func (rd *RedisDriver) Del(keys ...string) (bool, error) {
-	err := rd.client.Del(keys...).Err()
+	err := rd.client.Del(rd.cacheKeys(keys)...).Err()
 
 	return err == nil, err
 }
 
-// Flush - delete `keys` in the currently selected DB from Redis
+// Flush - delete `keys` in the currently selected DB from Redis.
+// With a prefix, only the keys under the prefix are deleted (found via SCAN).
 func (rd *RedisDriver) Flush() (bool, error) {
+	if rd.prefix != "" {
+		err := rd.flushPrefix()
+
+		return err == nil, err
+	}
+
 	err := rd.client.FlushDB().Err()
 
 	return err == nil, err
 }
 
+// flushPrefix - delete all keys under the prefix, on every master in cluster mode
+func (rd *RedisDriver) flushPrefix() error {
+	return rd.deleteMatching(redisGlobEscaper.Replace(rd.prefix) + "*")
+}
+
+// deleteMatching - delete all keys matching `pattern`, on every master in cluster mode
+func (rd *RedisDriver) deleteMatching(pattern string) error {
+	flush := func(client redis.Cmdable) error {
+		var (
+			cursor uint64
+			keys   []string
+			err    error
+		)
+
+		for {
+			if keys, cursor, err = client.Scan(cursor, pattern, 1000).Result(); err != nil {
+				return err
+			}
+
+			// Delete one by one, keys in a batch may belong to different slots
+			pipeline := client.Pipeline()
+			for _, key := range keys {
+				pipeline.Del(key)
+			}
+			if len(keys) > 0 {
+				if _, err = pipeline.Exec(); err != nil {
+					return err
+				}
+			}
+
+			if cursor == 0 {
+				return nil
+			}
+		}
+	}
+
+	if cluster, ok := rd.client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(func(client *redis.Client) error {
+			return flush(client)
+		})
+	}
+
+	return flush(rd.client)
+}
+
+// redisGlobEscaper - escape the special characters of a SCAN MATCH pattern
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
 // Incr - increase the value of `key`
 func (rd *RedisDriver) Incr(key string) (int64, error) {
-	return rd.client.Incr(key).Result()
+	return rd.client.Incr(rd.cacheKey(key)).Result()
 }
 
 // Decr - decrease the value of `key`
 func (rd *RedisDriver) Decr(key string) (int64, error) {
-	return rd.client.Decr(key).Result()
+	return rd.client.Decr(rd.cacheKey(key)).Result()
 }
 
 // Expire - set the expire time of `key`
 func (rd *RedisDriver) Expire(key string, expiry time.Duration) (bool, error) {
-	return rd.client.Expire(key, expiry).Result()
+	return rd.client.Expire(rd.cacheKey(key), expiry).Result()
 }
 
 // Guard - guard the execution of `handler` with a lock
-func (rd *RedisDriver) Guard(key string, expiration time.Duration, handler func() error) (err error) {
-	acquired, err := rd.client.SetNX(key, "guarded", expiration).Result()
+func (rd *RedisDriver) Guard(key string, expiration time.Duration, handler func() error) error {
+	return guard(rd, key, expiration, handler)
+}
+
+// CompareAndDelete - delete `key` if it holds `value`, atomically via Lua
+func (rd *RedisDriver) CompareAndDelete(key, value string) (bool, error) {
+	/*
+	 * KEYS[1] = key
+	 * ARGV[1] = value
+	 */
+	script := redis.NewScript(`
+		if redis.call('get', KEYS[1]) == ARGV[1] then
+			return redis.call('del', KEYS[1])
+		end
+		return 0
+	`)
+
+	deleted, err := script.Run(rd.client, []string{rd.cacheKey(key)}, value).Int64()
+
+	return deleted == 1, err
+}
+
+// CompareAndExpire - set the expire time of `key` if it holds `value`, atomically via Lua
+func (rd *RedisDriver) CompareAndExpire(key, value string, expiry time.Duration) (bool, error) {
+	/*
+	 * KEYS[1] = key
+	 * ARGV[1] = value
+	 * ARGV[2] = expiry in milliseconds
+	 */
+	script := redis.NewScript(`
+		if redis.call('get', KEYS[1]) == ARGV[1] then
+			return redis.call('pexpire', KEYS[1], ARGV[2])
+		end
+		return 0
+	`)
+
+	expired, err := script.Run(rd.client, []string{rd.cacheKey(key)}, value, int64(expiry/time.Millisecond)).Int64()
+
+	return expired == 1, err
+}
+
+// MGet - retrieve multiple keys from Redis.
+// In cluster mode keys may live in different slots, so the GETs are
+// pipelined and routed to their nodes instead of sending a single MGET.
+func (rd *RedisDriver) MGet(keys ...string) (values map[string]string, err error) {
+	values = make(map[string]string, len(keys))
+
+	if len(keys) == 0 {
+		return
+	}
+
+	if _, ok := rd.client.(*redis.ClusterClient); ok {
+		pipeline := rd.client.Pipeline()
+		cmds := make([]*redis.StringCmd, len(keys))
+
+		for i, key := range keys {
+			cmds[i] = pipeline.Get(rd.cacheKey(key))
+		}
+
+		pipeline.Exec()
+
+		for i, cmd := range cmds {
+			value, err := cmd.Result()
+
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			values[keys[i]] = value
+		}
+
+		return
+	}
+
+	result, err := rd.client.MGet(rd.cacheKeys(keys)...).Result()
 
 	if err != nil {
+		return nil, err
+	}
+
+	for i, value := range result {
+		if str, ok := value.(string); ok {
+			values[keys[i]] = str
+		}
+	}
+
+	return
+}
+
+// MSet - put multiple items into Redis with their own expirations in one pipeline
+func (rd *RedisDriver) MSet(items ...*CacheItem) (err error) {
+	if len(items) == 0 {
+		return
+	}
+
+	pipeline := rd.client.Pipeline()
+
+	for _, item := range items {
+		pipeline.Set(rd.cacheKey(item.Key), item.Value, item.Expiration)
+	}
+
+	_, err = pipeline.Exec()
+
+	return
+}
+
+// MDel - delete multiple keys from Redis, one DEL per key in cluster mode
+func (rd *RedisDriver) MDel(keys ...string) (deleted int64, err error) {
+	if len(keys) == 0 {
+		return
+	}
+
+	if _, ok := rd.client.(*redis.ClusterClient); !ok {
+		return rd.client.Del(rd.cacheKeys(keys)...).Result()
+	}
+
+	pipeline := rd.client.Pipeline()
+	cmds := make([]*redis.IntCmd, len(keys))
+
+	for i, key := range keys {
+		cmds[i] = pipeline.Del(rd.cacheKey(key))
+	}
+
+	if _, err = pipeline.Exec(); err != nil {
 		return
 	}
 
-	if !acquired {
-		return fmt.Errorf("acquiring lock failed: %s", key)
+	for _, cmd := range cmds {
+		deleted += cmd.Val()
+	}
+
+	return
+}
+
+// Batch - start a pipelined batch of operations
+func (rd *RedisDriver) Batch() CacheBatch {
+	return &redisBatch{driver: rd, pipeline: rd.client.Pipeline()}
+}
+
+// redisBatch queues operations in a Redis pipeline, which takes care of
+// routing each command to the right node in cluster mode.
+type redisBatch struct {
+	driver   *RedisDriver
+	pipeline redis.Pipeliner
+	results  []func() error
+}
+
+func (b *redisBatch) Get(key string) *CacheResult {
+	result := &CacheResult{}
+	cmd := b.pipeline.Get(b.driver.cacheKey(key))
+
+	b.results = append(b.results, func() error {
+		result.value, result.err = cmd.Result()
+		return result.err
+	})
+
+	return result
+}
+
+func (b *redisBatch) Set(key, value string, expiration time.Duration) *CacheResult {
+	result := &CacheResult{}
+	cmd := b.pipeline.Set(b.driver.cacheKey(key), value, expiration)
+
+	b.results = append(b.results, func() error {
+		result.err = cmd.Err()
+		return result.err
+	})
+
+	return result
+}
+
+func (b *redisBatch) Del(key string) *CacheResult {
+	result := &CacheResult{}
+	cmd := b.pipeline.Del(b.driver.cacheKey(key))
+
+	b.results = append(b.results, func() error {
+		result.err = cmd.Err()
+		result.ok = result.err == nil
+		return result.err
+	})
+
+	return result
+}
+
+func (b *redisBatch) Incr(key string) *CacheResult {
+	result := &CacheResult{}
+	cmd := b.pipeline.Incr(b.driver.cacheKey(key))
+
+	b.results = append(b.results, func() error {
+		result.number, result.err = cmd.Result()
+		return result.err
+	})
+
+	return result
+}
+
+func (b *redisBatch) Decr(key string) *CacheResult {
+	result := &CacheResult{}
+	cmd := b.pipeline.Decr(b.driver.cacheKey(key))
+
+	b.results = append(b.results, func() error {
+		result.number, result.err = cmd.Result()
+		return result.err
+	})
+
+	return result
+}
+
+func (b *redisBatch) Expire(key string, expiry time.Duration) *CacheResult {
+	result := &CacheResult{}
+	cmd := b.pipeline.Expire(b.driver.cacheKey(key), expiry)
+
+	b.results = append(b.results, func() error {
+		result.ok, result.err = cmd.Result()
+		return result.err
+	})
+
+	return result
+}
+
+func (b *redisBatch) Exec() (err error) {
+	b.pipeline.Exec()
+
+	results := b.results
+	b.results = nil
+
+	for _, fill := range results {
+		if er := fill(); er != nil && er != redis.Nil && err == nil {
+			err = er
+		}
+	}
+
+	return
+}
+
+/* Data structures */
+
+// HGet - get `field` of the hash at `key` from Redis
+func (rd *RedisDriver) HGet(key, field string) (string, error) {
+	return rd.client.HGet(rd.cacheKey(key), field).Result()
+}
+
+// HSet - set `field` of the hash at `key` in Redis
+func (rd *RedisDriver) HSet(key, field, value string) error {
+	return rd.client.HSet(rd.cacheKey(key), field, value).Err()
+}
+
+// HDel - delete `fields` of the hash at `key` from Redis
+func (rd *RedisDriver) HDel(key string, fields ...string) (int64, error) {
+	return rd.client.HDel(rd.cacheKey(key), fields...).Result()
+}
+
+// HGetAll - get all fields of the hash at `key` from Redis
+func (rd *RedisDriver) HGetAll(key string) (map[string]string, error) {
+	return rd.client.HGetAll(rd.cacheKey(key)).Result()
+}
+
+// HIncrBy - add `delta` to `field` of the hash at `key` in Redis
+func (rd *RedisDriver) HIncrBy(key, field string, delta int64) (int64, error) {
+	return rd.client.HIncrBy(rd.cacheKey(key), field, delta).Result()
+}
+
+// ZAdd - add `members` to the sorted set at `key` in Redis
+func (rd *RedisDriver) ZAdd(key string, members ...ZMember) (int64, error) {
+	zs := make([]redis.Z, len(members))
+	for i, member := range members {
+		zs[i] = redis.Z{Score: member.Score, Member: member.Member}
+	}
+
+	return rd.client.ZAdd(rd.cacheKey(key), zs...).Result()
+}
+
+// ZRange - members of the sorted set at `key` by ascending score
+func (rd *RedisDriver) ZRange(key string, start, stop int64) ([]ZMember, error) {
+	return zmembers(rd.client.ZRangeWithScores(rd.cacheKey(key), start, stop).Result())
+}
+
+// ZRevRange - members of the sorted set at `key` by descending score
+func (rd *RedisDriver) ZRevRange(key string, start, stop int64) ([]ZMember, error) {
+	return zmembers(rd.client.ZRevRangeWithScores(rd.cacheKey(key), start, stop).Result())
+}
+
+func zmembers(zs []redis.Z, err error) ([]ZMember, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]ZMember, len(zs))
+	for i, z := range zs {
+		members[i] = ZMember{Member: fmt.Sprint(z.Member), Score: z.Score}
+	}
+
+	return members, nil
+}
+
+// ZRank - the rank of `member` in the sorted set at `key`
+func (rd *RedisDriver) ZRank(key, member string) (int64, error) {
+	return rd.client.ZRank(rd.cacheKey(key), member).Result()
+}
+
+// LPush - prepend `values` to the list at `key` in Redis
+func (rd *RedisDriver) LPush(key string, values ...string) (int64, error) {
+	return rd.client.LPush(rd.cacheKey(key), stringsToInterfaces(values)...).Result()
+}
+
+// RPush - append `values` to the list at `key` in Redis
+func (rd *RedisDriver) RPush(key string, values ...string) (int64, error) {
+	return rd.client.RPush(rd.cacheKey(key), stringsToInterfaces(values)...).Result()
+}
+
+func stringsToInterfaces(values []string) []interface{} {
+	items := make([]interface{}, len(values))
+	for i, value := range values {
+		items[i] = value
+	}
+
+	return items
+}
+
+// LPop - remove and return the first element of the list at `key`
+func (rd *RedisDriver) LPop(key string) (string, error) {
+	return rd.client.LPop(rd.cacheKey(key)).Result()
+}
+
+// RPop - remove and return the last element of the list at `key`
+func (rd *RedisDriver) RPop(key string) (string, error) {
+	return rd.client.RPop(rd.cacheKey(key)).Result()
+}
+
+// LRange - elements of the list at `key` from `start` to `stop`
+func (rd *RedisDriver) LRange(key string, start, stop int64) ([]string, error) {
+	return rd.client.LRange(rd.cacheKey(key), start, stop).Result()
+}
+
+// LTrim - keep only the elements of the list at `key` from `start` to `stop`
+func (rd *RedisDriver) LTrim(key string, start, stop int64) error {
+	return rd.client.LTrim(rd.cacheKey(key), start, stop).Err()
+}
+
+/* Rate limiting */
+
+// Throttle - count a request against the rate limit at `key`, atomically via Lua
+func (rd *RedisDriver) Throttle(key string, limit *RateLimit) (*RateLimitResult, error) {
+	if err := limit.validate(); err != nil {
+		return nil, err
+	}
+
+	key = rd.cacheKey(key)
+
+	var (
+		now    = time.Now().UnixNano() / int64(time.Millisecond)
+		period = int64(limit.Period / time.Millisecond)
+		reply  interface{}
+		err    error
+	)
+
+	switch limit.Algorithm {
+	case RateLimitSlidingWindow:
+		/*
+		 * KEYS[1] = key (sorted set of request times)
+		 * ARGV[1] = now in milliseconds
+		 * ARGV[2] = period in milliseconds
+		 * ARGV[3] = limit
+		 * ARGV[4] = unique member for this request
+		 */
+		script := redis.NewScript(`
+			local now, period, limit = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+			redis.call('zremrangebyscore', KEYS[1], '-inf', now - period)
+			local count = redis.call('zcard', KEYS[1])
+			if count < limit then
+				redis.call('zadd', KEYS[1], now, ARGV[4])
+				redis.call('pexpire', KEYS[1], period)
+				return {1, limit - count - 1, 0}
+			end
+			local oldest = redis.call('zrange', KEYS[1], 0, 0, 'withscores')
+			return {0, 0, tonumber(oldest[2]) + period - now}
+		`)
+		reply, err = script.Run(rd.client, []string{key}, now, period, limit.Limit, GenerateTraceID()).Result()
+	case RateLimitTokenBucket:
+		/*
+		 * KEYS[1] = key (hash of the token count and the last refill time)
+		 * ARGV[1] = capacity
+		 * ARGV[2] = tokens refilled per `period`
+		 * ARGV[3] = period in milliseconds
+		 * ARGV[4] = now in milliseconds
+		 */
+		script := redis.NewScript(`
+			local capacity, rate, now = tonumber(ARGV[1]), tonumber(ARGV[2]) / tonumber(ARGV[3]), tonumber(ARGV[4])
+			local state = redis.call('hmget', KEYS[1], 'tokens', 'ts')
+			local tokens, ts = tonumber(state[1]), tonumber(state[2])
+			if tokens == nil then
+				tokens, ts = capacity, now
+			end
+			tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+			local allowed, wait = 0, 0
+			if tokens >= 1 then
+				tokens, allowed = tokens - 1, 1
+			else
+				wait = math.ceil((1 - tokens) / rate)
+			end
+			redis.call('hmset', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+			redis.call('pexpire', KEYS[1], math.ceil(capacity / rate))
+			return {allowed, math.floor(tokens), wait}
+		`)
+		reply, err = script.Run(rd.client, []string{key}, limit.burst(), limit.Limit, period, now).Result()
+	default:
+		/*
+		 * KEYS[1] = key (request counter of the current window)
+		 * ARGV[1] = period in milliseconds
+		 * ARGV[2] = limit
+		 */
+		script := redis.NewScript(`
+			local count = redis.call('incr', KEYS[1])
+			if count == 1 then
+				redis.call('pexpire', KEYS[1], ARGV[1])
+			end
+			local limit = tonumber(ARGV[2])
+			if count <= limit then
+				return {1, limit - count, 0}
+			end
+			return {0, 0, redis.call('pttl', KEYS[1])}
+		`)
+		reply, err = script.Run(rd.client, []string{key}, period, limit.Limit).Result()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 3 {
+		return nil, fmt.Errorf("unexpected rate limit reply: %v", reply)
 	}
 
-	defer func() {
-		rd.client.Del(key)
+	allowed, _ := values[0].(int64)
+	remaining, _ := values[1].(int64)
+	wait, _ := values[2].(int64)
+
+	return &RateLimitResult{
+		Allowed:    allowed == 1,
+		Remaining:  remaining,
+		RetryAfter: time.Duration(wait) * time.Millisecond,
+	}, nil
+}
+
+/* PubSub */
+
+// Publish - publish `message` on a Redis channel
+func (rd *RedisDriver) Publish(channel, message string) error {
+	return rd.client.Publish(channel, message).Err()
+}
+
+// Subscribe - call `handler` for every message published on a Redis channel.
+// The subscription reconnects on its own until the returned closer is closed.
+func (rd *RedisDriver) Subscribe(channel string, handler func(message string)) io.Closer {
+	pubsub := rd.client.Subscribe(channel)
+
+	go func() {
+		for message := range pubsub.Channel() {
+			handler(message.Payload)
+		}
 	}()
 
-	return handler()
+	return pubsub
 }
 
 /* QueueDriver */
 
-// queue:pending (list, uuid)
+// queue:pending (list, uuid), queue:pending:{critical,high,low} for other priorities
 // queue:working (list, uuid)
 // queue:failure (list, uuid)
 
 // queue:delayed (sorted set, uuid by timestamp)
+// queue:leases (sorted set, uuid by lease deadline in milliseconds)
+// queue:holders (hash, uuid => token of the lease handed out by the last dequeue)
 // queue:backlog (hash, uuid => job)
+// queue:unique:{key} (string, uuid of the job holding the unique key)
+// queue:batch:{id} (hash, counts and callbacks of a batch, job:{uuid} => state of its jobs)
+// queue:chain:{id} (hash, state of a chain of jobs)
 
 // Enqueue pushes a new job into the queue
 func (rd *RedisDriver) Enqueue(queue string, job *Job) (err error) {
@@ -168,16 +831,27 @@ func (rd *RedisDriver) Enqueue(queue string, job *Job) (err error) {
 	/*
 	 * KEYS[1] = backlog
 	 * KEYS[2] = pending
+	 * KEYS[3] = unique
 	 * ARGV[1] = uuid
 	 * ARGV[2] = job
+	 * ARGV[3] = unique key
 	 */
 	script := redis.NewScript(`
+		if ARGV[3] ~= "" then
+			local existing = redis.call("get", KEYS[3])
+			if existing then
+				return existing
+			end
+			redis.call("set", KEYS[3], ARGV[1])
+		end
 		redis.call("hset", KEYS[1], ARGV[1], ARGV[2])
-		return redis.call("lpush", KEYS[2], ARGV[1])
+		redis.call("lpush", KEYS[2], ARGV[1])
+		return ARGV[1]
 	`)
 
-	_, err = script.Run(rd.client, []string{rd.key(queue, "backlog"), rd.key(queue, "pending")}, job.TraceID, job.Serialize()).Result()
-	return
+	id, err := script.Run(rd.client, []string{rd.key(queue, "backlog"), rd.pending(queue, job.Priority), rd.unique(queue, job)}, job.TraceID, job.Serialize(), job.UniqueKey).String()
+
+	return duplicate(job, id, err)
 }
 
 // Schedule pushes a new job into the delayed queue so that it will be processed at a later time.
@@ -190,257 +864,977 @@ func (rd *RedisDriver) Schedule(queue string, job *Job, at time.Time) (err error
 	 * KEYS[1] = backlog
 	 * KEYS[2] = delayed
 	 * KEYS[3] = uuid
+	 * KEYS[4] = unique
 	 * ARGV[1] = job
 	 * ARGV[2] = score
+	 * ARGV[3] = unique key
 	 */
 	script := redis.NewScript(`
+		if ARGV[3] ~= "" then
+			local existing = redis.call("get", KEYS[4])
+			if existing then
+				return existing
+			end
+			redis.call("set", KEYS[4], KEYS[3])
+		end
 		redis.call("hset", KEYS[1], KEYS[3], ARGV[1])
-		return redis.call("zadd", KEYS[2], ARGV[2], KEYS[3])
+		redis.call("zadd", KEYS[2], ARGV[2], KEYS[3])
+		return KEYS[3]
 	`)
 
-	keys := []string{rd.key(queue, "backlog"), rd.key(queue, "delayed"), job.TraceID}
-	argv := []interface{}{job.Serialize(), at.Unix()}
+	keys := []string{rd.key(queue, "backlog"), rd.key(queue, "delayed"), job.TraceID, rd.unique(queue, job)}
+	argv := []interface{}{job.Serialize(), at.Unix(), job.UniqueKey}
 
-	fmt.Println(keys)
-	fmt.Println(argv)
+	id, err := script.Run(rd.client, keys, argv...).String()
 
-	_, err = script.Run(rd.client, keys, argv...).Result()
-	return
+	return duplicate(job, id, err)
+}
+
+// unique - the key holding the unique key of `job`
+func (rd *RedisDriver) unique(queue string, job *Job) string {
+	return rd.key(queue, "unique:"+job.UniqueKey)
 }
 
 // Dequeue retrieves a job from the queue
 func (rd *RedisDriver) Dequeue(queue string) (job *Job, err error) {
 	/*
-	 * 1. BRPOPLPUSH queue:pending queue:working
+	 * 1. RPOPLPUSH queue:pending* queue:working, highest priority first
 	 * 2. Fetch jobs from queue:backlog
 	 */
 	var (
 		jobID, serialized string
 	)
-	if rd.settings.Blocking {
-		jobID, err = rd.client.BRPopLPush(rd.key(queue, "pending"), rd.key(queue, "working"), time.Duration(rd.settings.ReadTimeout)*time.Second).Result()
+
+	jobID, err = rd.pop(queue)
+
+	if err == redis.Nil && rd.settings.Blocking {
+		// Block on the normal priority list, checking the others every second
+		var deadline time.Time
+		if rd.settings.ReadTimeout > 0 {
+			deadline = time.Now().Add(time.Duration(rd.settings.ReadTimeout) * time.Second)
+		}
+
+		for err == redis.Nil && (deadline.IsZero() || time.Now().Before(deadline)) {
+			jobID, err = rd.client.BRPopLPush(rd.pending(queue, PriorityNormal), rd.key(queue, "working"), time.Second).Result()
+			if err == redis.Nil {
+				jobID, err = rd.pop(queue)
+			}
+		}
+	}
+
+	if err != nil {
+		return
+	}
+
+	// A job left without a lease by a crash right here is leased by the reaper
+	var lease string
+	if timeout := visibilityTimeout(rd.settings.VisibilityTimeout); timeout > 0 {
+		lease = GenerateTraceID()
+		rd.client.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.ZAdd(rd.key(queue, "leases"), redis.Z{Score: float64(leaseDeadline(timeout)), Member: jobID})
+			pipe.HSet(rd.key(queue, "holders"), jobID, lease)
+			return nil
+		})
+	}
+
+	logger.Dataf("Job ID: %s", jobID)
+	if serialized, err = rd.client.HGet(rd.key(queue, "backlog"), jobID).Result(); err != nil {
+		return
+	}
+
+	job = &Job{lease: lease}
+	err = json.Unmarshal([]byte(serialized), job)
+
+	return
+}
+
+// pop - move the next pending job to `working`, redis.Nil when there is none
+func (rd *RedisDriver) pop(queue string) (jobID string, err error) {
+	/*
+	 * KEYS[1..n-1] = pending lists, highest priority first
+	 * KEYS[n] = working
+	 */
+	script := redis.NewScript(`
+		for i = 1, #KEYS - 1 do
+			local id = redis.call('rpoplpush', KEYS[i], KEYS[#KEYS])
+			if id then
+				return id
+			end
+		end
+		return false
+	`)
+
+	return script.Run(rd.client, append(rd.pendings(queue), rd.key(queue, "working"))).String()
+}
+
+// pending - the pending list of jobs of `priority`
+func (rd *RedisDriver) pending(queue string, priority int) string {
+	switch priorityLevel(priority) {
+	case PriorityCritical:
+		return rd.key(queue, "pending:critical")
+	case PriorityHigh:
+		return rd.key(queue, "pending:high")
+	case PriorityLow:
+		return rd.key(queue, "pending:low")
+	}
+	return rd.key(queue, "pending")
+}
+
+// pendingIndex - the index, from 1 as in Lua, of the pending list of `priority` in `pendings`
+func pendingIndex(priority int) int {
+	for i, level := range Priorities {
+		if level == priorityLevel(priority) {
+			return i + 1
+		}
+	}
+	return len(Priorities)
+}
+
+// pendings - the pending lists, in the order of `Priorities`
+func (rd *RedisDriver) pendings(queue string) (keys []string) {
+	for _, priority := range Priorities {
+		keys = append(keys, rd.pending(queue, priority))
+	}
+	return
+}
+
+// redisHoldsLease - Lua checking that the caller still holds the lease of a
+// job, jobs handled without a lease are always held
+const redisHoldsLease = `
+	local function holds(holders, id, lease)
+		return lease == '' or redis.call('hget', holders, id) == lease
+	end
+`
+
+// leaseLost - ErrorJobLeaseLost when a script refused to act, returning -1,
+// because the caller no longer holds the lease of the job
+func leaseLost(result int64, err error) error {
+	if err == nil && result < 0 {
+		return ErrorJobLeaseLost
+	}
+	return err
+}
+
+// Attempt requeues the job
+func (rd *RedisDriver) Attempt(queue string, job *Job) (err error) {
+	job.Attempt()
+
+	/*
+	 * KEYS[1] = backlog
+	 * KEYS[2] = holders
+	 * ARGV[1] = uuid
+	 * ARGV[2] = job
+	 * ARGV[3] = lease
+	 */
+	script := redis.NewScript(redisHoldsLease + `
+		if not holds(KEYS[2], ARGV[1], ARGV[3]) then
+			return -1
+		end
+		return redis.call('hset', KEYS[1], ARGV[1], ARGV[2])
+	`)
+
+	return leaseLost(script.Run(rd.client, []string{rd.key(queue, "backlog"), rd.key(queue, "holders")}, job.TraceID, job.Serialize(), job.lease).Int64())
+}
+
+// Requeue requeues the job
+func (rd *RedisDriver) Requeue(queue string, job *Job) (err error) {
+	/*
+	 * KEYS[1] = working
+	 * KEYS[2] = pending
+	 * KEYS[3] = leases
+	 * KEYS[4] = holders
+	 * ARGV[1] = uuid
+	 * ARGV[2] = lease
+	 */
+	script := redis.NewScript(redisHoldsLease + `
+		if not holds(KEYS[4], ARGV[1], ARGV[2]) then
+			return -1
+		end
+		redis.call('lrem', KEYS[1], 0, ARGV[1])
+		redis.call('zrem', KEYS[3], ARGV[1])
+		redis.call('hdel', KEYS[4], ARGV[1])
+		return redis.call('lpush', KEYS[2], ARGV[1])
+	`)
+
+	keys := []string{rd.key(queue, "working"), rd.pending(queue, job.Priority), rd.key(queue, "leases"), rd.key(queue, "holders")}
+
+	return leaseLost(script.Run(rd.client, keys, job.TraceID, job.lease).Int64())
+}
+
+// Complete removes the job from the queue entirely.
+func (rd *RedisDriver) Complete(queue string, job *Job) (err error) {
+	/*
+	 * KEYS[1] = working
+	 * KEYS[2] = backlog
+	 * KEYS[3] = leases
+	 * KEYS[4] = unique
+	 * KEYS[5] = batch
+	 * KEYS[6] = chain
+	 * KEYS[7] = pending (priority of the next step)
+	 * KEYS[8] = holders
+	 * KEYS[9..n] = pending lists, in the order of the priorities
+	 * ARGV[1] = uuid
+	 * ARGV[2] = unique key
+	 * ARGV[3] = uniqueness window
+	 * ARGV[4] = batch id
+	 * ARGV[5] = now
+	 * ARGV[6] = batch retention
+	 * ARGV[7] = chain id
+	 * ARGV[8] = uuid of the next step
+	 * ARGV[9] = next step
+	 * ARGV[10] = chain retention
+	 * ARGV[11] = lease
+	 */
+	script := redis.NewScript(redisHoldsLease + redisSettleBatch + `
+		if not holds(KEYS[8], ARGV[1], ARGV[11]) then
+			return -1
+		end
+		redis.call('lrem', KEYS[1], 0, ARGV[1])
+		redis.call('zrem', KEYS[3], ARGV[1])
+		redis.call('hdel', KEYS[8], ARGV[1])
+		if ARGV[2] ~= '' and redis.call('get', KEYS[4]) == ARGV[1] then
+			if tonumber(ARGV[3]) > 0 then
+				redis.call('expire', KEYS[4], ARGV[3])
+			else
+				redis.call('del', KEYS[4])
+			end
+		end
+		if ARGV[4] ~= '' then
+			settle(KEYS[5], KEYS[2], {unpack(KEYS, 9)}, ARGV[1], 'succeeded', ARGV[5], ARGV[6])
+		end
+		if ARGV[7] ~= '' and redis.call('hget', KEYS[6], 'job') == ARGV[1] then
+			if ARGV[8] ~= '' then
+				redis.call('hset', KEYS[2], ARGV[8], ARGV[9])
+				redis.call('lpush', KEYS[7], ARGV[8])
+				redis.call('hincrby', KEYS[6], 'step', 1)
+				redis.call('hset', KEYS[6], 'job', ARGV[8])
+			else
+				redis.call('hset', KEYS[6], 'status', 'completed')
+				redis.call('hset', KEYS[6], 'finished', ARGV[5])
+				redis.call('expire', KEYS[6], ARGV[10])
+			end
+		end
+		return redis.call('hdel', KEYS[2], ARGV[1])
+	`)
+
+	var nextID, nextJob string
+	next := job.successor()
+	if next != nil {
+		nextID, nextJob = next.TraceID, next.Serialize()
 	} else {
-		jobID, err = rd.client.RPopLPush(rd.key(queue, "pending"), rd.key(queue, "working")).Result()
+		next = job
+	}
+
+	keys := append([]string{
+		rd.key(queue, "working"),
+		rd.key(queue, "backlog"),
+		rd.key(queue, "leases"),
+		rd.unique(queue, job),
+		rd.key(queue, "batch:"+job.BatchID),
+		rd.key(queue, "chain:"+job.ChainID),
+		rd.pending(queue, next.Priority),
+		rd.key(queue, "holders"),
+	}, rd.pendings(queue)...)
+
+	return leaseLost(script.Run(rd.client, keys,
+		job.TraceID, job.UniqueKey, job.UniqueFor, job.BatchID, time.Now().Unix(), int64(batchRetention/time.Second),
+		job.ChainID, nextID, nextJob, int64(chainRetention/time.Second), job.lease,
+	).Int64())
+}
+
+// Defer moves the job to a deferred queue for processing at a later time.
+func (rd *RedisDriver) Defer(queue string, job *Job, after time.Duration) (err error) {
+	/*
+	 * KEYS[1] = working
+	 * KEYS[2] = delayed
+	 * KEYS[3] = leases
+	 * KEYS[4] = holders
+	 * ARGV[1] = uuid
+	 * ARGV[2] = score
+	 * ARGV[3] = lease
+	 */
+	script := redis.NewScript(redisHoldsLease + `
+		if not holds(KEYS[4], ARGV[1], ARGV[3]) then
+			return -1
+		end
+		redis.call('lrem', KEYS[1], 0, ARGV[1])
+		redis.call('zrem', KEYS[3], ARGV[1])
+		redis.call('hdel', KEYS[4], ARGV[1])
+		return redis.call('zadd', KEYS[2], ARGV[2], ARGV[1])
+	`)
+
+	keys := []string{rd.key(queue, "working"), rd.key(queue, "delayed"), rd.key(queue, "leases"), rd.key(queue, "holders")}
+
+	return leaseLost(script.Run(rd.client, keys, job.TraceID, time.Now().Add(after).Unix(), job.lease).Int64())
+}
+
+// Fail moves the job into a failure list for trouble shooting.
+func (rd *RedisDriver) Fail(queue string, job *Job) (err error) {
+	job.FailedAt = time.Now().Unix()
+
+	/*
+	 * KEYS[1] = working
+	 * KEYS[2] = failure
+	 * KEYS[3] = backlog
+	 * KEYS[4] = leases
+	 * KEYS[5] = unique
+	 * KEYS[6] = batch
+	 * KEYS[7] = chain
+	 * KEYS[8] = holders
+	 * KEYS[9..n] = pending lists, in the order of the priorities
+	 * ARGV[1] = uuid
+	 * ARGV[2] = job
+	 * ARGV[3] = unique key
+	 * ARGV[4] = batch id
+	 * ARGV[5] = now
+	 * ARGV[6] = batch retention
+	 * ARGV[7] = chain id
+	 * ARGV[8] = error
+	 * ARGV[9] = lease
+	 */
+	script := redis.NewScript(redisHoldsLease + redisSettleBatch + `
+		if not holds(KEYS[8], ARGV[1], ARGV[9]) then
+			return -1
+		end
+		redis.call('lrem', KEYS[1], 0, ARGV[1])
+		redis.call('zrem', KEYS[4], ARGV[1])
+		redis.call('hdel', KEYS[8], ARGV[1])
+		if ARGV[3] ~= '' and redis.call('get', KEYS[5]) == ARGV[1] then
+			redis.call('del', KEYS[5])
+		end
+		redis.call('hset', KEYS[3], ARGV[1], ARGV[2])
+		if ARGV[4] ~= '' then
+			settle(KEYS[6], KEYS[3], {unpack(KEYS, 9)}, ARGV[1], 'failed', ARGV[5], ARGV[6])
+		end
+		if ARGV[7] ~= '' and redis.call('hget', KEYS[7], 'job') == ARGV[1] then
+			redis.call('hset', KEYS[7], 'status', 'failed')
+			redis.call('hset', KEYS[7], 'error', ARGV[8])
+			redis.call('hset', KEYS[7], 'finished', ARGV[5])
+		end
+		return redis.call('lpush', KEYS[2], ARGV[1])
+	`)
+
+	keys := append([]string{
+		rd.key(queue, "working"),
+		rd.key(queue, "failure"),
+		rd.key(queue, "backlog"),
+		rd.key(queue, "leases"),
+		rd.unique(queue, job),
+		rd.key(queue, "batch:"+job.BatchID),
+		rd.key(queue, "chain:"+job.ChainID),
+		rd.key(queue, "holders"),
+	}, rd.pendings(queue)...)
+
+	return leaseLost(script.Run(rd.client, keys,
+		job.TraceID, job.Serialize(), job.UniqueKey, job.BatchID, time.Now().Unix(), int64(batchRetention/time.Second),
+		job.ChainID, job.LastError, job.lease,
+	).Int64())
+}
+
+// get - get the Job object by its uuid
+func (rd *RedisDriver) get(queue string, id string) (job *Job, err error) {
+	var serialized string
+	if serialized, err = rd.client.HGet(rd.key(queue, "backlog"), id).Result(); err != nil {
+		return nil, err
 	}
+	job = &Job{}
+	err = json.Unmarshal([]byte(serialized), job)
+	return job, err
+}
+
+// RequeueAllFailed - requeue all failed jobs (move jobs from `failure` into `pending`)
+func (rd *RedisDriver) RequeueAllFailed(queue string) (jobIDs []string, err error) {
+	var (
+		job *Job
+		ids []string
+	)
+	if ids, err = rd.client.LRange(rd.key(queue, "failure"), 0, -1).Result(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if job, err = rd.get(queue, id); err != nil {
+			if err == redis.Nil {
+				rd.client.LRem(rd.key(queue, "failure"), 0, id)
+			}
+		} else {
+			if err = rd.retry(queue, job); err == nil {
+				jobIDs = append(jobIDs, job.TraceID)
+			}
+		}
+	}
+	return jobIDs, nil
+}
+
+// retry - move a failed job from the `failure` list to `pending`.
+//         the attempt count of that job will be reset to zero.
+//         the job stays failed if another job holds its unique key.
+func (rd *RedisDriver) retry(queue string, job *Job) (err error) {
+	// Reset attempt count
+	job.Attempts = 0
+
+	/*
+	 * KEYS[1] = backlog
+	 * KEYS[2] = failure
+	 * KEYS[3] = pending
+	 * KEYS[4] = unique
+	 * KEYS[5] = batch
+	 * KEYS[6] = chain
+	 * ARGV[1] = uuid
+	 * ARGV[2] = payload
+	 * ARGV[3] = unique key
+	 */
+	script := redis.NewScript(`
+		if ARGV[3] ~= '' then
+			local holder = redis.call('get', KEYS[4])
+			if holder and holder ~= ARGV[1] then
+				if redis.call('hexists', KEYS[1], ARGV[1]) == 0 then
+					return 0
+				end
+				return -1
+			end
+		end
+		if redis.call('lrem', KEYS[2], 0, ARGV[1]) == 0 then
+			return 0
+		end
+		if ARGV[3] ~= '' then
+			redis.call('set', KEYS[4], ARGV[1])
+		end
+		if redis.call('hget', KEYS[5], 'job:' .. ARGV[1]) == 'failed' then
+			redis.call('hset', KEYS[5], 'job:' .. ARGV[1], 'pending')
+			redis.call('hincrby', KEYS[5], 'failed', -1)
+			redis.call('hincrby', KEYS[5], 'pending', 1)
+			redis.call('hset', KEYS[5], 'finished', 0)
+			redis.call('persist', KEYS[5])
+		end
+		if redis.call('hget', KEYS[6], 'job') == ARGV[1] and redis.call('hget', KEYS[6], 'status') == 'failed' then
+			redis.call('hset', KEYS[6], 'status', 'running')
+			redis.call('hset', KEYS[6], 'error', '')
+			redis.call('hset', KEYS[6], 'finished', 0)
+		end
+		redis.call('hset', KEYS[1], ARGV[1], ARGV[2])
+		return redis.call('lpush', KEYS[3], ARGV[1])
+	`)
+
+	requeued, err := script.Run(rd.client, []string{
+		rd.key(queue, "backlog"),
+		rd.key(queue, "failure"),
+		rd.pending(queue, job.Priority),
+		rd.unique(queue, job),
+		rd.key(queue, "batch:"+job.BatchID),
+		rd.key(queue, "chain:"+job.ChainID),
+	}, job.TraceID, job.Serialize(), job.UniqueKey).Int64()
+
+	if err == nil && requeued == 0 {
+		err = ErrorJobNotFound
+	}
+	if err == nil && requeued < 0 {
+		err = ErrorJobDuplicate
+	}
+
+	return
+}
+
+// Failed - list failed jobs, most recent failure first
+func (rd *RedisDriver) Failed(queue string, offset, limit int64) (jobs []*Job, err error) {
+	ids, err := rd.client.LRange(rd.key(queue, "failure"), offset, offset+limit-1).Result()
+	if err != nil || len(ids) == 0 {
+		return
+	}
+
+	serialized, err := rd.client.HMGet(rd.key(queue, "backlog"), ids...).Result()
+	if err != nil {
+		return
+	}
+
+	for _, value := range serialized {
+		// The job may have been deleted in the meantime
+		if value, ok := value.(string); ok {
+			job := &Job{}
+			if err = job.Unserialize(value); err != nil {
+				return nil, err
+			}
+			jobs = append(jobs, job)
+		}
+	}
+
+	return
+}
+
+// Find - get a job of the queue by its ID
+func (rd *RedisDriver) Find(queue string, id string) (job *Job, err error) {
+	if job, err = rd.get(queue, id); err == redis.Nil {
+		return nil, ErrorJobNotFound
+	}
+
+	return
+}
+
+// RequeueFailed - move a failed job back to `pending`, resetting its attempt count
+func (rd *RedisDriver) RequeueFailed(queue string, id string) (err error) {
+	job, err := rd.Find(queue, id)
+	if err != nil {
+		return
+	}
+
+	return rd.retry(queue, job)
+}
+
+// DeleteFailed - remove a failed job from the queue entirely
+func (rd *RedisDriver) DeleteFailed(queue string, id string) (err error) {
+	/*
+	 * KEYS[1] = failure
+	 * KEYS[2] = backlog
+	 * ARGV[1] = uuid
+	 */
+	script := redis.NewScript(`
+		if redis.call('lrem', KEYS[1], 0, ARGV[1]) == 0 then
+			return 0
+		end
+		redis.call('hdel', KEYS[2], ARGV[1])
+		return 1
+	`)
+
+	deleted, err := script.Run(rd.client, []string{rd.key(queue, "failure"), rd.key(queue, "backlog")}, id).Int64()
+
+	if err == nil && deleted == 0 {
+		err = ErrorJobNotFound
+	}
+
+	return
+}
+
+// PurgeFailed - remove the jobs that failed before `before`. Jobs failed
+// before their failure time was recorded are always removed.
+func (rd *RedisDriver) PurgeFailed(queue string, before time.Time) (count int64, err error) {
+	ids, err := rd.client.LRange(rd.key(queue, "failure"), 0, -1).Result()
+	if err != nil || len(ids) == 0 {
+		return
+	}
+
+	serialized, err := rd.client.HMGet(rd.key(queue, "backlog"), ids...).Result()
+	if err != nil {
+		return
+	}
+
+	for i, value := range serialized {
+		job := &Job{}
+		if value, ok := value.(string); ok {
+			if err = job.Unserialize(value); err != nil {
+				return
+			}
+		}
+
+		if job.FailedAt >= before.Unix() {
+			continue
+		}
+
+		if err = rd.DeleteFailed(queue, ids[i]); err == nil {
+			count++
+		} else if err != ErrorJobNotFound {
+			return
+		}
+	}
+
+	return count, nil
+}
+
+// Truncate discards everything (!!DANGER!!) currently stored in the queue
+func (rd *RedisDriver) Truncate(queue string) (err error) {
+	deleted, err := rd.client.Del(append(
+		rd.pendings(queue),
+		rd.key(queue, "working"),
+		rd.key(queue, "failure"),
+		rd.key(queue, "backlog"),
+		rd.key(queue, "delayed"),
+		rd.key(queue, "leases"),
+		rd.key(queue, "holders"),
+	)...).Result()
+
+	if err == nil {
+		err = rd.deleteMatching(redisGlobEscaper.Replace(rd.key(queue, "unique:")) + "*")
+	}
+
+	logger.Dataf("deleted %s, %s, %s", deleted, queue, err)
+	return
+}
+
+// Stats - get the stats of the queue
+func (rd *RedisDriver) Stats(queue string) (stats *QueueStats, err error) {
+	/*
+	 * KEYS[1] = working
+	 * KEYS[2] = failure
+	 * KEYS[3] = backlog
+	 * KEYS[4] = delayed
+	 * KEYS[5..n] = pending lists, in the order of the priorities
+	 * ARGV[1] = now
+	 */
+	script := redis.NewScript(`
+		local working = redis.call('llen', KEYS[1])
+		local failure = redis.call('llen', KEYS[2])
+		local backlog = redis.call('hlen', KEYS[3])
+		local delayed = redis.call('zcount', KEYS[4], '-inf', '+inf')
+		local waiting = redis.call('zcount', KEYS[4], '-inf', ARGV[1])
+
+		local counts = {working, failure, delayed, backlog, waiting}
+		for i = 5, #KEYS do
+			table.insert(counts, redis.call('llen', KEYS[i]))
+		end
+
+		return counts
+	`)
+
+	keys := append([]string{
+		rd.key(queue, "working"),
+		rd.key(queue, "failure"),
+		rd.key(queue, "backlog"),
+		rd.key(queue, "delayed"),
+	}, rd.pendings(queue)...)
+
+	result, err := script.Run(rd.client, keys, time.Now().Unix()).Result()
 
 	if err != nil {
 		return
 	}
 
-	logger.Dataf("Job ID: %s", jobID)
-	if serialized, err = rd.client.HGet(rd.key(queue, "backlog"), jobID).Result(); err != nil {
-		return
+	counts := result.([]interface{})
+
+	stats = &QueueStats{
+		Working:    counts[0].(int64),
+		Failure:    counts[1].(int64),
+		Delayed:    counts[2].(int64),
+		Backlog:    counts[3].(int64),
+		Waiting:    counts[4].(int64),
+		Priorities: make(map[int]int64),
 	}
 
-	job = &Job{}
-	err = json.Unmarshal([]byte(serialized), job)
+	for i, priority := range Priorities {
+		stats.Priorities[priority] = counts[5+i].(int64)
+		stats.Pending += counts[5+i].(int64)
+	}
 
-	return
+	return stats, nil
 }
 
-// Attempt requeues the job
-func (rd *RedisDriver) Attempt(queue string, job *Job) (err error) {
-	job.Attempt()
+// redisSettleBatch - Lua counting a job of a batch as `state` (succeeded or
+// failed), queueing the matching callback job once the last job settled onto
+// the pending list, among `pendings`, of the priority of the callbacks
+const redisSettleBatch = `
+	local function settle(batch, backlog, pendings, id, state, now, retention)
+		if redis.call('hget', batch, 'job:' .. id) ~= 'pending' then
+			return
+		end
 
-	_, err = rd.client.HSet(rd.key(queue, "backlog"), job.TraceID, job.Serialize()).Result()
+		redis.call('hset', batch, 'job:' .. id, state)
+		redis.call('hincrby', batch, state, 1)
+		if redis.call('hincrby', batch, 'pending', -1) > 0 then
+			return
+		end
 
-	return
-}
+		local callback = 'complete'
+		if tonumber(redis.call('hget', batch, 'failed')) > 0 then
+			callback = 'failure'
+		end
 
-// Requeue requeues the job
-func (rd *RedisDriver) Requeue(queue string, job *Job) (err error) {
-	/*
-	 * KEYS[1] = working
-	 * KEYS[2] = pending
-	 * ARGV[1] = uuid
-	 */
-	script := redis.NewScript(`
-		redis.call('lrem', KEYS[1], 0, ARGV[1])
-		return redis.call('lpush', KEYS[2], ARGV[1])
-	`)
+		local callbackID = redis.call('hget', batch, callback .. ':id')
+		if callbackID then
+			redis.call('hset', backlog, callbackID, redis.call('hget', batch, callback .. ':job'))
+			-- Batches queued before callbacks had a priority call back with normal priority
+			local list = tonumber(redis.call('hget', batch, 'callback:list')) or 3
+			redis.call('lpush', pendings[list], callbackID)
+		end
 
-	_, err = script.Run(rd.client, []string{rd.key(queue, "working"), rd.key(queue, "pending")}, job.TraceID).Result()
+		redis.call('hset', batch, 'finished', now)
+		redis.call('expire', batch, retention)
+	end
+`
+
+// EnqueueBatch pushes the jobs of a batch into the queue, along with the batch itself
+func (rd *RedisDriver) EnqueueBatch(queue string, batch *Batch, jobs []*Job) (err error) {
+	fields := []interface{}{
+		"total", batch.Total,
+		"pending", batch.Pending,
+		"succeeded", 0,
+		"failed", 0,
+		"created", batch.CreatedAt,
+		"finished", 0,
+		"payload", batch.Payload,
+		"on-complete", batch.OnComplete,
+		"on-failure", batch.OnFailure,
+		"priority", batch.Priority,
+		"callback:list", pendingIndex(batch.Priority),
+	}
 
-	return
-}
+	complete, failure := batch.callbacks()
+	if complete != nil {
+		fields = append(fields, "complete:id", complete.TraceID, "complete:job", complete.Serialize())
+	}
+	if failure != nil {
+		fields = append(fields, "failure:id", failure.TraceID, "failure:job", failure.Serialize())
+	}
 
-// Complete removes the job from the queue entirely.
-func (rd *RedisDriver) Complete(queue string, job *Job) (err error) {
 	/*
-	 * KEYS[1] = working
+	 * KEYS[1] = batch
 	 * KEYS[2] = backlog
-	 * ARGV[1] = uuid
+	 * KEYS[3..n] = pending lists, in the order of the priorities
+	 * ARGV[1] = number of fields of the batch
+	 * ARGV[2..2m+1] = fields and values of the batch
+	 * ARGV[2m+2..] = uuid, job and index of the pending list of each job
 	 */
 	script := redis.NewScript(`
-		redis.call('lrem', KEYS[1], 0, ARGV[1])
-		return redis.call('hdel', KEYS[2], ARGV[1])
+		local m = tonumber(ARGV[1])
+		for i = 2, 2 * m, 2 do
+			redis.call('hset', KEYS[1], ARGV[i], ARGV[i + 1])
+		end
+
+		for i = 2 * m + 2, #ARGV, 3 do
+			redis.call('hset', KEYS[1], 'job:' .. ARGV[i], 'pending')
+			redis.call('hset', KEYS[2], ARGV[i], ARGV[i + 1])
+			redis.call('lpush', KEYS[2 + tonumber(ARGV[i + 2])], ARGV[i])
+		end
+
+		return 1
 	`)
 
-	_, err = script.Run(rd.client, []string{rd.key(queue, "working"), rd.key(queue, "backlog")}, job.TraceID).Result()
+	argv := append([]interface{}{len(fields) / 2}, fields...)
+	for _, job := range jobs {
+		argv = append(argv, job.TraceID, job.Serialize(), pendingIndex(job.Priority))
+	}
+
+	keys := append([]string{rd.key(queue, "batch:"+batch.ID), rd.key(queue, "backlog")}, rd.pendings(queue)...)
+
+	_, err = script.Run(rd.client, keys, argv...).Result()
 
 	return
 }
 
-// Defer moves the job to a deferred queue for processing at a later time.
-func (rd *RedisDriver) Defer(queue string, job *Job, after time.Duration) (err error) {
-	/*
-	 * KEYS[1] = working
-	 * KEYS[2] = delayed
-	 * ARGV[1] = uuid
-	 * ARGV[2] = score
-	 */
-	script := redis.NewScript(`
-		redis.call('lrem', KEYS[1], 0, ARGV[1])
-		return redis.call('zadd', KEYS[2], ARGV[2], ARGV[1])
-	`)
+// FindBatch gets a batch with its counts
+func (rd *RedisDriver) FindBatch(queue string, id string) (batch *Batch, err error) {
+	fields, err := rd.client.HMGet(rd.key(queue, "batch:"+id),
+		"total", "pending", "succeeded", "failed", "created", "finished", "payload", "on-complete", "on-failure", "priority",
+	).Result()
 
-	_, err = script.Run(rd.client, []string{rd.key(queue, "working"), rd.key(queue, "delayed")}, job.TraceID, time.Now().Add(after).Unix()).Result()
-	return
+	if err != nil {
+		return
+	}
+	if fields[0] == nil {
+		return nil, ErrorBatchNotFound
+	}
+
+	values := make([]int64, len(fields))
+	for i, field := range fields {
+		if field, ok := field.(string); ok && i != 6 {
+			values[i], _ = strconv.ParseInt(field, 10, 64)
+		}
+	}
+	payload, _ := fields[6].(string)
+
+	return &Batch{
+		ID:         id,
+		OnComplete: int(values[7]),
+		OnFailure:  int(values[8]),
+		Payload:    payload,
+		Priority:   int(values[9]),
+		Total:      values[0],
+		Pending:    values[1],
+		Succeeded:  values[2],
+		Failed:     values[3],
+		CreatedAt:  values[4],
+		FinishedAt: values[5],
+	}, nil
 }
 
-// Fail moves the job into a failure list for trouble shooting.
-func (rd *RedisDriver) Fail(queue string, job *Job) (err error) {
+// EnqueueChain pushes the first step of a chain into the queue, along with the chain itself
+func (rd *RedisDriver) EnqueueChain(queue string, chain *Chain, job *Job) (err error) {
 	/*
-	 * KEYS[1] = working
-	 * KEYS[2] = failure
+	 * KEYS[1] = chain
+	 * KEYS[2] = backlog
+	 * KEYS[3] = pending
 	 * ARGV[1] = uuid
+	 * ARGV[2] = job
+	 * ARGV[3] = steps
+	 * ARGV[4] = now
 	 */
 	script := redis.NewScript(`
-		redis.call('lrem', KEYS[1], 0, ARGV[1])
-		return redis.call('lpush', KEYS[2], ARGV[1])
+		redis.call('hset', KEYS[1], 'steps', ARGV[3])
+		redis.call('hset', KEYS[1], 'step', 0)
+		redis.call('hset', KEYS[1], 'job', ARGV[1])
+		redis.call('hset', KEYS[1], 'status', 'running')
+		redis.call('hset', KEYS[1], 'error', '')
+		redis.call('hset', KEYS[1], 'created', ARGV[4])
+		redis.call('hset', KEYS[1], 'finished', 0)
+		redis.call('hset', KEYS[2], ARGV[1], ARGV[2])
+		return redis.call('lpush', KEYS[3], ARGV[1])
 	`)
 
-	_, err = script.Run(rd.client, []string{rd.key(queue, "working"), rd.key(queue, "failure")}, job.TraceID).Result()
+	keys := []string{rd.key(queue, "chain:"+chain.ID), rd.key(queue, "backlog"), rd.pending(queue, job.Priority)}
+
+	_, err = script.Run(rd.client, keys, job.TraceID, job.Serialize(), chain.Steps, chain.CreatedAt).Result()
+
 	return
 }
 
-// get - get the Job object by its uuid
-func (rd *RedisDriver) get(queue string, id string) (job *Job, err error) {
-	var serialized string
-	if serialized, err = rd.client.HGet(rd.key(queue, "backlog"), id).Result(); err != nil {
-		return nil, err
-	}
-	job = &Job{}
-	err = json.Unmarshal([]byte(serialized), job)
-	return job, err
-}
+// FindChain gets a chain with the state of its steps
+func (rd *RedisDriver) FindChain(queue string, id string) (chain *Chain, err error) {
+	fields, err := rd.client.HMGet(rd.key(queue, "chain:"+id),
+		"steps", "step", "job", "status", "error", "created", "finished",
+	).Result()
 
-// RequeueAllFailed - requeue all failed jobs (move jobs from `failure` into `pending`)
-func (rd *RedisDriver) RequeueAllFailed(queue string) (jobIDs []string, err error) {
-	var (
-		job *Job
-		ids []string
-	)
-	if ids, err = rd.client.LRange(rd.key(queue, "failure"), 0, -1).Result(); err != nil {
-		return nil, err
+	if err != nil {
+		return
+	}
+	if fields[0] == nil {
+		return nil, ErrorChainNotFound
 	}
 
-	for _, id := range ids {
-		if job, err = rd.get(queue, id); err != nil {
-			if err == redis.Nil {
-				rd.client.LRem(rd.key(queue, "failure"), 0, id)
-			}
-		} else {
-			if err = rd.retry(queue, job); err == nil {
-				jobIDs = append(jobIDs, job.TraceID)
-			}
-		}
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		values[i], _ = field.(string)
 	}
-	return jobIDs, nil
+
+	chain = &Chain{ID: id, JobID: values[2], Status: values[3], LastError: values[4]}
+	chain.Steps, _ = strconv.Atoi(values[0])
+	chain.Step, _ = strconv.Atoi(values[1])
+	chain.CreatedAt, _ = strconv.ParseInt(values[5], 10, 64)
+	chain.FinishedAt, _ = strconv.ParseInt(values[6], 10, 64)
+
+	return
 }
 
-// retry - move a failed job from the `failure` list to `pending`.
-//         the attempt count of that job will be reset to zero.
-func (rd *RedisDriver) retry(queue string, job *Job) (err error) {
-	// Reset attempt count
-	job.Attempts = 0
+// VisibilityTimeout - the lease of dequeued jobs, zero when leases are disabled
+func (rd *RedisDriver) VisibilityTimeout() time.Duration {
+	return visibilityTimeout(rd.settings.VisibilityTimeout)
+}
+
+// Heartbeat extends the lease of a job being processed to `lease` from now,
+// or to the visibility timeout when `lease` is zero.
+func (rd *RedisDriver) Heartbeat(queue string, job *Job, lease time.Duration) (err error) {
+	if lease <= 0 {
+		lease = visibilityTimeout(rd.settings.VisibilityTimeout)
+	}
 
 	/*
-	 * KEYS[1] = backlog
-	 * KEYS[2] = failure
-	 * KEYS[3] = pending
+	 * KEYS[1] = leases
+	 * KEYS[2] = holders
 	 * ARGV[1] = uuid
-	 * ARGV[2] = payload
+	 * ARGV[2] = deadline
+	 * ARGV[3] = lease
 	 */
-	script := redis.NewScript(`
-		redis.call('hset', KEYS[1], ARGV[1], ARGV[2])
-		redis.call('lrem', KEYS[2], 0, ARGV[1])
-		return redis.call('lpush', KEYS[3], ARGV[1])
+	script := redis.NewScript(redisHoldsLease + `
+		if not redis.call('zscore', KEYS[1], ARGV[1]) then
+			return 0
+		end
+		if not holds(KEYS[2], ARGV[1], ARGV[3]) then
+			return -1
+		end
+		redis.call('zadd', KEYS[1], ARGV[2], ARGV[1])
+		return 1
 	`)
 
-	_, err = script.Run(rd.client, []string{
-		rd.key(queue, "backlog"),
-		rd.key(queue, "failure"),
-		rd.key(queue, "pending"),
-	}, job.TraceID, job.Serialize()).Result()
-	return
-}
+	extended, err := script.Run(rd.client, []string{rd.key(queue, "leases"), rd.key(queue, "holders")}, job.TraceID, leaseDeadline(lease), job.lease).Int64()
 
-// Truncate discards everything (!!DANGER!!) currently stored in the queue
-func (rd *RedisDriver) Truncate(queue string) (err error) {
-	deleted, err := rd.client.Del(
-		rd.key(queue, "pending"),
-		rd.key(queue, "working"),
-		rd.key(queue, "failure"),
-		rd.key(queue, "backlog"),
-		rd.key(queue, "delayed"),
-	).Result()
+	if err == nil && extended == 0 {
+		err = ErrorJobNotFound
+	}
 
-	logger.Dataf("deleted %s, %s, %s", deleted, queue, err)
-	return
+	return leaseLost(extended, err)
 }
 
-// Stats - get the stats of the queue
-func (rd *RedisDriver) Stats(queue string) (stats *QueueStats, err error) {
-	stats = &QueueStats{}
-
-	if err != nil {
-		return nil, err
+// Reap moves the working jobs whose lease expired back to the pending queue,
+// counting the lost attempt. Working jobs without a lease are leased first.
+func (rd *RedisDriver) Reap(queue string) (count int64, err error) {
+	timeout := visibilityTimeout(rd.settings.VisibilityTimeout)
+	if timeout == 0 {
+		return
 	}
 
 	/*
-	 * KEYS[1] = pending
-	 * KEYS[2] = working
-	 * KEYS[3] = failure
-	 * KEYS[4] = backlog
-	 * KEYS[5] = delayed
-	 * ARGV[1] = now
+	 * KEYS[1] = working
+	 * KEYS[2] = leases
+	 * ARGV[1] = deadline
 	 */
-	script := redis.NewScript(`
-		local pending = redis.call('llen', KEYS[1])
-		local working = redis.call('llen', KEYS[2])
-		local failure = redis.call('llen', KEYS[3])
-		local backlog = redis.call('hlen', KEYS[4])
-		local delayed = redis.call('zcount', KEYS[5], '-inf', '+inf')
-		local waiting = redis.call('zcount', KEYS[5], '-inf', ARGV[1])
-
-		return {pending, working, failure, delayed, backlog, waiting}
+	lease := redis.NewScript(`
+		local working = redis.call('lrange', KEYS[1], 0, -1)
+
+		for _, id in ipairs(working) do
+			if not redis.call('zscore', KEYS[2], id) then
+				redis.call('zadd', KEYS[2], ARGV[1], id)
+			end
+		end
+
+		return #working
 	`)
 
-	keys := []string{
-		rd.key(queue, "pending"),
-		rd.key(queue, "working"),
-		rd.key(queue, "failure"),
-		rd.key(queue, "backlog"),
-		rd.key(queue, "delayed"),
+	if _, err = lease.Run(rd.client, []string{rd.key(queue, "working"), rd.key(queue, "leases")}, leaseDeadline(timeout)).Result(); err != nil {
+		return
 	}
 
-	result, err := script.Run(rd.client, keys, time.Now().Unix()).Result()
+	now := leaseDeadline(0)
 
+	expired, err := rd.client.ZRangeByScore(rd.key(queue, "leases"), redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now, 10),
+	}).Result()
 	if err != nil {
 		return
 	}
 
-	counts := result.([]interface{})
+	/*
+	 * KEYS[1] = working
+	 * KEYS[2] = leases
+	 * KEYS[3] = pending
+	 * KEYS[4] = backlog
+	 * KEYS[5] = holders
+	 * ARGV[1] = uuid
+	 * ARGV[2] = now
+	 * ARGV[3] = job
+	 */
+	reap := redis.NewScript(`
+		local deadline = redis.call('zscore', KEYS[2], ARGV[1])
+		if not deadline or tonumber(deadline) > tonumber(ARGV[2]) then
+			return 0
+		end
 
-	return &QueueStats{
-		Pending: counts[0].(int64),
-		Working: counts[1].(int64),
-		Failure: counts[2].(int64),
-		Delayed: counts[3].(int64),
-		Backlog: counts[4].(int64),
-		Waiting: counts[5].(int64),
-	}, nil
+		redis.call('zrem', KEYS[2], ARGV[1])
+		redis.call('hdel', KEYS[5], ARGV[1])
+		if redis.call('lrem', KEYS[1], 0, ARGV[1]) == 0 then
+			return 0
+		end
+
+		redis.call('hset', KEYS[4], ARGV[1], ARGV[3])
+		redis.call('lpush', KEYS[3], ARGV[1])
+		return 1
+	`)
+
+	for _, id := range expired {
+		job, er := rd.get(queue, id)
+		if er == redis.Nil {
+			// Completed in the meantime, only the lease is left
+			rd.client.ZRem(rd.key(queue, "leases"), id)
+			rd.client.HDel(rd.key(queue, "holders"), id)
+			continue
+		} else if er != nil {
+			return count, er
+		}
+
+		job.Attempt()
+
+		keys := []string{
+			rd.key(queue, "working"),
+			rd.key(queue, "leases"),
+			rd.pending(queue, job.Priority),
+			rd.key(queue, "backlog"),
+			rd.key(queue, "holders"),
+		}
+
+		reaped, er := reap.Run(rd.client, keys, id, now, job.Serialize()).Int64()
+		if er != nil {
+			return count, er
+		}
+		count += reaped
+	}
+
+	return
 }
 
 // ScheduleDeferred moves deferred jobs that are ready for processing to the pending queue
@@ -448,8 +1842,10 @@ func (rd *RedisDriver) ScheduleDeferred(queue string) (count int64, err error) {
 
 	/*
 	 * KEYS[1] = delayed
-	 * KEYS[2] = pending
+	 * KEYS[2] = backlog
+	 * KEYS[3..n] = pending lists, in the order of the priorities
 	 * ARGV[1] = now
+	 * ARGV[2..n-1] = priorities, highest first
 	 */
 	lua := `
 		local ready = redis.call('zrangebyscore', KEYS[1], '-inf', ARGV[1])
@@ -457,20 +1853,35 @@ func (rd *RedisDriver) ScheduleDeferred(queue string) (count int64, err error) {
 
 		for k,v in pairs(ready) do
 			redis.call('zrem', KEYS[1], v)
-			redis.call('lpush', KEYS[2], v)
+
+			local priority = 0
+			local job = redis.call('hget', KEYS[2], v)
+			if job then
+				priority = tonumber(cjson.decode(job).Priority) or 0
+			end
+
+			local pending = KEYS[#KEYS]
+			for i = 2, #ARGV do
+				if priority >= tonumber(ARGV[i]) then
+					pending = KEYS[i + 1]
+					break
+				end
+			end
+
+			redis.call('lpush', pending, v)
 			count = count + 1
 		end
 
 		return count
 	`
 
-	keys := []string{rd.key(queue, "delayed"), rd.key(queue, "pending")}
+	keys := append([]string{rd.key(queue, "delayed"), rd.key(queue, "backlog")}, rd.pendings(queue)...)
 	argv := []interface{}{time.Now().Unix()}
+	for _, priority := range Priorities {
+		argv = append(argv, priority)
+	}
 
-	result, err := rd.client.Eval(lua, keys, argv...).Result()
-	count = result.(int64)
-
-	return
+	return rd.client.Eval(lua, keys, argv...).Int64()
 }
 
 func (rd *RedisDriver) key(queue string, segment string) string {
@@ -543,3 +1954,113 @@ func (nd *NullDriver) GetVia(key string, handler func() (value string, expiratio
 func (nd *NullDriver) Guard(key string, expiration time.Duration, handler func() error) error {
 	return fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
 }
+
+// CompareAndDelete - delete key if it holds value
+func (nd *NullDriver) CompareAndDelete(key, value string) (bool, error) {
+	return false, fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// CompareAndExpire - set the expire time of key if it holds value
+func (nd *NullDriver) CompareAndExpire(key, value string, expiry time.Duration) (bool, error) {
+	return false, fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// MGet - get multiple keys
+func (nd *NullDriver) MGet(keys ...string) (map[string]string, error) {
+	return nil, fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// MSet - set multiple keys
+func (nd *NullDriver) MSet(items ...*CacheItem) error {
+	return fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// MDel - delete multiple keys
+func (nd *NullDriver) MDel(keys ...string) (int64, error) {
+	return 0, fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// Batch - start a batch of operations, all of which will fail
+func (nd *NullDriver) Batch() CacheBatch {
+	return newSequentialBatch(nd)
+}
+
+// HGet - get a hash field
+func (nd *NullDriver) HGet(key, field string) (string, error) {
+	return "", fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// HSet - set a hash field
+func (nd *NullDriver) HSet(key, field, value string) error {
+	return fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// HDel - delete hash fields
+func (nd *NullDriver) HDel(key string, fields ...string) (int64, error) {
+	return 0, fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// HGetAll - get all hash fields
+func (nd *NullDriver) HGetAll(key string) (map[string]string, error) {
+	return nil, fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// HIncrBy - increase a hash field
+func (nd *NullDriver) HIncrBy(key, field string, delta int64) (int64, error) {
+	return 0, fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// ZAdd - add sorted set members
+func (nd *NullDriver) ZAdd(key string, members ...ZMember) (int64, error) {
+	return 0, fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// ZRange - get sorted set members
+func (nd *NullDriver) ZRange(key string, start, stop int64) ([]ZMember, error) {
+	return nil, fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// ZRevRange - get sorted set members in reverse
+func (nd *NullDriver) ZRevRange(key string, start, stop int64) ([]ZMember, error) {
+	return nil, fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// ZRank - get the rank of a sorted set member
+func (nd *NullDriver) ZRank(key, member string) (int64, error) {
+	return 0, fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// LPush - prepend to a list
+func (nd *NullDriver) LPush(key string, values ...string) (int64, error) {
+	return 0, fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// RPush - append to a list
+func (nd *NullDriver) RPush(key string, values ...string) (int64, error) {
+	return 0, fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// LPop - pop the first list element
+func (nd *NullDriver) LPop(key string) (string, error) {
+	return "", fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// RPop - pop the last list element
+func (nd *NullDriver) RPop(key string) (string, error) {
+	return "", fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// LRange - get list elements
+func (nd *NullDriver) LRange(key string, start, stop int64) ([]string, error) {
+	return nil, fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// LTrim - trim a list
+func (nd *NullDriver) LTrim(key string, start, stop int64) error {
+	return fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
+
+// Throttle - count a request against a rate limit
+func (nd *NullDriver) Throttle(key string, limit *RateLimit) (*RateLimitResult, error) {
+	return nil, fmt.Errorf("Cannot find settings of cache named `%s`", nd.name)
+}
@@ -0,0 +1,116 @@
+package motto_test
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.garena.com/duanzy/motto/motto"
+)
+
+// fakeRedis records the commands it receives and answers every GET with nil
+type fakeRedis struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	commands []string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+
+	server := &fakeRedis{listener: listener}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		// *<count>\r\n followed by $<len>\r\n<arg>\r\n per argument
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+
+		args := []string{}
+		for i := 0; i < count; i++ {
+			reader.ReadString('\n')
+			arg, _ := reader.ReadString('\n')
+			args = append(args, strings.TrimSpace(arg))
+		}
+
+		s.mutex.Lock()
+		s.commands = append(s.commands, strings.Join(args, " "))
+		s.mutex.Unlock()
+
+		if strings.EqualFold(args[0], "get") {
+			conn.Write([]byte("$-1\r\n"))
+		} else {
+			conn.Write([]byte("+OK\r\n"))
+		}
+	}
+}
+
+func (s *fakeRedis) Commands() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]string{}, s.commands...)
+}
+
+func (s *fakeRedis) Close() {
+	s.listener.Close()
+}
+
+func TestRedisDriverAuthenticatesAsACLUser(t *testing.T) {
+	server := newFakeRedis(t)
+	defer server.Close()
+
+	cache := motto.NewRedisDriver("redis", &motto.RedisSettings{
+		Address:  server.listener.Addr().String(),
+		Username: "jotto",
+		Password: "secret",
+		PoolSize: 1,
+	})
+
+	_, err := cache.Get("key")
+	assert.True(t, motto.IsCacheMiss(err))
+	assert.Equal(t, []string{"auth jotto secret", "get key"}, server.Commands())
+}
+
+func TestRedisDriverRejectsBrokenTLSSettings(t *testing.T) {
+	server := newFakeRedis(t)
+	defer server.Close()
+
+	cache := motto.NewRedisDriver("redis", &motto.RedisSettings{
+		Address: server.listener.Addr().String(),
+		TLS:     &motto.TLSSettings{CAFile: "/nonexistent/ca.pem"},
+	})
+
+	_, err := cache.Get("key")
+	assert.True(t, os.IsNotExist(err))
+	assert.Empty(t, server.Commands())
+}
@@ -0,0 +1,942 @@
+package jotto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrorCircuitOpen - the circuit breaker of the cache is open, the backend is not called
+	ErrorCircuitOpen = errors.New("cache circuit breaker is open")
+
+	// CircuitOpenEvent is fired when the circuit breaker of a cache opens.
+	// The payload is the cache name, the previous and the new CircuitState.
+	CircuitOpenEvent = NewEvent("motto:cache:circuit:open")
+
+	// CircuitHalfOpenEvent is fired when an open circuit breaker starts probing the backend
+	CircuitHalfOpenEvent = NewEvent("motto:cache:circuit:half-open")
+
+	// CircuitCloseEvent is fired when the circuit breaker of a cache closes again
+	CircuitCloseEvent = NewEvent("motto:cache:circuit:close")
+)
+
+// CircuitState - the state of a circuit breaker
+type CircuitState int
+
+const (
+	// CircuitClosed - calls go through to the backend
+	CircuitClosed CircuitState = iota
+	// CircuitOpen - calls are short-circuited to the fallback
+	CircuitOpen
+	// CircuitHalfOpen - a limited number of probe calls go through to the backend
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreaker tracks the failures of a backend over a rolling window.
+// It opens when the error rate (slow calls included) crosses the threshold,
+// lets a few probe calls through after `OpenTimeout`, and closes again once
+// they succeed.
+type CircuitBreaker struct {
+	name     string
+	settings CircuitBreakerSettings
+	onChange func(name string, from, to CircuitState)
+
+	mutex     sync.Mutex
+	state     CircuitState
+	openedAt  time.Time
+	buckets   []circuitBucket
+	probes    int
+	successes int
+}
+
+// circuitBucket - the calls recorded during one second of the window
+type circuitBucket struct {
+	second   int64
+	total    int
+	failures int
+}
+
+// NewCircuitBreaker - create a closed circuit breaker
+func NewCircuitBreaker(name string, settings *CircuitBreakerSettings) *CircuitBreaker {
+	cb := &CircuitBreaker{name: name}
+
+	if settings != nil {
+		cb.settings = *settings
+	}
+	if cb.settings.Window <= 0 {
+		cb.settings.Window = 10
+	}
+	if cb.settings.MinRequests <= 0 {
+		cb.settings.MinRequests = 20
+	}
+	if cb.settings.ErrorRate <= 0 {
+		cb.settings.ErrorRate = 0.5
+	}
+	if cb.settings.OpenTimeout <= 0 {
+		cb.settings.OpenTimeout = 5000
+	}
+	if cb.settings.HalfOpenRequests <= 0 {
+		cb.settings.HalfOpenRequests = 1
+	}
+	if cb.settings.LocalTTL <= 0 {
+		cb.settings.LocalTTL = 60
+	}
+
+	cb.buckets = make([]circuitBucket, cb.settings.Window)
+
+	return cb
+}
+
+// OnStateChange - call `handler` whenever the state changes
+func (cb *CircuitBreaker) OnStateChange(handler func(name string, from, to CircuitState)) {
+	cb.onChange = handler
+}
+
+// State - the current state
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	return cb.state
+}
+
+// Allow - check whether a call may go through to the backend.
+// Every allowed call must be followed by a `Record`.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mutex.Lock()
+
+	from := cb.state
+	allowed := true
+
+	switch cb.state {
+	case CircuitOpen:
+		if time.Since(cb.openedAt) < time.Duration(cb.settings.OpenTimeout)*time.Millisecond {
+			allowed = false
+			break
+		}
+		cb.state = CircuitHalfOpen
+		cb.probes = 1
+		cb.successes = 0
+	case CircuitHalfOpen:
+		if cb.probes >= cb.settings.HalfOpenRequests {
+			allowed = false
+			break
+		}
+		cb.probes++
+	}
+
+	to := cb.state
+	cb.mutex.Unlock()
+
+	cb.changed(from, to)
+
+	return allowed
+}
+
+// Record - record the outcome of an allowed call
+func (cb *CircuitBreaker) Record(err error, elapsed time.Duration) {
+	failed := err != nil && !IsCacheMiss(err)
+	if cb.settings.SlowCall > 0 && elapsed > time.Duration(cb.settings.SlowCall)*time.Millisecond {
+		failed = true
+	}
+
+	cb.mutex.Lock()
+
+	from := cb.state
+
+	switch cb.state {
+	case CircuitClosed:
+		now := time.Now().Unix()
+		bucket := &cb.buckets[now%int64(len(cb.buckets))]
+		if bucket.second != now {
+			*bucket = circuitBucket{second: now}
+		}
+		bucket.total++
+		if failed {
+			bucket.failures++
+		}
+
+		total, failures := 0, 0
+		for _, b := range cb.buckets {
+			if now-b.second < int64(len(cb.buckets)) {
+				total += b.total
+				failures += b.failures
+			}
+		}
+
+		if total >= cb.settings.MinRequests && float64(failures) >= cb.settings.ErrorRate*float64(total) {
+			cb.open()
+		}
+	case CircuitHalfOpen:
+		if failed {
+			cb.open()
+			break
+		}
+		cb.successes++
+		if cb.successes >= cb.settings.HalfOpenRequests {
+			cb.state = CircuitClosed
+			cb.buckets = make([]circuitBucket, len(cb.buckets))
+		}
+	}
+
+	to := cb.state
+	cb.mutex.Unlock()
+
+	cb.changed(from, to)
+}
+
+func (cb *CircuitBreaker) open() {
+	cb.state = CircuitOpen
+	cb.openedAt = time.Now()
+	cb.probes = 0
+	cb.successes = 0
+}
+
+// changed - notify the state change handler, outside of the lock
+func (cb *CircuitBreaker) changed(from, to CircuitState) {
+	if from != to && cb.onChange != nil {
+		cb.onChange(cb.name, from, to)
+	}
+}
+
+// CircuitBreakerDriver guards a CacheDriver with a CircuitBreaker. While the
+// circuit is open calls are short-circuited to a fallback:
+//
+//	miss  - reads miss and Set/MSet are dropped, other writes fail with ErrorCircuitOpen
+//	local - everything is served by an in-process cache, which mirrors the
+//	        values read and written while the circuit is closed for `LocalTTL`
+//	error - every call fails with ErrorCircuitOpen
+//
+// SetNX, CompareAndDelete, CompareAndExpire and Throttle coordinate processes,
+// they fail with ErrorCircuitOpen whatever the fallback: locks taken in a
+// local cache would be granted to every process at once.
+type CircuitBreakerDriver struct {
+	driver    CacheDriver
+	breaker   *CircuitBreaker
+	fallback  CacheDriver
+	exclusive CacheDriver // the fallback of the coordinating calls
+	local     *MemoryDriver
+	flight    flightGroup
+}
+
+// NewCircuitBreakerDriver - guard `driver` with a circuit breaker described by `settings`
+func NewCircuitBreakerDriver(name string, driver CacheDriver, settings *CircuitBreakerSettings) *CircuitBreakerDriver {
+	cd := &CircuitBreakerDriver{
+		driver:    driver,
+		breaker:   NewCircuitBreaker(name, settings),
+		exclusive: &circuitFallbackDriver{},
+	}
+
+	switch cd.breaker.settings.Fallback {
+	case "local":
+		local := cd.breaker.settings.Local
+		if local == nil {
+			local = &MemorySettings{MaxEntries: 10000}
+		}
+		cd.local = NewMemoryDriver(name, local)
+		cd.fallback = cd.local
+	case "error":
+		cd.fallback = &circuitFallbackDriver{}
+	default:
+		cd.fallback = &circuitFallbackDriver{miss: true}
+	}
+
+	return cd
+}
+
+// Breaker - the circuit breaker
+func (cd *CircuitBreakerDriver) Breaker() *CircuitBreaker {
+	return cd.breaker
+}
+
+// Driver - the guarded driver
+func (cd *CircuitBreakerDriver) Driver() CacheDriver {
+	return cd.driver
+}
+
+// Close - close the guarded driver and the local fallback
+func (cd *CircuitBreakerDriver) Close() error {
+	if cd.local != nil {
+		cd.local.Close()
+	}
+
+	if closer, ok := cd.driver.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// record - record a call started at `start`, meant to be deferred with a
+// pointer to the named error result
+func (cd *CircuitBreakerDriver) record(start time.Time, err *error) {
+	cd.breaker.Record(*err, time.Since(start))
+}
+
+// mirror - keep a local copy of `key` for the local fallback, for `LocalTTL` at most
+func (cd *CircuitBreakerDriver) mirror(key, value string, expiration time.Duration) {
+	if cd.local == nil {
+		return
+	}
+
+	ttl := time.Duration(cd.breaker.settings.LocalTTL) * time.Second
+	if expiration <= 0 || expiration > ttl {
+		expiration = ttl
+	}
+	cd.local.Set(key, value, expiration)
+}
+
+// forget - drop the local copies of `keys`
+func (cd *CircuitBreakerDriver) forget(keys ...string) {
+	if cd.local != nil {
+		cd.local.MDel(keys...)
+	}
+}
+
+// Get - retrieve `key`
+func (cd *CircuitBreakerDriver) Get(key string) (value string, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.Get(key)
+	}
+	defer cd.record(time.Now(), &err)
+
+	if value, err = cd.driver.Get(key); err == nil {
+		cd.mirror(key, value, 0)
+	}
+
+	return
+}
+
+// GetVia - retrieve `key`, call `handler` to fill it in on a miss
+func (cd *CircuitBreakerDriver) GetVia(key string, handler func() (string, time.Duration, error)) (string, error) {
+	return getVia(cd, &cd.flight, key, handler)
+}
+
+// Set - put `key` into the cache
+func (cd *CircuitBreakerDriver) Set(key, value string, expiration time.Duration) (err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.Set(key, value, expiration)
+	}
+	defer cd.record(time.Now(), &err)
+
+	if err = cd.driver.Set(key, value, expiration); err == nil {
+		cd.mirror(key, value, expiration)
+	} else {
+		cd.forget(key)
+	}
+
+	return
+}
+
+// SetNX - put `key` into the cache if `key` is not exist
+func (cd *CircuitBreakerDriver) SetNX(key, value string, expiration time.Duration) (ok bool, err error) {
+	if !cd.breaker.Allow() {
+		return cd.exclusive.SetNX(key, value, expiration)
+	}
+	defer cd.record(time.Now(), &err)
+
+	if ok, err = cd.driver.SetNX(key, value, expiration); ok {
+		cd.mirror(key, value, expiration)
+	}
+
+	return
+}
+
+// Has - check if `key` exists
+func (cd *CircuitBreakerDriver) Has(key string) (has bool, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.Has(key)
+	}
+	defer cd.record(time.Now(), &err)
+
+	return cd.driver.Has(key)
+}
+
+// Del - delete `keys`
+func (cd *CircuitBreakerDriver) Del(keys ...string) (ok bool, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.Del(keys...)
+	}
+	defer cd.record(time.Now(), &err)
+	defer cd.forget(keys...)
+
+	return cd.driver.Del(keys...)
+}
+
+// Flush - flush the cache
+func (cd *CircuitBreakerDriver) Flush() (ok bool, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.Flush()
+	}
+	defer cd.record(time.Now(), &err)
+
+	if cd.local != nil {
+		cd.local.Flush()
+	}
+
+	return cd.driver.Flush()
+}
+
+// Incr - increase the value of `key`
+func (cd *CircuitBreakerDriver) Incr(key string) (value int64, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.Incr(key)
+	}
+	defer cd.record(time.Now(), &err)
+	defer cd.forget(key)
+
+	return cd.driver.Incr(key)
+}
+
+// Decr - decrease the value of `key`
+func (cd *CircuitBreakerDriver) Decr(key string) (value int64, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.Decr(key)
+	}
+	defer cd.record(time.Now(), &err)
+	defer cd.forget(key)
+
+	return cd.driver.Decr(key)
+}
+
+// Expire - set the expire time of `key`
+func (cd *CircuitBreakerDriver) Expire(key string, expiry time.Duration) (ok bool, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.Expire(key, expiry)
+	}
+	defer cd.record(time.Now(), &err)
+	defer cd.forget(key)
+
+	return cd.driver.Expire(key, expiry)
+}
+
+// Guard - guard the execution of `handler` with a lock
+func (cd *CircuitBreakerDriver) Guard(key string, expiration time.Duration, handler func() error) error {
+	return guard(cd, key, expiration, handler)
+}
+
+// CompareAndDelete - delete `key` if it holds `value`
+func (cd *CircuitBreakerDriver) CompareAndDelete(key, value string) (ok bool, err error) {
+	if !cd.breaker.Allow() {
+		return cd.exclusive.CompareAndDelete(key, value)
+	}
+	defer cd.record(time.Now(), &err)
+	defer cd.forget(key)
+
+	return cd.driver.CompareAndDelete(key, value)
+}
+
+// CompareAndExpire - set the expire time of `key` if it holds `value`
+func (cd *CircuitBreakerDriver) CompareAndExpire(key, value string, expiry time.Duration) (ok bool, err error) {
+	if !cd.breaker.Allow() {
+		return cd.exclusive.CompareAndExpire(key, value, expiry)
+	}
+	defer cd.record(time.Now(), &err)
+	defer cd.forget(key)
+
+	return cd.driver.CompareAndExpire(key, value, expiry)
+}
+
+// MGet - retrieve multiple keys
+func (cd *CircuitBreakerDriver) MGet(keys ...string) (values map[string]string, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.MGet(keys...)
+	}
+	defer cd.record(time.Now(), &err)
+
+	if values, err = cd.driver.MGet(keys...); err == nil {
+		for key, value := range values {
+			cd.mirror(key, value, 0)
+		}
+	}
+
+	return
+}
+
+// MSet - put multiple items into the cache
+func (cd *CircuitBreakerDriver) MSet(items ...*CacheItem) (err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.MSet(items...)
+	}
+	defer cd.record(time.Now(), &err)
+
+	err = cd.driver.MSet(items...)
+
+	for _, item := range items {
+		if err == nil {
+			cd.mirror(item.Key, item.Value, item.Expiration)
+		} else {
+			cd.forget(item.Key)
+		}
+	}
+
+	return
+}
+
+// MDel - delete multiple keys
+func (cd *CircuitBreakerDriver) MDel(keys ...string) (deleted int64, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.MDel(keys...)
+	}
+	defer cd.record(time.Now(), &err)
+	defer cd.forget(keys...)
+
+	return cd.driver.MDel(keys...)
+}
+
+// HGet - get `field` of the hash at `key`
+func (cd *CircuitBreakerDriver) HGet(key, field string) (value string, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.HGet(key, field)
+	}
+	defer cd.record(time.Now(), &err)
+
+	return cd.driver.HGet(key, field)
+}
+
+// HSet - set `field` of the hash at `key`
+func (cd *CircuitBreakerDriver) HSet(key, field, value string) (err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.HSet(key, field, value)
+	}
+	defer cd.record(time.Now(), &err)
+	defer cd.forget(key)
+
+	return cd.driver.HSet(key, field, value)
+}
+
+// HDel - delete `fields` of the hash at `key`
+func (cd *CircuitBreakerDriver) HDel(key string, fields ...string) (count int64, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.HDel(key, fields...)
+	}
+	defer cd.record(time.Now(), &err)
+	defer cd.forget(key)
+
+	return cd.driver.HDel(key, fields...)
+}
+
+// HGetAll - get all fields of the hash at `key`
+func (cd *CircuitBreakerDriver) HGetAll(key string) (values map[string]string, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.HGetAll(key)
+	}
+	defer cd.record(time.Now(), &err)
+
+	return cd.driver.HGetAll(key)
+}
+
+// HIncrBy - add `delta` to `field` of the hash at `key`
+func (cd *CircuitBreakerDriver) HIncrBy(key, field string, delta int64) (count int64, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.HIncrBy(key, field, delta)
+	}
+	defer cd.record(time.Now(), &err)
+	defer cd.forget(key)
+
+	return cd.driver.HIncrBy(key, field, delta)
+}
+
+// ZAdd - add `members` to the sorted set at `key`
+func (cd *CircuitBreakerDriver) ZAdd(key string, members ...ZMember) (count int64, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.ZAdd(key, members...)
+	}
+	defer cd.record(time.Now(), &err)
+	defer cd.forget(key)
+
+	return cd.driver.ZAdd(key, members...)
+}
+
+// ZRange - members of the sorted set at `key` by ascending score
+func (cd *CircuitBreakerDriver) ZRange(key string, start, stop int64) (members []ZMember, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.ZRange(key, start, stop)
+	}
+	defer cd.record(time.Now(), &err)
+
+	return cd.driver.ZRange(key, start, stop)
+}
+
+// ZRevRange - members of the sorted set at `key` by descending score
+func (cd *CircuitBreakerDriver) ZRevRange(key string, start, stop int64) (members []ZMember, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.ZRevRange(key, start, stop)
+	}
+	defer cd.record(time.Now(), &err)
+
+	return cd.driver.ZRevRange(key, start, stop)
+}
+
+// ZRank - the rank of `member` in the sorted set at `key`
+func (cd *CircuitBreakerDriver) ZRank(key, member string) (count int64, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.ZRank(key, member)
+	}
+	defer cd.record(time.Now(), &err)
+
+	return cd.driver.ZRank(key, member)
+}
+
+// LPush - prepend `values` to the list at `key`
+func (cd *CircuitBreakerDriver) LPush(key string, values ...string) (count int64, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.LPush(key, values...)
+	}
+	defer cd.record(time.Now(), &err)
+	defer cd.forget(key)
+
+	return cd.driver.LPush(key, values...)
+}
+
+// RPush - append `values` to the list at `key`
+func (cd *CircuitBreakerDriver) RPush(key string, values ...string) (count int64, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.RPush(key, values...)
+	}
+	defer cd.record(time.Now(), &err)
+	defer cd.forget(key)
+
+	return cd.driver.RPush(key, values...)
+}
+
+// LPop - remove and return the first element of the list at `key`
+func (cd *CircuitBreakerDriver) LPop(key string) (value string, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.LPop(key)
+	}
+	defer cd.record(time.Now(), &err)
+	defer cd.forget(key)
+
+	return cd.driver.LPop(key)
+}
+
+// RPop - remove and return the last element of the list at `key`
+func (cd *CircuitBreakerDriver) RPop(key string) (value string, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.RPop(key)
+	}
+	defer cd.record(time.Now(), &err)
+	defer cd.forget(key)
+
+	return cd.driver.RPop(key)
+}
+
+// LRange - elements of the list at `key` from `start` to `stop`
+func (cd *CircuitBreakerDriver) LRange(key string, start, stop int64) (values []string, err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.LRange(key, start, stop)
+	}
+	defer cd.record(time.Now(), &err)
+
+	return cd.driver.LRange(key, start, stop)
+}
+
+// LTrim - keep only the elements of the list at `key` from `start` to `stop`
+func (cd *CircuitBreakerDriver) LTrim(key string, start, stop int64) (err error) {
+	if !cd.breaker.Allow() {
+		return cd.fallback.LTrim(key, start, stop)
+	}
+	defer cd.record(time.Now(), &err)
+	defer cd.forget(key)
+
+	return cd.driver.LTrim(key, start, stop)
+}
+
+// Throttle - count a request against the rate limit at `key`
+func (cd *CircuitBreakerDriver) Throttle(key string, limit *RateLimit) (result *RateLimitResult, err error) {
+	if !cd.breaker.Allow() {
+		return cd.exclusive.Throttle(key, limit)
+	}
+	defer cd.record(time.Now(), &err)
+
+	return cd.driver.Throttle(key, limit)
+}
+
+// Batch - start a batch. The breaker is consulted on Exec, when the queued
+// operations are replayed either on the guarded driver or on the fallback.
+func (cd *CircuitBreakerDriver) Batch() CacheBatch {
+	return &circuitBatch{driver: cd}
+}
+
+type circuitBatch struct {
+	driver     *CircuitBreakerDriver
+	operations []func(batch CacheBatch) *CacheResult
+	results    []*CacheResult
+	written    []string
+}
+
+func (b *circuitBatch) queue(operation func(batch CacheBatch) *CacheResult) *CacheResult {
+	result := &CacheResult{}
+
+	b.operations = append(b.operations, operation)
+	b.results = append(b.results, result)
+
+	return result
+}
+
+func (b *circuitBatch) Get(key string) *CacheResult {
+	return b.queue(func(batch CacheBatch) *CacheResult { return batch.Get(key) })
+}
+
+func (b *circuitBatch) Set(key, value string, expiration time.Duration) *CacheResult {
+	b.written = append(b.written, key)
+	return b.queue(func(batch CacheBatch) *CacheResult { return batch.Set(key, value, expiration) })
+}
+
+func (b *circuitBatch) Del(key string) *CacheResult {
+	b.written = append(b.written, key)
+	return b.queue(func(batch CacheBatch) *CacheResult { return batch.Del(key) })
+}
+
+func (b *circuitBatch) Incr(key string) *CacheResult {
+	b.written = append(b.written, key)
+	return b.queue(func(batch CacheBatch) *CacheResult { return batch.Incr(key) })
+}
+
+func (b *circuitBatch) Decr(key string) *CacheResult {
+	b.written = append(b.written, key)
+	return b.queue(func(batch CacheBatch) *CacheResult { return batch.Decr(key) })
+}
+
+func (b *circuitBatch) Expire(key string, expiry time.Duration) *CacheResult {
+	b.written = append(b.written, key)
+	return b.queue(func(batch CacheBatch) *CacheResult { return batch.Expire(key, expiry) })
+}
+
+func (b *circuitBatch) Exec() (err error) {
+	operations, results, written := b.operations, b.results, b.written
+	b.operations, b.results, b.written = nil, nil, nil
+
+	var batch CacheBatch
+
+	if b.driver.breaker.Allow() {
+		defer b.driver.record(time.Now(), &err)
+		defer b.driver.forget(written...)
+		batch = b.driver.driver.Batch()
+	} else {
+		batch = b.driver.fallback.Batch()
+	}
+
+	queued := make([]*CacheResult, len(operations))
+	for i, operation := range operations {
+		queued[i] = operation(batch)
+	}
+
+	err = batch.Exec()
+
+	for i, result := range queued {
+		*results[i] = *result
+	}
+
+	return
+}
+
+// Publish - publish through the guarded driver, if it supports pub/sub
+func (cd *CircuitBreakerDriver) Publish(channel, message string) (err error) {
+	pubsub, ok := cd.driver.(PubSub)
+	if !ok {
+		return fmt.Errorf("cache driver %T does not support pub/sub", cd.driver)
+	}
+
+	if !cd.breaker.Allow() {
+		return ErrorCircuitOpen
+	}
+	defer cd.record(time.Now(), &err)
+
+	return pubsub.Publish(channel, message)
+}
+
+// Subscribe - subscribe through the guarded driver, if it supports pub/sub
+func (cd *CircuitBreakerDriver) Subscribe(channel string, handler func(message string)) io.Closer {
+	if pubsub, ok := cd.driver.(PubSub); ok {
+		return pubsub.Subscribe(channel, handler)
+	}
+
+	return ioutil.NopCloser(nil)
+}
+
+// circuitFallbackDriver serves the calls short-circuited by an open breaker,
+// either as misses or as ErrorCircuitOpen.
+type circuitFallbackDriver struct {
+	miss   bool
+	flight flightGroup
+}
+
+func (fd *circuitFallbackDriver) Get(key string) (string, error) {
+	if fd.miss {
+		return "", ErrorCacheMiss
+	}
+	return "", ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) GetVia(key string, handler func() (string, time.Duration, error)) (string, error) {
+	return getVia(fd, &fd.flight, key, handler)
+}
+
+func (fd *circuitFallbackDriver) Set(key, value string, expiration time.Duration) error {
+	if fd.miss {
+		return nil
+	}
+	return ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) SetNX(key, value string, expiration time.Duration) (bool, error) {
+	return false, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) Has(key string) (bool, error) {
+	if fd.miss {
+		return false, nil
+	}
+	return false, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) Del(keys ...string) (bool, error) {
+	return false, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) Flush() (bool, error) {
+	return false, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) Incr(key string) (int64, error) {
+	return 0, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) Decr(key string) (int64, error) {
+	return 0, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) Expire(key string, expiry time.Duration) (bool, error) {
+	return false, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) Guard(key string, expiration time.Duration, handler func() error) error {
+	return ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) CompareAndDelete(key, value string) (bool, error) {
+	return false, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) CompareAndExpire(key, value string, expiry time.Duration) (bool, error) {
+	return false, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) MGet(keys ...string) (map[string]string, error) {
+	if fd.miss {
+		return map[string]string{}, nil
+	}
+	return nil, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) MSet(items ...*CacheItem) error {
+	return fd.Set("", "", 0)
+}
+
+func (fd *circuitFallbackDriver) MDel(keys ...string) (int64, error) {
+	return 0, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) Batch() CacheBatch {
+	return newSequentialBatch(fd)
+}
+
+func (fd *circuitFallbackDriver) HGet(key, field string) (string, error) {
+	if fd.miss {
+		return "", ErrorCacheMiss
+	}
+	return "", ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) HSet(key, field, value string) error {
+	return ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) HDel(key string, fields ...string) (int64, error) {
+	return 0, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) HGetAll(key string) (map[string]string, error) {
+	if fd.miss {
+		return map[string]string{}, nil
+	}
+	return nil, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) HIncrBy(key, field string, delta int64) (int64, error) {
+	return 0, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) ZAdd(key string, members ...ZMember) (int64, error) {
+	return 0, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) ZRange(key string, start, stop int64) ([]ZMember, error) {
+	if fd.miss {
+		return []ZMember{}, nil
+	}
+	return nil, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) ZRevRange(key string, start, stop int64) ([]ZMember, error) {
+	if fd.miss {
+		return []ZMember{}, nil
+	}
+	return nil, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) ZRank(key, member string) (int64, error) {
+	if fd.miss {
+		return 0, ErrorCacheMiss
+	}
+	return 0, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) LPush(key string, values ...string) (int64, error) {
+	return 0, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) RPush(key string, values ...string) (int64, error) {
+	return 0, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) LPop(key string) (string, error) {
+	return "", ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) RPop(key string) (string, error) {
+	return "", ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) LRange(key string, start, stop int64) ([]string, error) {
+	if fd.miss {
+		return []string{}, nil
+	}
+	return nil, ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) LTrim(key string, start, stop int64) error {
+	return ErrorCircuitOpen
+}
+
+func (fd *circuitFallbackDriver) Throttle(key string, limit *RateLimit) (*RateLimitResult, error) {
+	return nil, ErrorCircuitOpen
+}
@@ -0,0 +1,174 @@
+package motto_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.garena.com/duanzy/motto/motto"
+)
+
+// flakyDriver fails every call while `down` is set
+type flakyDriver struct {
+	*motto.MemoryDriver
+	down bool
+}
+
+func (fd *flakyDriver) Get(key string) (string, error) {
+	if fd.down {
+		return "", errors.New("backend down")
+	}
+	return fd.MemoryDriver.Get(key)
+}
+
+func (fd *flakyDriver) Set(key, value string, expiration time.Duration) error {
+	if fd.down {
+		return errors.New("backend down")
+	}
+	return fd.MemoryDriver.Set(key, value, expiration)
+}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	backend := &flakyDriver{MemoryDriver: motto.NewMemoryDriver("mem", nil)}
+	cache := motto.NewCircuitBreakerDriver("mem", backend, &motto.CircuitBreakerSettings{
+		MinRequests: 4,
+		ErrorRate:   0.5,
+		OpenTimeout: 50,
+	})
+	defer cache.Close()
+
+	changes := []motto.CircuitState{}
+	cache.Breaker().OnStateChange(func(name string, from, to motto.CircuitState) {
+		changes = append(changes, to)
+	})
+
+	assert.Nil(t, cache.Set("key", "value", 0))
+	backend.down = true
+
+	for i := 0; i < 3; i++ {
+		_, err := cache.Get("key")
+		assert.NotNil(t, err)
+		assert.False(t, motto.IsCacheMiss(err))
+	}
+	assert.Equal(t, motto.CircuitOpen, cache.Breaker().State())
+
+	// Short-circuited to misses, writes of cache fills are dropped
+	_, err := cache.Get("key")
+	assert.True(t, motto.IsCacheMiss(err))
+	assert.Nil(t, cache.Set("key", "other", 0))
+	_, err = cache.Incr("counter")
+	assert.Equal(t, motto.ErrorCircuitOpen, err)
+
+	value, err := cache.GetVia("key", func() (string, time.Duration, error) {
+		return "loaded", 0, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "loaded", value)
+
+	// A failed probe opens the circuit again
+	time.Sleep(time.Millisecond * 60)
+	cache.Get("key")
+	assert.Equal(t, motto.CircuitOpen, cache.Breaker().State())
+
+	// A successful probe closes it
+	backend.down = false
+	time.Sleep(time.Millisecond * 60)
+	value, err = cache.Get("key")
+	assert.Nil(t, err)
+	assert.Equal(t, "value", value)
+	assert.Equal(t, motto.CircuitClosed, cache.Breaker().State())
+
+	assert.Equal(t, []motto.CircuitState{
+		motto.CircuitOpen, motto.CircuitHalfOpen, motto.CircuitOpen, motto.CircuitHalfOpen, motto.CircuitClosed,
+	}, changes)
+}
+
+func TestCircuitBreakerLocalFallback(t *testing.T) {
+	backend := &flakyDriver{MemoryDriver: motto.NewMemoryDriver("mem", nil)}
+	cache := motto.NewCircuitBreakerDriver("mem", backend, &motto.CircuitBreakerSettings{
+		MinRequests: 1,
+		Fallback:    "local",
+	})
+	defer cache.Close()
+
+	assert.Nil(t, cache.Set("key", "value", 0))
+
+	backend.down = true
+	cache.Get("key")
+	assert.Equal(t, motto.CircuitOpen, cache.Breaker().State())
+
+	value, err := cache.Get("key")
+	assert.Nil(t, err)
+	assert.Equal(t, "value", value)
+
+	batch := cache.Batch()
+	set := batch.Set("other", "local", 0)
+	get := batch.Get("other")
+	assert.Nil(t, batch.Exec())
+	assert.Nil(t, set.Err())
+	value, _ = get.Result()
+	assert.Equal(t, "local", value)
+}
+
+func TestCircuitBreakerLocalFallbackKeepsLocksRemote(t *testing.T) {
+	backend := &flakyDriver{MemoryDriver: motto.NewMemoryDriver("mem", nil)}
+	cache := motto.NewCircuitBreakerDriver("mem", backend, &motto.CircuitBreakerSettings{
+		MinRequests: 1,
+		Fallback:    "local",
+		LocalTTL:    1,
+	})
+	defer cache.Close()
+
+	assert.Nil(t, backend.MemoryDriver.Set("key", "value", 0))
+	value, _ := cache.Get("key")
+	assert.Equal(t, "value", value)
+
+	backend.down = true
+	cache.Get("key")
+	assert.Equal(t, motto.CircuitOpen, cache.Breaker().State())
+
+	// Locks and rate limits are never granted by the local cache
+	_, err := cache.SetNX("lock", "token", time.Minute)
+	assert.Equal(t, motto.ErrorCircuitOpen, err)
+	_, err = cache.CompareAndDelete("lock", "token")
+	assert.Equal(t, motto.ErrorCircuitOpen, err)
+	_, err = cache.CompareAndExpire("lock", "token", time.Minute)
+	assert.Equal(t, motto.ErrorCircuitOpen, err)
+	_, err = cache.Throttle("login", &motto.RateLimit{Limit: 1, Period: time.Minute})
+	assert.Equal(t, motto.ErrorCircuitOpen, err)
+	assert.Equal(t, motto.ErrorCircuitOpen, cache.Guard("lock", time.Minute, func() error { return nil }))
+
+	// The copy read while the circuit was closed expires after LocalTTL
+	value, err = cache.Get("key")
+	assert.Nil(t, err)
+	assert.Equal(t, "value", value)
+
+	time.Sleep(1100 * time.Millisecond)
+	_, err = cache.Get("key")
+	assert.True(t, motto.IsCacheMiss(err))
+}
+
+func TestCircuitBreakerFiresApplicationEvents(t *testing.T) {
+	cfg := motto.NewDefaultSettings()
+	cfg.Motto().Cache = []*motto.CacheSettings{{
+		Name:           "mem",
+		Driver:         "memcached",
+		Memcached:      &motto.MemcachedSettings{Address: []string{"127.0.0.1:1"}},
+		CircuitBreaker: &motto.CircuitBreakerSettings{MinRequests: 1, Fallback: "error"},
+	}}
+	app := motto.NewApplication(cfg, nil, nil, nil)
+
+	opened := ""
+	app.On(motto.CircuitOpenEvent, func(payload ...interface{}) {
+		opened = payload[0].(string)
+	})
+	app.Boot()
+
+	app.Cache("mem").Get("key")
+	assert.Equal(t, "mem", opened)
+
+	_, err := app.Cache("mem").Get("key")
+	assert.Equal(t, motto.ErrorCircuitOpen, err)
+}
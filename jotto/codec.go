@@ -0,0 +1,156 @@
+package jotto
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Codec - converts objects to and from the string values stored by a CacheDriver
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec - encode objects with encoding/json
+	JSONCodec Codec = jsonCodec{}
+
+	// ProtoCodec - encode objects implementing `proto.Message` with protobuf
+	ProtoCodec Codec = protoCodec{}
+
+	// GobCodec - encode objects with encoding/gob
+	GobCodec Codec = gobCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	message, ok := v.(proto.Message)
+
+	if !ok {
+		return nil, fmt.Errorf("%T does not implement proto.Message", v)
+	}
+
+	return proto.Marshal(message)
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	message, ok := v.(proto.Message)
+
+	if !ok {
+		return fmt.Errorf("%T does not implement proto.Message", v)
+	}
+
+	return proto.Unmarshal(data, message)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+
+	if err := gob.NewEncoder(buffer).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// ObjectCache stores objects in a CacheDriver, encoding them with a Codec.
+//
+//	users := jotto.NewAppObjectCache(app, "default", jotto.JSONCodec)
+//	err := users.SetObject("user:1", &User{Name: "jotto"}, time.Minute)
+//	err = users.GetObject("user:1", &user)
+type ObjectCache struct {
+	driver cacheRef
+	codec  Codec
+}
+
+// NewObjectCache - create an object cache on top of `driver`
+func NewObjectCache(driver CacheDriver, codec Codec) *ObjectCache {
+	return &ObjectCache{
+		driver: cacheRef{driver: driver},
+		codec:  codec,
+	}
+}
+
+// NewAppObjectCache - create an object cache on top of the cache of `app` named
+// `cache`, looked up for every call so that it follows the cache across reloads
+func NewAppObjectCache(app Application, cache string, codec Codec) *ObjectCache {
+	return &ObjectCache{
+		driver: cacheRef{app: app, name: cache},
+		codec:  codec,
+	}
+}
+
+// Driver - the underlying cache driver
+func (oc *ObjectCache) Driver() CacheDriver {
+	return oc.driver.get()
+}
+
+// GetObject - retrieve `key` and decode it into `v`
+func (oc *ObjectCache) GetObject(key string, v interface{}) error {
+	value, err := oc.driver.get().Get(key)
+
+	if err != nil {
+		return err
+	}
+
+	return oc.codec.Unmarshal([]byte(value), v)
+}
+
+// SetObject - encode `v` and put it into the cache as `key`
+func (oc *ObjectCache) SetObject(key string, v interface{}, expiration time.Duration) error {
+	data, err := oc.codec.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	return oc.driver.get().Set(key, string(data), expiration)
+}
+
+// GetObjectVia - retrieve `key` and decode it into `v`. On a miss, `handler`
+// is called to produce the object, which is cached via the driver's GetVia.
+func (oc *ObjectCache) GetObjectVia(key string, v interface{}, handler func() (interface{}, time.Duration, error)) error {
+	value, err := oc.driver.get().GetVia(key, func() (string, time.Duration, error) {
+		object, expiration, err := handler()
+
+		if err != nil {
+			return "", 0, err
+		}
+
+		data, err := oc.codec.Marshal(object)
+
+		if err != nil {
+			return "", 0, err
+		}
+
+		return string(data), expiration, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return oc.codec.Unmarshal([]byte(value), v)
+}
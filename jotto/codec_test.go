@@ -0,0 +1,59 @@
+package motto_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+
+	"git.garena.com/duanzy/motto/motto"
+)
+
+type cachedAuthor struct {
+	Name string
+	Age  int
+}
+
+func TestObjectCacheRoundTrips(t *testing.T) {
+	driver := motto.NewMemoryDriver("default", &motto.MemorySettings{JanitorInterval: -1})
+
+	for _, codec := range []motto.Codec{motto.JSONCodec, motto.GobCodec} {
+		objects := motto.NewObjectCache(driver, codec)
+
+		assert.Nil(t, objects.SetObject("author", &cachedAuthor{"Jotto", 31}, time.Minute))
+
+		author := &cachedAuthor{}
+		assert.Nil(t, objects.GetObject("author", author))
+		assert.Equal(t, &cachedAuthor{"Jotto", 31}, author)
+	}
+
+	objects := motto.NewObjectCache(driver, motto.ProtoCodec)
+
+	assert.Nil(t, objects.SetObject("message", &wrappers.StringValue{Value: "hello"}, time.Minute))
+	message := &wrappers.StringValue{}
+	assert.Nil(t, objects.GetObject("message", message))
+	assert.Equal(t, "hello", message.Value)
+
+	assert.NotNil(t, objects.SetObject("author", &cachedAuthor{}, time.Minute))
+
+	err := objects.GetObject("missing", message)
+	assert.True(t, motto.IsCacheMiss(err))
+}
+
+func TestObjectCacheGetObjectVia(t *testing.T) {
+	objects := motto.NewObjectCache(motto.NewMemoryDriver("default", &motto.MemorySettings{JanitorInterval: -1}), motto.JSONCodec)
+
+	calls := 0
+	handler := func() (interface{}, time.Duration, error) {
+		calls++
+		return &cachedAuthor{"Jotto", 31}, time.Minute, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		author := &cachedAuthor{}
+		assert.Nil(t, objects.GetObjectVia("author", author, handler))
+		assert.Equal(t, "Jotto", author.Name)
+	}
+	assert.Equal(t, 1, calls)
+}
@@ -19,6 +19,7 @@ const (
 	CtxHTTPResponseHeaders
 	CtxLogger
 	CtxTime
+	CtxRoute
 )
 
 // GetLogger - retrieve a logger from context
@@ -43,6 +44,17 @@ func GetTime(ctx context.Context) (timestamp uint32) {
 	return timestamp
 }
 
+// GetRoute - retrieve the route being served from context
+func GetRoute(ctx context.Context) *Route {
+	route, ok := ctx.Value(CtxRoute).(Route)
+
+	if !ok {
+		return nil
+	}
+
+	return &route
+}
+
 func GetHTTPRequest(ctx context.Context) (request *http.Request) {
 	request, ok := ctx.Value(CtxHTTPRequest).(*http.Request)
 
@@ -0,0 +1,201 @@
+package jotto
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule tells when a recurring job runs
+type Schedule interface {
+	// Next - the first run strictly after `t`
+	Next(t time.Time) time.Time
+}
+
+// Every - a schedule running every `interval`, aligned on multiples of it
+// since the zero time so that every process agrees on the runs
+func Every(interval time.Duration) Schedule {
+	return everySchedule(interval)
+}
+
+type everySchedule time.Duration
+
+func (every everySchedule) Next(t time.Time) time.Time {
+	return t.Truncate(time.Duration(every)).Add(time.Duration(every))
+}
+
+// CronSchedule - a schedule parsed from a cron expression
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Either restricted, a day matches when it matches any of the two as in cron(8)
+	domStar, dowStar bool
+}
+
+// cronField - the bounds and names of a field of a cron expression
+type cronField struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronMinute = cronField{min: 0, max: 59}
+	cronHour   = cronField{min: 0, max: 23}
+	cronDom    = cronField{min: 1, max: 31}
+	cronMonth  = cronField{min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	cronDow = cronField{min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron - parse a standard 5-field cron expression (minute, hour, day of
+// month, month, day of week) with lists, ranges, steps and names, one of the
+// @yearly, @monthly, @weekly, @daily or @hourly descriptors, or "@every <duration>"
+func ParseCron(expression string) (Schedule, error) {
+	expression = strings.TrimSpace(expression)
+
+	if strings.HasPrefix(expression, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(expression[len("@every "):]))
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid cron interval: %s", expression)
+		}
+		return Every(interval), nil
+	}
+
+	if descriptor, ok := cronDescriptors[expression]; ok {
+		expression = descriptor
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression, expected 5 fields: %s", expression)
+	}
+
+	schedule := &CronSchedule{
+		domStar: fields[2] == "*" || fields[2] == "?",
+		dowStar: fields[4] == "*" || fields[4] == "?",
+	}
+
+	var err error
+	for i, target := range []*uint64{&schedule.minute, &schedule.hour, &schedule.dom, &schedule.month, &schedule.dow} {
+		field := []cronField{cronMinute, cronHour, cronDom, cronMonth, cronDow}[i]
+		if *target, err = field.parse(fields[i]); err != nil {
+			return nil, fmt.Errorf("invalid cron expression %s: %v", expression, err)
+		}
+	}
+
+	// Sunday is either 0 or 7
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+
+	return schedule, nil
+}
+
+// parse - the bits of the values matched by a comma separated list
+func (f cronField) parse(list string) (bits uint64, err error) {
+	for _, part := range strings.Split(list, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step: %s", part)
+			}
+			part = part[:i]
+		}
+
+		low, high := f.min, f.max
+		switch {
+		case part == "*" || part == "?":
+		case strings.Contains(part, "-"):
+			i := strings.Index(part, "-")
+			if low, err = f.value(part[:i]); err != nil {
+				return
+			}
+			if high, err = f.value(part[i+1:]); err != nil {
+				return
+			}
+		default:
+			if low, err = f.value(part); err != nil {
+				return
+			}
+			// A single value with a step runs from the value to the end, like "5/15"
+			if step == 1 {
+				high = low
+			}
+		}
+
+		if low > high {
+			return 0, fmt.Errorf("invalid range: %s", part)
+		}
+
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+
+	return
+}
+
+// value - a single number or name of the field
+func (f cronField) value(text string) (int, error) {
+	if value, ok := f.names[strings.ToLower(text)]; ok {
+		return value, nil
+	}
+
+	value, err := strconv.Atoi(text)
+	if err != nil || value < f.min || value > f.max {
+		return 0, fmt.Errorf("value out of range [%d, %d]: %s", f.min, f.max, text)
+	}
+
+	return value, nil
+}
+
+// Next - the first minute strictly after `t` matching the expression, in the location of `t`.
+// A zero time is returned if nothing matches within five years (e.g. "0 0 30 2 *").
+func (cs *CronSchedule) Next(t time.Time) time.Time {
+	location := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, location).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case cs.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, location)
+		case !cs.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, location)
+		case cs.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, location)
+		case cs.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// dayMatches - check the day of month and the day of week of `t`
+func (cs *CronSchedule) dayMatches(t time.Time) bool {
+	dom := cs.dom&(1<<uint(t.Day())) != 0
+	dow := cs.dow&(1<<uint(t.Weekday())) != 0
+
+	if cs.domStar || cs.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
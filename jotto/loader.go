@@ -0,0 +1,275 @@
+package jotto
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// flightGroup coalesces concurrent calls for the same key, so that only one
+// of them executes while the others wait for and share its result.
+// The zero value is ready to use.
+type flightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg    sync.WaitGroup
+	value string
+	err   error
+}
+
+// Do - execute `fn` unless a call for `key` is already in flight, in which case wait for it
+func (g *flightGroup) Do(key string, fn func() (string, error)) (string, error) {
+	g.mutex.Lock()
+
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+
+	if call, ok := g.calls[key]; ok {
+		g.mutex.Unlock()
+		call.wg.Wait()
+		return call.value, call.err
+	}
+
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mutex.Unlock()
+
+	defer func() {
+		// A panicking `fn` fails the waiting calls, and keeps panicking here
+		ex := recover()
+		if ex != nil {
+			call.value, call.err = "", fmt.Errorf("panic: %v", ex)
+		}
+
+		g.mutex.Lock()
+		delete(g.calls, key)
+		g.mutex.Unlock()
+
+		call.wg.Done()
+
+		if ex != nil {
+			panic(ex)
+		}
+	}()
+
+	call.value, call.err = fn()
+
+	return call.value, call.err
+}
+
+// getVia - the GetVia logic shared by the cache drivers: serve hits directly,
+// and on a miss let only one caller per process run `handler`.
+func getVia(cache CacheDriver, flight *flightGroup, key string, handler func() (string, time.Duration, error)) (string, error) {
+	value, err := cache.Get(key)
+
+	if err == nil || !IsCacheMiss(err) {
+		return value, err
+	}
+
+	return flight.Do(key, func() (string, error) {
+		value, expiration, err := handler()
+
+		if err != nil {
+			return "", err
+		}
+
+		return value, cache.Set(key, value, expiration)
+	})
+}
+
+// LoaderDriver wraps a CacheDriver and hardens its GetVia against stampedes
+// across processes: misses are filled under a distributed lock taken via
+// `SetNX`, and values can be served stale while they are being refreshed.
+// All other methods are passed through to the wrapped driver.
+type LoaderDriver struct {
+	CacheDriver
+
+	settings *GetViaSettings
+	flight   flightGroup
+
+	onRefreshError func(key string, err error)
+}
+
+// NewLoaderDriver - wrap `driver` with the GetVia behaviour described by `settings`
+func NewLoaderDriver(driver CacheDriver, settings *GetViaSettings) *LoaderDriver {
+	return &LoaderDriver{
+		CacheDriver: driver,
+		settings:    settings,
+	}
+}
+
+// Driver - the wrapped driver
+func (ld *LoaderDriver) Driver() CacheDriver {
+	return ld.CacheDriver
+}
+
+// Publish - publish through the wrapped driver, if it supports pub/sub
+func (ld *LoaderDriver) Publish(channel, message string) error {
+	pubsub, ok := ld.CacheDriver.(PubSub)
+	if !ok {
+		return fmt.Errorf("cache driver %T does not support pub/sub", ld.CacheDriver)
+	}
+
+	return pubsub.Publish(channel, message)
+}
+
+// Subscribe - subscribe through the wrapped driver, if it supports pub/sub
+func (ld *LoaderDriver) Subscribe(channel string, handler func(message string)) io.Closer {
+	if pubsub, ok := ld.CacheDriver.(PubSub); ok {
+		return pubsub.Subscribe(channel, handler)
+	}
+
+	return ioutil.NopCloser(nil)
+}
+
+// Close - close the wrapped driver
+func (ld *LoaderDriver) Close() error {
+	if closer, ok := ld.CacheDriver.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// GetVia - get the `key` from cache, if not set, call `handler` to get the value.
+// With stale-while-revalidate enabled, an expired value is still returned
+// while a single caller refreshes it in the background.
+func (ld *LoaderDriver) GetVia(key string, handler func() (string, time.Duration, error)) (value string, err error) {
+	value, err = ld.CacheDriver.Get(key)
+
+	if err != nil && !IsCacheMiss(err) {
+		return "", err
+	}
+
+	if err == nil {
+		if ld.settings.StaleWhileRevalidate <= 0 {
+			return value, nil
+		}
+
+		fresh, err := ld.CacheDriver.Has(ld.freshKey(key))
+		if err != nil && !IsCacheMiss(err) {
+			return "", err
+		}
+
+		if !fresh {
+			go ld.refresh(key, handler)
+		}
+
+		return value, nil
+	}
+
+	return ld.flight.Do(key, func() (string, error) {
+		return ld.fill(key, handler, true)
+	})
+}
+
+// OnRefreshError - call `handler` when a background refresh fails or panics
+func (ld *LoaderDriver) OnRefreshError(handler func(key string, err error)) {
+	ld.onRefreshError = handler
+}
+
+// refresh - refill a stale `key` in the background. Nobody waits for the
+// result, failures and panics are reported to the OnRefreshError handler.
+func (ld *LoaderDriver) refresh(key string, handler func() (string, time.Duration, error)) {
+	var err error
+
+	defer func() {
+		if ex := recover(); ex != nil {
+			err = fmt.Errorf("panic: %v", ex)
+		}
+		if err != nil && ld.onRefreshError != nil {
+			ld.onRefreshError(key, err)
+		}
+	}()
+
+	_, err = ld.flight.Do("refresh:"+key, func() (string, error) {
+		return ld.fill(key, handler, false)
+	})
+}
+
+// fill - call `handler` and store its result, holding the distributed lock
+// if enabled. When someone else holds the lock, `wait` decides whether to
+// wait for them to fill the key or give up straight away.
+func (ld *LoaderDriver) fill(key string, handler func() (string, time.Duration, error), wait bool) (string, error) {
+	if ld.settings.Lock {
+		lock := NewLock(ld.CacheDriver, ld.lockKey(key), &LockOptions{TTL: ld.lockTimeout()})
+
+		acquired, err := lock.TryAcquire()
+		if err != nil {
+			return "", err
+		}
+
+		if acquired {
+			defer lock.Release()
+
+			// The previous lock holder may have filled the key just now
+			if value, err := ld.CacheDriver.Get(key); err == nil {
+				if fresh, _ := ld.CacheDriver.Has(ld.freshKey(key)); fresh || ld.settings.StaleWhileRevalidate <= 0 {
+					return value, nil
+				}
+			}
+		} else {
+			if !wait {
+				return "", nil
+			}
+
+			deadline := time.Now().Add(ld.lockWait())
+			for time.Now().Before(deadline) {
+				if value, err := ld.CacheDriver.Get(key); err == nil {
+					return value, nil
+				}
+				time.Sleep(time.Millisecond * 50)
+			}
+			// The lock holder is taking too long, load the value ourselves
+		}
+	}
+
+	value, expiration, err := handler()
+
+	if err != nil {
+		return "", err
+	}
+
+	if ld.settings.StaleWhileRevalidate > 0 {
+		stale := expiration
+		if expiration > 0 {
+			stale += time.Duration(ld.settings.StaleWhileRevalidate) * time.Second
+		}
+
+		if err = ld.CacheDriver.Set(key, value, stale); err != nil {
+			return "", err
+		}
+
+		return value, ld.CacheDriver.Set(ld.freshKey(key), "1", expiration)
+	}
+
+	return value, ld.CacheDriver.Set(key, value, expiration)
+}
+
+func (ld *LoaderDriver) lockKey(key string) string {
+	return key + ":lock"
+}
+
+func (ld *LoaderDriver) freshKey(key string) string {
+	return key + ":fresh"
+}
+
+func (ld *LoaderDriver) lockTimeout() time.Duration {
+	if ld.settings.LockTimeout > 0 {
+		return time.Duration(ld.settings.LockTimeout) * time.Second
+	}
+	return time.Second * 10
+}
+
+func (ld *LoaderDriver) lockWait() time.Duration {
+	if ld.settings.LockWait > 0 {
+		return time.Duration(ld.settings.LockWait) * time.Millisecond
+	}
+	return time.Second * 3
+}
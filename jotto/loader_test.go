@@ -0,0 +1,178 @@
+package motto_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.garena.com/duanzy/motto/motto"
+)
+
+func TestGetViaServesHitsAndCoalescesMisses(t *testing.T) {
+	cache := motto.NewMemoryDriver("default", &motto.MemorySettings{JanitorInterval: -1})
+
+	var calls int32
+	handler := func() (string, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(time.Millisecond * 50)
+		return "value", time.Minute, nil
+	}
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := cache.GetVia("hot", handler)
+			assert.Nil(t, err)
+			assert.Equal(t, "value", value)
+		}()
+	}
+	wg.Wait()
+
+	value, _ := cache.GetVia("hot", handler)
+	assert.Equal(t, "value", value)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestGetViaFailsCallersWaitingOnAPanic(t *testing.T) {
+	cache := motto.NewMemoryDriver("default", &motto.MemorySettings{JanitorInterval: -1})
+
+	handler := func() (string, time.Duration, error) {
+		time.Sleep(time.Millisecond * 50)
+		panic("boom")
+	}
+
+	var panicked, failed int32
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if recover() != nil {
+					atomic.AddInt32(&panicked, 1)
+				}
+			}()
+
+			// The caller running the handler panics, the waiting ones get an error
+			value, err := cache.GetVia("hot", handler)
+			assert.EqualError(t, err, "panic: boom")
+			assert.Equal(t, "", value)
+			atomic.AddInt32(&failed, 1)
+		}()
+	}
+	wg.Wait()
+
+	assert.True(t, atomic.LoadInt32(&panicked) >= 1)
+	assert.Equal(t, int32(10), atomic.LoadInt32(&panicked)+atomic.LoadInt32(&failed))
+
+	_, err := cache.Get("hot")
+	assert.True(t, motto.IsCacheMiss(err))
+}
+
+func TestLoaderDriverLocksAcrossProcesses(t *testing.T) {
+	shared := motto.NewMemoryDriver("default", &motto.MemorySettings{JanitorInterval: -1})
+	settings := &motto.GetViaSettings{Lock: true, LockWait: 1000}
+
+	// Two loaders over the same backend behave like two processes sharing Redis
+	loaders := []motto.CacheDriver{
+		motto.NewLoaderDriver(shared, settings),
+		motto.NewLoaderDriver(shared, settings),
+	}
+
+	var calls int32
+	handler := func() (string, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(time.Millisecond * 100)
+		return "value", time.Minute, nil
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, loader := range loaders {
+		wg.Add(1)
+		go func(loader motto.CacheDriver) {
+			defer wg.Done()
+			value, err := loader.GetVia("hot", handler)
+			assert.Nil(t, err)
+			assert.Equal(t, "value", value)
+		}(loader)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	has, _ := shared.Has("hot:lock")
+	assert.False(t, has)
+}
+
+func TestLoaderDriverServesStaleWhileRevalidating(t *testing.T) {
+	shared := motto.NewMemoryDriver("default", &motto.MemorySettings{JanitorInterval: -1})
+	loader := motto.NewLoaderDriver(shared, &motto.GetViaSettings{StaleWhileRevalidate: 60})
+
+	var calls int32
+	handler := func() (string, time.Duration, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if n == 1 {
+			return "first", time.Millisecond * 20, nil
+		}
+		return "second", time.Minute, nil
+	}
+
+	value, _ := loader.GetVia("key", handler)
+	assert.Equal(t, "first", value)
+
+	time.Sleep(time.Millisecond * 30)
+
+	// Expired but within the stale window: the old value is served
+	value, _ = loader.GetVia("key", handler)
+	assert.Equal(t, "first", value)
+
+	time.Sleep(time.Millisecond * 50)
+
+	value, _ = loader.GetVia("key", handler)
+	assert.Equal(t, "second", value)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestLoaderDriverReportsFailedRefreshes(t *testing.T) {
+	shared := motto.NewMemoryDriver("default", &motto.MemorySettings{JanitorInterval: -1})
+	loader := motto.NewLoaderDriver(shared, &motto.GetViaSettings{StaleWhileRevalidate: 60})
+
+	failures := make(chan string, 2)
+	loader.OnRefreshError(func(key string, err error) {
+		failures <- key + ": " + err.Error()
+	})
+
+	var calls int32
+	handler := func() (string, time.Duration, error) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			return "first", time.Millisecond * 10, nil
+		case 2:
+			return "", 0, errors.New("backend down")
+		}
+		panic("boom")
+	}
+
+	loader.GetVia("key", handler)
+
+	for _, expected := range []string{"key: backend down", "key: panic: boom"} {
+		time.Sleep(time.Millisecond * 20)
+
+		value, err := loader.GetVia("key", handler)
+		assert.Nil(t, err)
+		assert.Equal(t, "first", value)
+
+		select {
+		case failure := <-failures:
+			assert.Equal(t, expected, failure)
+		case <-time.After(time.Second):
+			t.Fatal("refresh failure not reported")
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package jotto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrorLockNotAcquired - the lock is held by someone else
+	ErrorLockNotAcquired = errors.New("lock not acquired")
+
+	// ErrorLockNotHeld - the lock has expired or been taken over by someone else
+	ErrorLockNotHeld = errors.New("lock not held")
+)
+
+// LockOptions - options of a distributed lock
+type LockOptions struct {
+	// TTL - how long the lock lives unless it is extended, defaults to 10 seconds
+	TTL time.Duration
+	// Timeout - how long Acquire waits for the lock, zero to wait until the context is done
+	Timeout time.Duration
+	// RetryInterval - how often Acquire retries, defaults to 100 milliseconds
+	RetryInterval time.Duration
+}
+
+// Lock is a distributed lock stored in a CacheDriver. Each Lock carries a
+// unique owner token, so that it only ever releases or extends the lock it
+// acquired itself, even after its lease expired and someone else took over.
+type Lock struct {
+	cache   cacheRef
+	key     string
+	token   string
+	options LockOptions
+}
+
+// NewLock - create a lock on `key`, nothing is acquired until Acquire or TryAcquire is called
+func NewLock(cache CacheDriver, key string, options *LockOptions) *Lock {
+	return newLock(cacheRef{driver: cache}, key, options)
+}
+
+// NewAppLock - create a lock on `key` in the cache of `app` named `cache`, looked
+// up for every call so that a lock held for long follows the cache across reloads
+func NewAppLock(app Application, cache string, key string, options *LockOptions) *Lock {
+	return newLock(cacheRef{app: app, name: cache}, key, options)
+}
+
+func newLock(cache cacheRef, key string, options *LockOptions) *Lock {
+	lock := &Lock{
+		cache: cache,
+		key:   key,
+		token: GenerateTraceID(),
+	}
+
+	if options != nil {
+		lock.options = *options
+	}
+	if lock.options.TTL <= 0 {
+		lock.options.TTL = time.Second * 10
+	}
+	if lock.options.RetryInterval <= 0 {
+		lock.options.RetryInterval = time.Millisecond * 100
+	}
+
+	return lock
+}
+
+// Key - the cache key of the lock
+func (l *Lock) Key() string {
+	return l.key
+}
+
+// Token - the owner token stored in the cache while the lock is held
+func (l *Lock) Token() string {
+	return l.token
+}
+
+// TryAcquire - acquire the lock without waiting
+func (l *Lock) TryAcquire() (bool, error) {
+	return l.cache.get().SetNX(l.key, l.token, l.options.TTL)
+}
+
+// Acquire - wait for the lock until it is acquired, `Timeout` elapses or `ctx` is done
+func (l *Lock) Acquire(ctx context.Context) error {
+	if l.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.options.Timeout)
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(l.options.RetryInterval)
+	defer ticker.Stop()
+
+	for {
+		acquired, err := l.TryAcquire()
+
+		if err != nil {
+			return err
+		}
+
+		if acquired {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return ErrorLockNotAcquired
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// Release - release the lock if it is still held by us
+func (l *Lock) Release() error {
+	released, err := l.cache.get().CompareAndDelete(l.key, l.token)
+
+	if err != nil {
+		return err
+	}
+
+	if !released {
+		return ErrorLockNotHeld
+	}
+
+	return nil
+}
+
+// Extend - reset the lease of the lock to `ttl` if it is still held by us
+func (l *Lock) Extend(ttl time.Duration) error {
+	extended, err := l.cache.get().CompareAndExpire(l.key, l.token, ttl)
+
+	if err != nil {
+		return err
+	}
+
+	if !extended {
+		return ErrorLockNotHeld
+	}
+
+	return nil
+}
+
+// Run - acquire the lock, run `handler` and release the lock afterwards.
+// The lease is extended in the background while `handler` runs; the context
+// passed to `handler` is cancelled if the lease is lost.
+func (l *Lock) Run(ctx context.Context, handler func(ctx context.Context) error) (err error) {
+	if err = l.Acquire(ctx); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(l.options.TTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if er := l.Extend(l.options.TTL); er == ErrorLockNotHeld {
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	defer func() {
+		cancel()
+		wg.Wait()
+
+		if er := l.Release(); er != nil && err == nil {
+			err = er
+		}
+	}()
+
+	return handler(ctx)
+}
+
+// guard - the Guard logic shared by the cache drivers, built on Lock
+func guard(cache CacheDriver, key string, expiration time.Duration, handler func() error) error {
+	lock := NewLock(cache, key, &LockOptions{TTL: expiration})
+
+	acquired, err := lock.TryAcquire()
+
+	if err != nil {
+		return err
+	}
+
+	if !acquired {
+		return fmt.Errorf("acquiring lock failed: %s", key)
+	}
+
+	defer lock.Release()
+
+	return handler()
+}
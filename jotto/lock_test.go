@@ -0,0 +1,91 @@
+package motto_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.garena.com/duanzy/motto/motto"
+)
+
+func TestLockOnlyReleasesItsOwnLease(t *testing.T) {
+	cache := motto.NewMemoryDriver("default", &motto.MemorySettings{JanitorInterval: -1})
+
+	slow := motto.NewLock(cache, "lock", &motto.LockOptions{TTL: time.Millisecond * 20})
+	acquired, err := slow.TryAcquire()
+	assert.Nil(t, err)
+	assert.True(t, acquired)
+
+	// The slow holder's lease expires and someone else takes over
+	time.Sleep(time.Millisecond * 30)
+
+	fast := motto.NewLock(cache, "lock", &motto.LockOptions{TTL: time.Minute})
+	acquired, _ = fast.TryAcquire()
+	assert.True(t, acquired)
+
+	assert.Equal(t, motto.ErrorLockNotHeld, slow.Release())
+
+	owner, _ := cache.Get("lock")
+	assert.Equal(t, fast.Token(), owner)
+}
+
+func TestLockAcquireWaitsAndTimesOut(t *testing.T) {
+	cache := motto.NewMemoryDriver("default", &motto.MemorySettings{JanitorInterval: -1})
+
+	holder := motto.NewLock(cache, "lock", &motto.LockOptions{TTL: time.Minute})
+	holder.TryAcquire()
+
+	waiter := motto.NewLock(cache, "lock", &motto.LockOptions{Timeout: time.Millisecond * 50, RetryInterval: time.Millisecond * 10})
+	assert.Equal(t, motto.ErrorLockNotAcquired, waiter.Acquire(context.Background()))
+
+	go func() {
+		time.Sleep(time.Millisecond * 30)
+		holder.Release()
+	}()
+
+	waiter = motto.NewLock(cache, "lock", &motto.LockOptions{Timeout: time.Second, RetryInterval: time.Millisecond * 10})
+	assert.Nil(t, waiter.Acquire(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, motto.NewLock(cache, "lock", nil).Acquire(ctx))
+}
+
+func TestLockRunExtendsLease(t *testing.T) {
+	cache := motto.NewMemoryDriver("default", &motto.MemorySettings{JanitorInterval: -1})
+	lock := motto.NewLock(cache, "lock", &motto.LockOptions{TTL: time.Millisecond * 30})
+
+	err := lock.Run(context.Background(), func(ctx context.Context) error {
+		// Outlive the TTL several times over
+		time.Sleep(time.Millisecond * 100)
+
+		owner, _ := cache.Get("lock")
+		assert.Equal(t, lock.Token(), owner)
+		assert.Nil(t, ctx.Err())
+
+		return nil
+	})
+	assert.Nil(t, err)
+
+	has, _ := cache.Has("lock")
+	assert.False(t, has)
+}
+
+func TestLockRunCancelsHandlerWhenLeaseIsLost(t *testing.T) {
+	cache := motto.NewMemoryDriver("default", &motto.MemorySettings{JanitorInterval: -1})
+	lock := motto.NewLock(cache, "lock", &motto.LockOptions{TTL: time.Millisecond * 30})
+
+	err := lock.Run(context.Background(), func(ctx context.Context) error {
+		cache.Set("lock", "stolen", time.Minute)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+			return nil
+		}
+	})
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,807 @@
+package jotto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of points each server takes on the hash ring
+const memcachedReplicas = 160
+
+// Expirations longer than 30 days are treated as unix timestamps by memcached
+const memcachedMaxRelativeExpiry = time.Hour * 24 * 30
+
+var (
+	// ErrorMemcachedMalformedKey - the key is too long or contains spaces or control characters
+	ErrorMemcachedMalformedKey = errors.New("malformed memcached key")
+
+	// ErrorMemcachedNoServers - no memcached servers are configured
+	ErrorMemcachedNoServers = errors.New("no memcached servers configured")
+
+	// ErrorMemcachedPrefixFlush - memcached cannot enumerate keys, so a prefixed driver cannot be flushed
+	ErrorMemcachedPrefixFlush = errors.New("memcached cannot flush the keys under a prefix")
+)
+
+// MemcachedDriver implements the CacheDriver interface on top of the memcached
+// text protocol. Keys are distributed across `MemcachedSettings.Address` with
+// consistent hashing, so adding or removing a server only remaps a fraction of keys.
+type MemcachedDriver struct {
+	name     string
+	settings *MemcachedSettings
+	servers  map[string]*memcachedServer
+	ring     []memcachedPoint
+	flight   flightGroup
+	prefix   string
+}
+
+type memcachedPoint struct {
+	hash    uint32
+	address string
+}
+
+// NewMemcachedDriver - create a memcached driver
+func NewMemcachedDriver(name string, settings *MemcachedSettings) *MemcachedDriver {
+	maxIdle := settings.MaxIdleConns
+	if maxIdle <= 0 {
+		maxIdle = 2
+	}
+
+	md := &MemcachedDriver{
+		name:     name,
+		settings: settings,
+		servers:  make(map[string]*memcachedServer),
+	}
+
+	for _, address := range settings.Address {
+		address = strings.TrimSpace(address)
+		if _, ok := md.servers[address]; ok || address == "" {
+			continue
+		}
+
+		md.servers[address] = &memcachedServer{
+			address:  address,
+			settings: settings,
+			idle:     make(chan *memcachedConn, maxIdle),
+		}
+
+		for i := 0; i < memcachedReplicas; i++ {
+			md.ring = append(md.ring, memcachedPoint{
+				hash:    crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s-%d", address, i))),
+				address: address,
+			})
+		}
+	}
+
+	sort.Slice(md.ring, func(i, j int) bool {
+		return md.ring[i].hash < md.ring[j].hash
+	})
+
+	return md
+}
+
+// Close - close all idle connections, those in use are closed once released
+func (md *MemcachedDriver) Close() error {
+	for _, server := range md.servers {
+		server.close()
+	}
+
+	return nil
+}
+
+// SetPrefix - scope all keys of this driver under `prefix`
+func (md *MemcachedDriver) SetPrefix(prefix string) {
+	md.prefix = prefix
+}
+
+// Prefix - the prefix applied to keys
+func (md *MemcachedDriver) Prefix() string {
+	return md.prefix
+}
+
+// server - pick the server responsible for `key` on the hash ring
+func (md *MemcachedDriver) server(key string) (*memcachedServer, error) {
+	if len(key) == 0 || len(key) > 250 {
+		return nil, ErrorMemcachedMalformedKey
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return nil, ErrorMemcachedMalformedKey
+		}
+	}
+
+	if len(md.ring) == 0 {
+		return nil, ErrorMemcachedNoServers
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	idx := sort.Search(len(md.ring), func(i int) bool {
+		return md.ring[i].hash >= hash
+	})
+	if idx == len(md.ring) {
+		idx = 0
+	}
+
+	return md.servers[md.ring[idx].address], nil
+}
+
+// do - run `fn` with a connection to the server responsible for `key`
+func (md *MemcachedDriver) do(key string, fn func(conn *memcachedConn) error) error {
+	server, err := md.server(key)
+
+	if err != nil {
+		return err
+	}
+
+	return server.do(fn)
+}
+
+// Get - retrieve `key` from memcached
+func (md *MemcachedDriver) Get(key string) (value string, err error) {
+	key = md.prefix + key
+	server, err := md.server(key)
+
+	if err != nil {
+		return "", err
+	}
+
+	values, err := server.get(key)
+
+	if err != nil {
+		return "", err
+	}
+
+	value, ok := values[key]
+
+	if !ok {
+		return "", ErrorCacheMiss
+	}
+
+	return value, nil
+}
+
+// GetVia - retrieve `key` from memcached, call `handler` to fill it in on a miss
+func (md *MemcachedDriver) GetVia(key string, handler func() (string, time.Duration, error)) (string, error) {
+	return getVia(md, &md.flight, key, handler)
+}
+
+// store - run a storage command (set, add, ...) and report whether the value is stored
+func (md *MemcachedDriver) store(command, key, value string, expiration time.Duration) (stored bool, err error) {
+	key = md.prefix + key
+	err = md.do(key, func(conn *memcachedConn) error {
+		if err := conn.send("%s %s 0 %d %d\r\n%s\r\n", command, key, memcachedExpiry(expiration), len(value), value); err != nil {
+			return err
+		}
+
+		line, err := conn.line()
+		if err != nil {
+			return err
+		}
+
+		switch line {
+		case "STORED":
+			stored = true
+		case "NOT_STORED", "EXISTS", "NOT_FOUND":
+			stored = false
+		default:
+			return conn.protocolError(line)
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// Set - put `key` into memcached
+func (md *MemcachedDriver) Set(key string, value string, expiration time.Duration) error {
+	_, err := md.store("set", key, value, expiration)
+
+	return err
+}
+
+// SetNX - put `key` into memcached if `key` is not exist
+func (md *MemcachedDriver) SetNX(key string, value string, expiration time.Duration) (bool, error) {
+	return md.store("add", key, value, expiration)
+}
+
+// Has - check if `key` exists in memcached
+func (md *MemcachedDriver) Has(key string) (bool, error) {
+	_, err := md.Get(key)
+
+	if err == ErrorCacheMiss {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Del - delete `keys` from memcached
+func (md *MemcachedDriver) Del(keys ...string) (bool, error) {
+	_, err := md.MDel(keys...)
+
+	return err == nil, err
+}
+
+// Flush - invalidate all items on every memcached server.
+// Memcached cannot enumerate keys, so this fails when a prefix is set.
+func (md *MemcachedDriver) Flush() (bool, error) {
+	if md.prefix != "" {
+		return false, ErrorMemcachedPrefixFlush
+	}
+
+	for _, server := range md.servers {
+		err := server.do(func(conn *memcachedConn) error {
+			if err := conn.send("flush_all\r\n"); err != nil {
+				return err
+			}
+
+			line, err := conn.line()
+			if err != nil {
+				return err
+			}
+
+			if line != "OK" {
+				return conn.protocolError(line)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// Incr - increase the value of `key`, a missing key is created with the value 1
+func (md *MemcachedDriver) Incr(key string) (int64, error) {
+	return md.incr("incr", key)
+}
+
+// Decr - decrease the value of `key`.
+// Memcached counters are unsigned, so the value will not go below zero.
+func (md *MemcachedDriver) Decr(key string) (int64, error) {
+	return md.incr("decr", key)
+}
+
+func (md *MemcachedDriver) incr(command, key string) (value int64, err error) {
+	for {
+		found := true
+
+		err = md.do(md.prefix+key, func(conn *memcachedConn) error {
+			if err := conn.send("%s %s 1\r\n", command, md.prefix+key); err != nil {
+				return err
+			}
+
+			line, err := conn.line()
+			if err != nil {
+				return err
+			}
+
+			if line == "NOT_FOUND" {
+				found = false
+				return nil
+			}
+
+			if value, err = strconv.ParseInt(line, 10, 64); err != nil {
+				return conn.protocolError(line)
+			}
+
+			return nil
+		})
+
+		if err != nil || found {
+			return
+		}
+
+		// The counter does not exist yet, try to create it. Someone else may
+		// win the race, in which case we simply try to increment again.
+		initial := int64(0)
+		if command == "incr" {
+			initial = 1
+		}
+
+		stored, err := md.store("add", key, strconv.FormatInt(initial, 10), 0)
+		if err != nil {
+			return 0, err
+		}
+		if stored {
+			return initial, nil
+		}
+	}
+}
+
+// Expire - set the expire time of `key`
+func (md *MemcachedDriver) Expire(key string, expiry time.Duration) (touched bool, err error) {
+	if expiry <= 0 {
+		var exists bool
+		if exists, err = md.Has(key); err != nil || !exists {
+			return false, err
+		}
+		return md.Del(key)
+	}
+
+	key = md.prefix + key
+	err = md.do(key, func(conn *memcachedConn) error {
+		if err := conn.send("touch %s %d\r\n", key, memcachedExpiry(expiry)); err != nil {
+			return err
+		}
+
+		line, err := conn.line()
+		if err != nil {
+			return err
+		}
+
+		switch line {
+		case "TOUCHED":
+			touched = true
+		case "NOT_FOUND":
+			touched = false
+		default:
+			return conn.protocolError(line)
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// Guard - guard the execution of `handler` with a lock
+func (md *MemcachedDriver) Guard(key string, expiration time.Duration, handler func() error) error {
+	return guard(md, key, expiration, handler)
+}
+
+// CompareAndDelete - delete `key` if it holds `value`, using gets and cas.
+// The item is overwritten with a negative exptime, which expires it at once.
+func (md *MemcachedDriver) CompareAndDelete(key, value string) (bool, error) {
+	return md.compareAndSwap(key, value, -1)
+}
+
+// CompareAndExpire - set the expire time of `key` if it holds `value`, using gets and cas
+func (md *MemcachedDriver) CompareAndExpire(key, value string, expiry time.Duration) (bool, error) {
+	if expiry <= 0 {
+		return md.CompareAndDelete(key, value)
+	}
+
+	return md.compareAndSwap(key, value, memcachedExpiry(expiry))
+}
+
+// compareAndSwap - rewrite `key` with a new exptime if it still holds `value`
+func (md *MemcachedDriver) compareAndSwap(key, value string, exptime int64) (swapped bool, err error) {
+	key = md.prefix + key
+	err = md.do(key, func(conn *memcachedConn) error {
+		if err := conn.send("gets %s\r\n", key); err != nil {
+			return err
+		}
+
+		var (
+			current string
+			unique  string
+			found   bool
+		)
+
+		for {
+			line, err := conn.line()
+			if err != nil {
+				return err
+			}
+
+			if line == "END" {
+				break
+			}
+
+			// VALUE <key> <flags> <bytes> <cas unique>
+			fields := strings.Fields(line)
+			if len(fields) < 5 || fields[0] != "VALUE" {
+				return conn.protocolError(line)
+			}
+
+			size, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return conn.protocolError(line)
+			}
+
+			if current, err = conn.block(size); err != nil {
+				return err
+			}
+			unique = fields[4]
+			found = true
+		}
+
+		if !found || current != value {
+			return nil
+		}
+
+		if err := conn.send("cas %s 0 %d %d %s\r\n%s\r\n", key, exptime, len(value), unique, value); err != nil {
+			return err
+		}
+
+		line, err := conn.line()
+		if err != nil {
+			return err
+		}
+
+		switch line {
+		case "STORED":
+			swapped = true
+		case "EXISTS", "NOT_FOUND":
+			swapped = false
+		default:
+			return conn.protocolError(line)
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// memcachedExpiry - convert a duration into a memcached exptime
+func memcachedExpiry(expiration time.Duration) int64 {
+	if expiration <= 0 {
+		return 0
+	}
+
+	if expiration > memcachedMaxRelativeExpiry {
+		return time.Now().Add(expiration).Unix()
+	}
+
+	// Round up so that sub-second expirations do not turn into "never expire"
+	return int64((expiration + time.Second - 1) / time.Second)
+}
+
+// MGet - retrieve multiple keys, with a single multi-key get per server
+func (md *MemcachedDriver) MGet(keys ...string) (map[string]string, error) {
+	groups := make(map[*memcachedServer][]string)
+
+	for _, key := range keys {
+		server, err := md.server(md.prefix + key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		groups[server] = append(groups[server], md.prefix+key)
+	}
+
+	values := make(map[string]string, len(keys))
+
+	for server, keys := range groups {
+		found, err := server.get(keys...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for key, value := range found {
+			values[strings.TrimPrefix(key, md.prefix)] = value
+		}
+	}
+
+	return values, nil
+}
+
+// MSet - put multiple items into memcached
+func (md *MemcachedDriver) MSet(items ...*CacheItem) error {
+	return mset(md, items)
+}
+
+// MDel - delete multiple keys from memcached
+func (md *MemcachedDriver) MDel(keys ...string) (deleted int64, err error) {
+	for _, key := range keys {
+		key = md.prefix + key
+		err = md.do(key, func(conn *memcachedConn) error {
+			if err := conn.send("delete %s\r\n", key); err != nil {
+				return err
+			}
+
+			line, err := conn.line()
+			if err != nil {
+				return err
+			}
+
+			switch line {
+			case "DELETED":
+				deleted++
+			case "NOT_FOUND":
+			default:
+				return conn.protocolError(line)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Batch - start a batch of operations, executed one by one
+func (md *MemcachedDriver) Batch() CacheBatch {
+	return newSequentialBatch(md)
+}
+
+/* Data structures */
+
+// HGet - not supported by memcached
+func (md *MemcachedDriver) HGet(key, field string) (string, error) {
+	return "", ErrorCacheUnsupported
+}
+
+// HSet - not supported by memcached
+func (md *MemcachedDriver) HSet(key, field, value string) error {
+	return ErrorCacheUnsupported
+}
+
+// HDel - not supported by memcached
+func (md *MemcachedDriver) HDel(key string, fields ...string) (int64, error) {
+	return 0, ErrorCacheUnsupported
+}
+
+// HGetAll - not supported by memcached
+func (md *MemcachedDriver) HGetAll(key string) (map[string]string, error) {
+	return nil, ErrorCacheUnsupported
+}
+
+// HIncrBy - not supported by memcached
+func (md *MemcachedDriver) HIncrBy(key, field string, delta int64) (int64, error) {
+	return 0, ErrorCacheUnsupported
+}
+
+// ZAdd - not supported by memcached
+func (md *MemcachedDriver) ZAdd(key string, members ...ZMember) (int64, error) {
+	return 0, ErrorCacheUnsupported
+}
+
+// ZRange - not supported by memcached
+func (md *MemcachedDriver) ZRange(key string, start, stop int64) ([]ZMember, error) {
+	return nil, ErrorCacheUnsupported
+}
+
+// ZRevRange - not supported by memcached
+func (md *MemcachedDriver) ZRevRange(key string, start, stop int64) ([]ZMember, error) {
+	return nil, ErrorCacheUnsupported
+}
+
+// ZRank - not supported by memcached
+func (md *MemcachedDriver) ZRank(key, member string) (int64, error) {
+	return 0, ErrorCacheUnsupported
+}
+
+// LPush - not supported by memcached
+func (md *MemcachedDriver) LPush(key string, values ...string) (int64, error) {
+	return 0, ErrorCacheUnsupported
+}
+
+// RPush - not supported by memcached
+func (md *MemcachedDriver) RPush(key string, values ...string) (int64, error) {
+	return 0, ErrorCacheUnsupported
+}
+
+// LPop - not supported by memcached
+func (md *MemcachedDriver) LPop(key string) (string, error) {
+	return "", ErrorCacheUnsupported
+}
+
+// RPop - not supported by memcached
+func (md *MemcachedDriver) RPop(key string) (string, error) {
+	return "", ErrorCacheUnsupported
+}
+
+// LRange - not supported by memcached
+func (md *MemcachedDriver) LRange(key string, start, stop int64) ([]string, error) {
+	return nil, ErrorCacheUnsupported
+}
+
+// LTrim - not supported by memcached
+func (md *MemcachedDriver) LTrim(key string, start, stop int64) error {
+	return ErrorCacheUnsupported
+}
+
+// Throttle - not supported by memcached
+func (md *MemcachedDriver) Throttle(key string, limit *RateLimit) (*RateLimitResult, error) {
+	return nil, ErrorCacheUnsupported
+}
+
+/* Connections */
+
+type memcachedServer struct {
+	address  string
+	settings *MemcachedSettings
+	idle     chan *memcachedConn
+
+	mutex  sync.Mutex
+	closed bool // connections are not pooled anymore
+}
+
+type memcachedConn struct {
+	conn     net.Conn
+	rw       *bufio.ReadWriter
+	settings *MemcachedSettings
+}
+
+// do - run `fn` on a pooled connection. Connections that hit an I/O or
+// protocol error are discarded instead of going back to the pool.
+func (ms *memcachedServer) do(fn func(conn *memcachedConn) error) (err error) {
+	conn, err := ms.acquire()
+
+	if err != nil {
+		return
+	}
+
+	conn.deadline()
+
+	if err = fn(conn); err != nil {
+		conn.conn.Close()
+		return
+	}
+
+	ms.release(conn)
+
+	return
+}
+
+// get - fetch `keys` with a single get command, missing keys are left out
+func (ms *memcachedServer) get(keys ...string) (values map[string]string, err error) {
+	values = make(map[string]string, len(keys))
+
+	err = ms.do(func(conn *memcachedConn) error {
+		if err := conn.send("get %s\r\n", strings.Join(keys, " ")); err != nil {
+			return err
+		}
+
+		for {
+			line, err := conn.line()
+			if err != nil {
+				return err
+			}
+
+			if line == "END" {
+				return nil
+			}
+
+			// VALUE <key> <flags> <bytes>
+			fields := strings.Fields(line)
+			if len(fields) < 4 || fields[0] != "VALUE" {
+				return conn.protocolError(line)
+			}
+
+			size, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return conn.protocolError(line)
+			}
+
+			if values[fields[1]], err = conn.block(size); err != nil {
+				return err
+			}
+		}
+	})
+
+	return
+}
+
+func (ms *memcachedServer) acquire() (*memcachedConn, error) {
+	select {
+	case conn := <-ms.idle:
+		return conn, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", ms.address, time.Duration(ms.settings.DialTimeout)*time.Second)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &memcachedConn{
+		conn:     conn,
+		rw:       bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+		settings: ms.settings,
+	}, nil
+}
+
+func (ms *memcachedServer) release(conn *memcachedConn) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if ms.closed {
+		conn.conn.Close()
+		return
+	}
+
+	select {
+	case ms.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+func (ms *memcachedServer) close() {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.closed = true
+
+	for {
+		select {
+		case conn := <-ms.idle:
+			conn.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (mc *memcachedConn) deadline() {
+	var read, write time.Time
+
+	if mc.settings.ReadTimeout > 0 {
+		read = time.Now().Add(time.Duration(mc.settings.ReadTimeout) * time.Second)
+	}
+	if mc.settings.WriteTimeout > 0 {
+		write = time.Now().Add(time.Duration(mc.settings.WriteTimeout) * time.Second)
+	}
+
+	mc.conn.SetReadDeadline(read)
+	mc.conn.SetWriteDeadline(write)
+}
+
+func (mc *memcachedConn) send(format string, v ...interface{}) (err error) {
+	if _, err = fmt.Fprintf(mc.rw, format, v...); err != nil {
+		return
+	}
+
+	return mc.rw.Flush()
+}
+
+// line - read a response line without the trailing CRLF
+func (mc *memcachedConn) line() (string, error) {
+	line, err := mc.rw.ReadString('\n')
+
+	if err != nil {
+		return "", err
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+
+	if strings.HasPrefix(line, "ERROR") || strings.HasPrefix(line, "CLIENT_ERROR") || strings.HasPrefix(line, "SERVER_ERROR") {
+		return "", fmt.Errorf("memcached: %s", line)
+	}
+
+	return line, nil
+}
+
+// block - read a data block of `size` bytes followed by CRLF
+func (mc *memcachedConn) block(size int) (string, error) {
+	buffer := make([]byte, size+2)
+
+	if _, err := io.ReadFull(mc.rw, buffer); err != nil {
+		return "", err
+	}
+
+	if !bytes.HasSuffix(buffer, []byte("\r\n")) {
+		return "", fmt.Errorf("memcached: corrupt data block")
+	}
+
+	return string(buffer[:size]), nil
+}
+
+func (mc *memcachedConn) protocolError(line string) error {
+	return fmt.Errorf("memcached: unexpected response `%s`", line)
+}
@@ -0,0 +1,381 @@
+package motto_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.garena.com/duanzy/motto/motto"
+)
+
+// fakeMemcached is a stand-in memcached server speaking a subset of the text protocol
+type fakeMemcached struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	items    map[string]string
+	uniques  map[string]uint64
+	counter  uint64
+	open     int           // connections being served
+	delay    time.Duration // how long to wait before answering a command
+}
+
+func newFakeMemcached(t *testing.T) *fakeMemcached {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+
+	server := &fakeMemcached{listener: listener, items: make(map[string]string), uniques: make(map[string]uint64)}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (s *fakeMemcached) Address() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeMemcached) Close() {
+	s.listener.Close()
+}
+
+func (s *fakeMemcached) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.items)
+}
+
+// Open - the number of client connections still open
+func (s *fakeMemcached) Open() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.open
+}
+
+func (s *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+
+	s.mutex.Lock()
+	s.open++
+	delay := s.delay
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		s.open--
+		s.mutex.Unlock()
+	}()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		time.Sleep(delay)
+
+		s.mutex.Lock()
+		switch fields[0] {
+		case "get", "gets":
+			for _, key := range fields[1:] {
+				if value, ok := s.items[key]; ok {
+					if fields[0] == "gets" {
+						fmt.Fprintf(rw, "VALUE %s 0 %d %d\r\n%s\r\n", key, len(value), s.uniques[key], value)
+					} else {
+						fmt.Fprintf(rw, "VALUE %s 0 %d\r\n%s\r\n", key, len(value), value)
+					}
+				}
+			}
+			rw.WriteString("END\r\n")
+		case "set", "add", "cas":
+			size, _ := strconv.Atoi(fields[4])
+			data := make([]byte, size+2)
+			io.ReadFull(rw, data)
+
+			_, exists := s.items[fields[1]]
+			if fields[0] == "add" && exists {
+				rw.WriteString("NOT_STORED\r\n")
+			} else if fields[0] == "cas" && !exists {
+				rw.WriteString("NOT_FOUND\r\n")
+			} else if fields[0] == "cas" && fields[5] != strconv.FormatUint(s.uniques[fields[1]], 10) {
+				rw.WriteString("EXISTS\r\n")
+			} else if strings.HasPrefix(fields[3], "-") {
+				delete(s.items, fields[1])
+				rw.WriteString("STORED\r\n")
+			} else {
+				s.counter++
+				s.items[fields[1]] = string(data[:size])
+				s.uniques[fields[1]] = s.counter
+				rw.WriteString("STORED\r\n")
+			}
+		case "delete":
+			if _, ok := s.items[fields[1]]; ok {
+				delete(s.items, fields[1])
+				rw.WriteString("DELETED\r\n")
+			} else {
+				rw.WriteString("NOT_FOUND\r\n")
+			}
+		case "incr", "decr":
+			value, ok := s.items[fields[1]]
+			if !ok {
+				rw.WriteString("NOT_FOUND\r\n")
+				break
+			}
+			current, _ := strconv.ParseUint(value, 10, 64)
+			delta, _ := strconv.ParseUint(fields[2], 10, 64)
+			if fields[0] == "incr" {
+				current += delta
+			} else if current < delta {
+				current = 0
+			} else {
+				current -= delta
+			}
+			s.items[fields[1]] = strconv.FormatUint(current, 10)
+			fmt.Fprintf(rw, "%d\r\n", current)
+		case "touch":
+			if _, ok := s.items[fields[1]]; ok {
+				rw.WriteString("TOUCHED\r\n")
+			} else {
+				rw.WriteString("NOT_FOUND\r\n")
+			}
+		case "flush_all":
+			s.items = make(map[string]string)
+			rw.WriteString("OK\r\n")
+		default:
+			rw.WriteString("ERROR\r\n")
+		}
+		s.mutex.Unlock()
+
+		rw.Flush()
+	}
+}
+
+func TestMemcachedDriverBasicOperations(t *testing.T) {
+	server := newFakeMemcached(t)
+	defer server.Close()
+
+	cache := motto.NewMemcachedDriver("mem", &motto.MemcachedSettings{Address: []string{server.Address()}})
+	defer cache.Close()
+
+	_, err := cache.Get("missing")
+	assert.True(t, motto.IsCacheMiss(err))
+
+	assert.Nil(t, cache.Set("key", "hello\r\nworld", time.Minute))
+	value, err := cache.Get("key")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\r\nworld", value)
+
+	ok, err := cache.SetNX("key", "other", 0)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	has, _ := cache.Has("key")
+	assert.True(t, has)
+
+	ok, _ = cache.Expire("key", time.Minute)
+	assert.True(t, ok)
+	ok, _ = cache.Expire("missing", time.Minute)
+	assert.False(t, ok)
+
+	cache.Del("key")
+	has, _ = cache.Has("key")
+	assert.False(t, has)
+
+	count, err := cache.Incr("counter")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+	count, _ = cache.Incr("counter")
+	assert.Equal(t, int64(2), count)
+	count, _ = cache.Decr("counter")
+	assert.Equal(t, int64(1), count)
+
+	_, err = cache.Get("bad key")
+	assert.Equal(t, motto.ErrorMemcachedMalformedKey, err)
+
+	cache.Flush()
+	assert.Equal(t, 0, server.Len())
+}
+
+func TestMemcachedDriverDistributesKeysAcrossServers(t *testing.T) {
+	first := newFakeMemcached(t)
+	defer first.Close()
+	second := newFakeMemcached(t)
+	defer second.Close()
+
+	settings := &motto.MemcachedSettings{Address: []string{first.Address(), second.Address()}}
+	cache := motto.NewMemcachedDriver("mem", settings)
+	defer cache.Close()
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, cache.Set(fmt.Sprintf("key:%d", i), "v", 0))
+	}
+
+	assert.Equal(t, 100, first.Len()+second.Len())
+	assert.True(t, first.Len() > 0)
+	assert.True(t, second.Len() > 0)
+
+	// The same key always lands on the same server
+	again := motto.NewMemcachedDriver("mem", settings)
+	defer again.Close()
+	for i := 0; i < 100; i++ {
+		value, err := again.Get(fmt.Sprintf("key:%d", i))
+		assert.Nil(t, err)
+		assert.Equal(t, "v", value)
+	}
+}
+
+func TestMemcachedDriverCloseReleasesConnectionsInUse(t *testing.T) {
+	server := newFakeMemcached(t)
+	defer server.Close()
+	server.mutex.Lock()
+	server.delay = 100 * time.Millisecond
+	server.mutex.Unlock()
+
+	// The address is only pooled once
+	cache := motto.NewMemcachedDriver("mem", &motto.MemcachedSettings{Address: []string{server.Address(), " " + server.Address()}})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := cache.Get("key")
+		assert.True(t, motto.IsCacheMiss(err))
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 1, server.Open())
+	assert.Nil(t, cache.Close())
+	<-done
+
+	// The connection in use when the driver was closed is not pooled
+	for i := 0; i < 20 && server.Open() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, server.Open())
+}
+
+func TestMemcachedDriverMGetAcrossServers(t *testing.T) {
+	first := newFakeMemcached(t)
+	defer first.Close()
+	second := newFakeMemcached(t)
+	defer second.Close()
+
+	cache := motto.NewMemcachedDriver("mem", &motto.MemcachedSettings{Address: []string{first.Address(), second.Address()}})
+	defer cache.Close()
+
+	items := []*motto.CacheItem{}
+	keys := []string{"missing"}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		items = append(items, &motto.CacheItem{Key: key, Value: key})
+		keys = append(keys, key)
+	}
+	assert.Nil(t, cache.MSet(items...))
+
+	values, err := cache.MGet(keys...)
+	assert.Nil(t, err)
+	assert.Len(t, values, 20)
+	assert.Equal(t, "key:7", values["key:7"])
+
+	deleted, err := cache.MDel("key:1", "key:2", "missing")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), deleted)
+}
+
+func TestMemcachedDriverCompareAndSwap(t *testing.T) {
+	server := newFakeMemcached(t)
+	defer server.Close()
+
+	cache := motto.NewMemcachedDriver("mem", &motto.MemcachedSettings{Address: []string{server.Address()}})
+	defer cache.Close()
+
+	lock := motto.NewLock(cache, "lock", &motto.LockOptions{TTL: time.Minute})
+	other := motto.NewLock(cache, "lock", &motto.LockOptions{TTL: time.Minute})
+
+	acquired, err := lock.TryAcquire()
+	assert.Nil(t, err)
+	assert.True(t, acquired)
+
+	acquired, _ = other.TryAcquire()
+	assert.False(t, acquired)
+	assert.Equal(t, motto.ErrorLockNotHeld, other.Extend(time.Minute))
+	assert.Equal(t, motto.ErrorLockNotHeld, other.Release())
+
+	assert.Nil(t, lock.Extend(time.Minute))
+	assert.Nil(t, lock.Release())
+
+	has, _ := cache.Has("lock")
+	assert.False(t, has)
+}
+
+func TestMemcachedDriverPrefix(t *testing.T) {
+	server := newFakeMemcached(t)
+	defer server.Close()
+
+	settings := &motto.MemcachedSettings{Address: []string{server.Address()}}
+	cache := motto.NewMemcachedDriver("mem", settings)
+	defer cache.Close()
+	cache.SetPrefix("app:")
+
+	other := motto.NewMemcachedDriver("mem", settings)
+	defer other.Close()
+
+	assert.Nil(t, cache.Set("key", "scoped", 0))
+	assert.Nil(t, other.Set("key", "global", 0))
+
+	value, _ := cache.Get("key")
+	assert.Equal(t, "scoped", value)
+	value, _ = other.Get("app:key")
+	assert.Equal(t, "scoped", value)
+
+	count, _ := cache.Incr("counter")
+	assert.Equal(t, int64(1), count)
+
+	values, err := cache.MGet("key", "counter")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"key": "scoped", "counter": "1"}, values)
+
+	_, err = cache.Flush()
+	assert.Equal(t, motto.ErrorMemcachedPrefixFlush, err)
+
+	deleted, _ := cache.MDel("key", "counter")
+	assert.Equal(t, int64(2), deleted)
+	value, _ = other.Get("key")
+	assert.Equal(t, "global", value)
+}
+
+func TestMemcachedDriverSelectedBySettings(t *testing.T) {
+	cfg := motto.NewDefaultSettings()
+	cfg.Motto().Cache = []*motto.CacheSettings{
+		{Name: "mem", Driver: "memcached", Memcached: &motto.MemcachedSettings{Address: []string{"127.0.0.1:11211"}}},
+	}
+	app := motto.NewApplication(cfg, nil, nil, nil)
+	app.Boot()
+
+	assert.IsType(t, &motto.MemcachedDriver{}, app.Cache("mem").(*motto.MetricsDriver).Driver())
+}
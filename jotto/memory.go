@@ -0,0 +1,1809 @@
+package jotto
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MemoryDriver is an in-process driver that keeps everything in memory.
+// It is meant for tests and single-process deployments; data is lost when
+// the process exits and is never shared between processes.
+type MemoryDriver struct {
+	name     string
+	settings atomic.Value // *MemorySettings, replaced by configure on reload
+
+	mutex  sync.Mutex
+	queues map[string]*memoryQueue
+
+	// Cache entries, most recently used at the front of `lru`
+	lru     *list.List
+	entries map[string]*list.Element
+	bytes   int64
+	flight  flightGroup
+
+	subscriptions map[string]map[*memorySubscription]bool
+
+	sweeping bool               // the janitor is running, guarded by `mutex`
+	retune   chan time.Duration // the new interval of the running janitor
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// NewMemoryDriver - create an in-memory driver
+func NewMemoryDriver(name string, settings *MemorySettings) *MemoryDriver {
+	if settings == nil {
+		settings = &MemorySettings{}
+	}
+
+	md := &MemoryDriver{
+		name:    name,
+		queues:  make(map[string]*memoryQueue),
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		retune:  make(chan time.Duration, 1),
+		stop:    make(chan struct{}),
+
+		subscriptions: make(map[string]map[*memorySubscription]bool),
+	}
+	md.configure(settings)
+
+	return md
+}
+
+// configure - apply `settings` to the driver, keeping its entries and jobs.
+// Lowered limits are enforced on the next write.
+func (md *MemoryDriver) configure(settings *MemorySettings) {
+	if settings == nil {
+		settings = &MemorySettings{}
+	}
+	md.settings.Store(settings)
+
+	interval := time.Duration(settings.JanitorInterval) * time.Second
+	if settings.JanitorInterval == 0 {
+		interval = time.Minute
+	}
+
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	if md.sweeping {
+		// The buffer only ever holds the latest interval
+		select {
+		case <-md.retune:
+		default:
+		}
+		md.retune <- interval
+	} else if interval > 0 {
+		md.sweeping = true
+		go md.janitor(interval)
+	}
+}
+
+// config - the current settings
+func (md *MemoryDriver) config() *MemorySettings {
+	return md.settings.Load().(*MemorySettings)
+}
+
+// Close - stop the background janitor
+func (md *MemoryDriver) Close() error {
+	md.once.Do(func() {
+		close(md.stop)
+	})
+
+	return nil
+}
+
+// janitor - periodically remove expired cache entries, unique keys of jobs, finished batches and completed chains
+func (md *MemoryDriver) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			md.mutex.Lock()
+			now := time.Now()
+			for _, element := range md.entries {
+				if element.Value.(*memoryEntry).expired(now) {
+					md.remove(element)
+				}
+			}
+			for _, mq := range md.queues {
+				for key, holder := range mq.unique {
+					if holder.expires != 0 && holder.expires <= now.Unix() {
+						delete(mq.unique, key)
+					}
+				}
+				for id, mb := range mq.batches {
+					if mb.expires != 0 && mb.expires <= now.Unix() {
+						delete(mq.batches, id)
+					}
+				}
+				for id, mc := range mq.chains {
+					if mc.expires != 0 && mc.expires <= now.Unix() {
+						delete(mq.chains, id)
+					}
+				}
+			}
+			md.mutex.Unlock()
+		case interval := <-md.retune:
+			if interval <= 0 {
+				md.mutex.Lock()
+				md.sweeping = false
+				md.mutex.Unlock()
+				return
+			}
+			ticker.Reset(interval)
+		case <-md.stop:
+			return
+		}
+	}
+}
+
+/* CacheDriver */
+
+type memoryEntry struct {
+	key      string
+	value    string
+	data     interface{} // map[string]string, map[string]float64, []string or *memoryRateLimit
+	expireAt time.Time   // zero means the entry never expires
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expireAt.IsZero() && !now.Before(e.expireAt)
+}
+
+func (e *memoryEntry) size() int64 {
+	size := len(e.key) + len(e.value)
+
+	switch data := e.data.(type) {
+	case map[string]string:
+		for field, value := range data {
+			size += len(field) + len(value)
+		}
+	case map[string]float64:
+		for member := range data {
+			size += len(member) + 8
+		}
+	case []string:
+		for _, value := range data {
+			size += len(value)
+		}
+	case *memoryRateLimit:
+		size += 16 + len(data.log)*8
+	}
+
+	return int64(size)
+}
+
+// lookup - find a live entry and mark it as recently used, the caller must hold the mutex
+func (md *MemoryDriver) lookup(key string) *memoryEntry {
+	element, ok := md.entries[key]
+
+	if !ok {
+		return nil
+	}
+
+	entry := element.Value.(*memoryEntry)
+	if entry.expired(time.Now()) {
+		md.remove(element)
+		return nil
+	}
+
+	md.lru.MoveToFront(element)
+
+	return entry
+}
+
+// store - put an entry into the cache and evict the least recently used
+// entries when over budget, the caller must hold the mutex
+func (md *MemoryDriver) store(key, value string, expiration time.Duration) {
+	entry := &memoryEntry{key: key, value: value}
+	if expiration > 0 {
+		entry.expireAt = time.Now().Add(expiration)
+	}
+
+	if element, ok := md.entries[key]; ok {
+		md.bytes -= element.Value.(*memoryEntry).size()
+		element.Value = entry
+		md.lru.MoveToFront(element)
+	} else {
+		md.entries[key] = md.lru.PushFront(entry)
+	}
+	md.bytes += entry.size()
+
+	md.evict()
+}
+
+// evict - evict the least recently used entries while over budget, the caller must hold the mutex
+func (md *MemoryDriver) evict() {
+	for md.lru.Len() > 0 {
+		if settings := md.config(); settings.MaxEntries > 0 && md.lru.Len() > settings.MaxEntries {
+			md.remove(md.lru.Back())
+		} else if settings.MaxBytes > 0 && md.bytes > settings.MaxBytes {
+			md.remove(md.lru.Back())
+		} else {
+			break
+		}
+	}
+}
+
+// remove - drop an entry from the cache, the caller must hold the mutex
+func (md *MemoryDriver) remove(element *list.Element) {
+	entry := element.Value.(*memoryEntry)
+
+	md.lru.Remove(element)
+	delete(md.entries, entry.key)
+	md.bytes -= entry.size()
+}
+
+// Get - retrieve `key` from memory
+func (md *MemoryDriver) Get(key string) (value string, err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	if entry := md.lookup(key); entry != nil {
+		if entry.data != nil {
+			return "", ErrorCacheWrongType
+		}
+		return entry.value, nil
+	}
+
+	return "", ErrorCacheMiss
+}
+
+// GetVia - retrieve `key` from memory, call `handler` to fill it in on a miss
+func (md *MemoryDriver) GetVia(key string, handler func() (string, time.Duration, error)) (string, error) {
+	return getVia(md, &md.flight, key, handler)
+}
+
+// Set - put `key` into memory
+func (md *MemoryDriver) Set(key string, value string, expiration time.Duration) error {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	md.store(key, value, expiration)
+
+	return nil
+}
+
+// SetNX - put `key` into memory if `key` is not exist
+func (md *MemoryDriver) SetNX(key string, value string, expiration time.Duration) (bool, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	if md.lookup(key) != nil {
+		return false, nil
+	}
+
+	md.store(key, value, expiration)
+
+	return true, nil
+}
+
+// Has - check if `key` exists in memory
+func (md *MemoryDriver) Has(key string) (bool, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	return md.lookup(key) != nil, nil
+}
+
+// Del - delete `keys` from memory
+func (md *MemoryDriver) Del(keys ...string) (bool, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	for _, key := range keys {
+		if element, ok := md.entries[key]; ok {
+			md.remove(element)
+		}
+	}
+
+	return true, nil
+}
+
+// Flush - delete all cached keys, queues are left untouched
+func (md *MemoryDriver) Flush() (bool, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	md.lru.Init()
+	md.entries = make(map[string]*list.Element)
+	md.bytes = 0
+
+	return true, nil
+}
+
+// Incr - increase the value of `key`
+func (md *MemoryDriver) Incr(key string) (int64, error) {
+	return md.incrBy(key, 1)
+}
+
+// Decr - decrease the value of `key`
+func (md *MemoryDriver) Decr(key string) (int64, error) {
+	return md.incrBy(key, -1)
+}
+
+// incrBy - add `delta` to the integer stored at `key`, keeping its expire time like Redis does
+func (md *MemoryDriver) incrBy(key string, delta int64) (int64, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	var (
+		current    int64
+		expiration time.Duration
+		err        error
+	)
+
+	if entry := md.lookup(key); entry != nil {
+		if entry.data != nil {
+			return 0, ErrorCacheWrongType
+		}
+		if current, err = strconv.ParseInt(entry.value, 10, 64); err != nil {
+			return 0, fmt.Errorf("value of `%s` is not an integer", key)
+		}
+		if !entry.expireAt.IsZero() {
+			expiration = time.Until(entry.expireAt)
+		}
+	}
+
+	current += delta
+	md.store(key, strconv.FormatInt(current, 10), expiration)
+
+	return current, nil
+}
+
+// Expire - set the expire time of `key`
+func (md *MemoryDriver) Expire(key string, expiry time.Duration) (bool, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	entry := md.lookup(key)
+	if entry == nil {
+		return false, nil
+	}
+
+	if expiry <= 0 {
+		md.remove(md.entries[key])
+	} else {
+		entry.expireAt = time.Now().Add(expiry)
+	}
+
+	return true, nil
+}
+
+// Guard - guard the execution of `handler` with a lock
+func (md *MemoryDriver) Guard(key string, expiration time.Duration, handler func() error) error {
+	return guard(md, key, expiration, handler)
+}
+
+// CompareAndDelete - delete `key` if it holds `value`
+func (md *MemoryDriver) CompareAndDelete(key, value string) (bool, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	entry := md.lookup(key)
+	if entry == nil || entry.data != nil || entry.value != value {
+		return false, nil
+	}
+
+	md.remove(md.entries[key])
+
+	return true, nil
+}
+
+// CompareAndExpire - set the expire time of `key` if it holds `value`
+func (md *MemoryDriver) CompareAndExpire(key, value string, expiry time.Duration) (bool, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	entry := md.lookup(key)
+	if entry == nil || entry.data != nil || entry.value != value {
+		return false, nil
+	}
+
+	if expiry <= 0 {
+		md.remove(md.entries[key])
+	} else {
+		entry.expireAt = time.Now().Add(expiry)
+	}
+
+	return true, nil
+}
+
+// MGet - retrieve multiple keys from memory
+func (md *MemoryDriver) MGet(keys ...string) (map[string]string, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	values := make(map[string]string, len(keys))
+
+	for _, key := range keys {
+		if entry := md.lookup(key); entry != nil && entry.data == nil {
+			values[key] = entry.value
+		}
+	}
+
+	return values, nil
+}
+
+// MSet - put multiple items into memory
+func (md *MemoryDriver) MSet(items ...*CacheItem) error {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	for _, item := range items {
+		md.store(item.Key, item.Value, item.Expiration)
+	}
+
+	return nil
+}
+
+// MDel - delete multiple keys from memory
+func (md *MemoryDriver) MDel(keys ...string) (deleted int64, err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	for _, key := range keys {
+		if md.lookup(key) != nil {
+			md.remove(md.entries[key])
+			deleted++
+		}
+	}
+
+	return
+}
+
+// Batch - start a batch of operations, executed one by one
+func (md *MemoryDriver) Batch() CacheBatch {
+	return newSequentialBatch(md)
+}
+
+/* Data structures */
+
+// structure - find the data structure of the kind of `empty` at `key`, creating
+// it from `empty` if `create` is set. The caller must hold the mutex and call
+// `resized` after changing the structure.
+func (md *MemoryDriver) structure(key string, empty interface{}, create bool) (*memoryEntry, error) {
+	entry := md.lookup(key)
+
+	if entry == nil {
+		if !create {
+			return nil, nil
+		}
+		entry = &memoryEntry{key: key, data: empty}
+		md.entries[key] = md.lru.PushFront(entry)
+		md.bytes += entry.size()
+		return entry, nil
+	}
+
+	if memoryKind(entry.data) != memoryKind(empty) {
+		return nil, ErrorCacheWrongType
+	}
+
+	return entry, nil
+}
+
+// memoryKind - the kind of value held by an entry
+func memoryKind(data interface{}) string {
+	switch data.(type) {
+	case map[string]string:
+		return "hash"
+	case map[string]float64:
+		return "zset"
+	case []string:
+		return "list"
+	case *memoryRateLimit:
+		return "ratelimit"
+	}
+	return "string"
+}
+
+// resized - account for a changed data structure, dropping it once empty
+// like Redis does. The caller must hold the mutex.
+func (md *MemoryDriver) resized(entry *memoryEntry, before int64) {
+	empty := false
+
+	switch data := entry.data.(type) {
+	case map[string]string:
+		empty = len(data) == 0
+	case map[string]float64:
+		empty = len(data) == 0
+	case []string:
+		empty = len(data) == 0
+	}
+
+	element := md.entries[entry.key]
+
+	if empty {
+		md.bytes -= before
+		md.lru.Remove(element)
+		delete(md.entries, entry.key)
+		return
+	}
+
+	md.bytes += entry.size() - before
+	md.evict()
+}
+
+// HGet - get `field` of the hash at `key`
+func (md *MemoryDriver) HGet(key, field string) (string, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	entry, err := md.structure(key, map[string]string{}, false)
+	if err != nil {
+		return "", err
+	}
+
+	if entry != nil {
+		if value, ok := entry.data.(map[string]string)[field]; ok {
+			return value, nil
+		}
+	}
+
+	return "", ErrorCacheMiss
+}
+
+// HSet - set `field` of the hash at `key`
+func (md *MemoryDriver) HSet(key, field, value string) error {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	entry, err := md.structure(key, map[string]string{}, true)
+	if err != nil {
+		return err
+	}
+
+	before := entry.size()
+	entry.data.(map[string]string)[field] = value
+	md.resized(entry, before)
+
+	return nil
+}
+
+// HDel - delete `fields` of the hash at `key`
+func (md *MemoryDriver) HDel(key string, fields ...string) (deleted int64, err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	entry, err := md.structure(key, map[string]string{}, false)
+	if entry == nil || err != nil {
+		return 0, err
+	}
+
+	before := entry.size()
+	hash := entry.data.(map[string]string)
+	for _, field := range fields {
+		if _, ok := hash[field]; ok {
+			delete(hash, field)
+			deleted++
+		}
+	}
+	md.resized(entry, before)
+
+	return deleted, nil
+}
+
+// HGetAll - get all fields of the hash at `key`
+func (md *MemoryDriver) HGetAll(key string) (map[string]string, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	entry, err := md.structure(key, map[string]string{}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	if entry != nil {
+		for field, value := range entry.data.(map[string]string) {
+			values[field] = value
+		}
+	}
+
+	return values, nil
+}
+
+// HIncrBy - add `delta` to the integer in `field` of the hash at `key`
+func (md *MemoryDriver) HIncrBy(key, field string, delta int64) (int64, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	entry, err := md.structure(key, map[string]string{}, true)
+	if err != nil {
+		return 0, err
+	}
+
+	hash := entry.data.(map[string]string)
+
+	var current int64
+	if value, ok := hash[field]; ok {
+		if current, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return 0, fmt.Errorf("field `%s` of `%s` is not an integer", field, key)
+		}
+	}
+
+	before := entry.size()
+	current += delta
+	hash[field] = strconv.FormatInt(current, 10)
+	md.resized(entry, before)
+
+	return current, nil
+}
+
+// ZAdd - add or update `members` of the sorted set at `key`
+func (md *MemoryDriver) ZAdd(key string, members ...ZMember) (added int64, err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	entry, err := md.structure(key, map[string]float64{}, true)
+	if err != nil {
+		return 0, err
+	}
+
+	before := entry.size()
+	set := entry.data.(map[string]float64)
+	for _, member := range members {
+		if _, ok := set[member.Member]; !ok {
+			added++
+		}
+		set[member.Member] = member.Score
+	}
+	md.resized(entry, before)
+
+	return added, nil
+}
+
+// sorted - the members of the sorted set at `key` by ascending score, then member.
+// The caller must hold the mutex.
+func (md *MemoryDriver) sorted(key string) ([]ZMember, error) {
+	entry, err := md.structure(key, map[string]float64{}, false)
+	if entry == nil || err != nil {
+		return nil, err
+	}
+
+	members := make([]ZMember, 0, len(entry.data.(map[string]float64)))
+	for member, score := range entry.data.(map[string]float64) {
+		members = append(members, ZMember{Member: member, Score: score})
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Score != members[j].Score {
+			return members[i].Score < members[j].Score
+		}
+		return members[i].Member < members[j].Member
+	})
+
+	return members, nil
+}
+
+// ZRange - members of the sorted set at `key` by ascending score
+func (md *MemoryDriver) ZRange(key string, start, stop int64) ([]ZMember, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	members, err := md.sorted(key)
+	if err != nil {
+		return nil, err
+	}
+
+	from, to := memoryRange(len(members), start, stop)
+
+	return append([]ZMember{}, members[from:to]...), nil
+}
+
+// ZRevRange - members of the sorted set at `key` by descending score
+func (md *MemoryDriver) ZRevRange(key string, start, stop int64) ([]ZMember, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	members, err := md.sorted(key)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+		members[i], members[j] = members[j], members[i]
+	}
+
+	from, to := memoryRange(len(members), start, stop)
+
+	return append([]ZMember{}, members[from:to]...), nil
+}
+
+// ZRank - the rank of `member` in the sorted set at `key`
+func (md *MemoryDriver) ZRank(key, member string) (int64, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	members, err := md.sorted(key)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, m := range members {
+		if m.Member == member {
+			return int64(i), nil
+		}
+	}
+
+	return 0, ErrorCacheMiss
+}
+
+// push - add `values` to the list at `key`, at the head if `head` is set
+func (md *MemoryDriver) push(key string, values []string, head bool) (int64, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	entry, err := md.structure(key, []string{}, true)
+	if err != nil {
+		return 0, err
+	}
+
+	before := entry.size()
+	items := entry.data.([]string)
+	for _, value := range values {
+		if head {
+			items = append([]string{value}, items...)
+		} else {
+			items = append(items, value)
+		}
+	}
+	entry.data = items
+	md.resized(entry, before)
+
+	return int64(len(items)), nil
+}
+
+// pop - remove an element from the list at `key`, from the head if `head` is set
+func (md *MemoryDriver) pop(key string, head bool) (string, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	entry, err := md.structure(key, []string{}, false)
+	if err != nil {
+		return "", err
+	}
+	if entry == nil {
+		return "", ErrorCacheMiss
+	}
+
+	before := entry.size()
+	items := entry.data.([]string)
+
+	var value string
+	if head {
+		value, entry.data = items[0], items[1:]
+	} else {
+		value, entry.data = items[len(items)-1], items[:len(items)-1]
+	}
+	md.resized(entry, before)
+
+	return value, nil
+}
+
+// LPush - prepend `values` to the list at `key`
+func (md *MemoryDriver) LPush(key string, values ...string) (int64, error) {
+	return md.push(key, values, true)
+}
+
+// RPush - append `values` to the list at `key`
+func (md *MemoryDriver) RPush(key string, values ...string) (int64, error) {
+	return md.push(key, values, false)
+}
+
+// LPop - remove and return the first element of the list at `key`
+func (md *MemoryDriver) LPop(key string) (string, error) {
+	return md.pop(key, true)
+}
+
+// RPop - remove and return the last element of the list at `key`
+func (md *MemoryDriver) RPop(key string) (string, error) {
+	return md.pop(key, false)
+}
+
+// LRange - elements of the list at `key` from `start` to `stop`
+func (md *MemoryDriver) LRange(key string, start, stop int64) ([]string, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	entry, err := md.structure(key, []string{}, false)
+	if entry == nil || err != nil {
+		return []string{}, err
+	}
+
+	items := entry.data.([]string)
+	from, to := memoryRange(len(items), start, stop)
+
+	return append([]string{}, items[from:to]...), nil
+}
+
+// LTrim - keep only the elements of the list at `key` from `start` to `stop`
+func (md *MemoryDriver) LTrim(key string, start, stop int64) error {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	entry, err := md.structure(key, []string{}, false)
+	if entry == nil || err != nil {
+		return err
+	}
+
+	before := entry.size()
+	items := entry.data.([]string)
+	from, to := memoryRange(len(items), start, stop)
+	entry.data = append([]string{}, items[from:to]...)
+	md.resized(entry, before)
+
+	return nil
+}
+
+// memoryRange - convert inclusive Redis style indexes into slice bounds
+func memoryRange(length int, start, stop int64) (int, int) {
+	n := int64(length)
+
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return 0, 0
+	}
+
+	return int(start), int(stop + 1)
+}
+
+/* Rate limiting */
+
+// memoryRateLimit - the state of a rate limit, `count` and `at` are used by
+// the fixed window (request count, window start) and the token bucket
+// (tokens, last refill), `log` by the sliding window.
+type memoryRateLimit struct {
+	count float64
+	at    time.Time
+	log   []time.Time
+}
+
+// Throttle - count a request against the rate limit at `key`
+func (md *MemoryDriver) Throttle(key string, limit *RateLimit) (*RateLimitResult, error) {
+	if err := limit.validate(); err != nil {
+		return nil, err
+	}
+
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	now := time.Now()
+
+	entry, err := md.structure(key, &memoryRateLimit{at: now}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	before := entry.size()
+	state := entry.data.(*memoryRateLimit)
+	result := &RateLimitResult{}
+
+	// Every algorithm sets an expire time, so only new entries have none
+	fresh := entry.expireAt.IsZero()
+
+	switch limit.Algorithm {
+	case RateLimitSlidingWindow:
+		log := state.log[:0]
+		for _, at := range state.log {
+			if now.Sub(at) < limit.Period {
+				log = append(log, at)
+			}
+		}
+
+		if int64(len(log)) < limit.Limit {
+			log = append(log, now)
+			result.Allowed = true
+			result.Remaining = limit.Limit - int64(len(log))
+		} else {
+			result.RetryAfter = log[0].Add(limit.Period).Sub(now)
+		}
+
+		state.log = log
+		entry.expireAt = now.Add(limit.Period)
+	case RateLimitTokenBucket:
+		capacity := float64(limit.burst())
+		rate := float64(limit.Limit) / float64(limit.Period)
+
+		if fresh {
+			// A new bucket starts full
+			state.count = capacity
+		}
+
+		state.count = math.Min(capacity, state.count+float64(now.Sub(state.at))*rate)
+		state.at = now
+
+		if state.count >= 1 {
+			state.count--
+			result.Allowed = true
+		} else {
+			result.RetryAfter = time.Duration(math.Ceil((1 - state.count) / rate))
+		}
+		result.Remaining = int64(state.count)
+
+		entry.expireAt = now.Add(time.Duration(math.Ceil(capacity / rate)))
+	default:
+		if fresh {
+			// The window starts with the first request
+			entry.expireAt = now.Add(limit.Period)
+		}
+
+		state.count++
+
+		if int64(state.count) <= limit.Limit {
+			result.Allowed = true
+			result.Remaining = limit.Limit - int64(state.count)
+		} else {
+			result.RetryAfter = entry.expireAt.Sub(now)
+		}
+	}
+
+	md.resized(entry, before)
+
+	return result, nil
+}
+
+/* PubSub */
+
+type memorySubscription struct {
+	driver  *MemoryDriver
+	channel string
+	handler func(message string)
+}
+
+// Close - stop receiving messages
+func (ms *memorySubscription) Close() error {
+	ms.driver.mutex.Lock()
+	defer ms.driver.mutex.Unlock()
+
+	delete(ms.driver.subscriptions[ms.channel], ms)
+
+	return nil
+}
+
+// Publish - deliver `message` to the subscribers of `channel` in this process
+func (md *MemoryDriver) Publish(channel, message string) error {
+	md.mutex.Lock()
+	handlers := []func(string){}
+	for subscription := range md.subscriptions[channel] {
+		handlers = append(handlers, subscription.handler)
+	}
+	md.mutex.Unlock()
+
+	for _, handler := range handlers {
+		handler(message)
+	}
+
+	return nil
+}
+
+// Subscribe - call `handler` for every message published on `channel`
+func (md *MemoryDriver) Subscribe(channel string, handler func(message string)) io.Closer {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	subscription := &memorySubscription{driver: md, channel: channel, handler: handler}
+
+	if md.subscriptions[channel] == nil {
+		md.subscriptions[channel] = make(map[*memorySubscription]bool)
+	}
+	md.subscriptions[channel][subscription] = true
+
+	return subscription
+}
+
+/* QueueDriver */
+
+// memoryQueue mirrors the Redis layout of a queue:
+//   - pending (list, uuid, one per priority level)
+//   - working (list, uuid)
+//   - failure (list, uuid)
+//   - delayed (uuid => timestamp)
+//   - leases (uuid => lease deadline in milliseconds)
+//   - holders (uuid => token of the lease handed out by the last dequeue)
+//   - backlog (uuid => job)
+//   - unique (unique key => uuid of the job holding it)
+//   - batches (batch id => counts, callbacks and state of its jobs)
+//   - chains (chain id => state of the chain)
+//
+// Lists are kept oldest first, i.e. index 0 is the tail of the Redis list.
+type memoryQueue struct {
+	pending map[int][]string
+	working []string
+	failure []string
+	delayed map[string]int64
+	leases  map[string]int64
+	holders map[string]string
+	backlog map[string]string
+	unique  map[string]memoryUnique
+	batches map[string]*memoryBatch
+	chains  map[string]*memoryChain
+
+	// notify is closed, then replaced, to wake up every blocking Dequeue when a job becomes pending
+	notify chan struct{}
+}
+
+func newMemoryQueue() *memoryQueue {
+	return &memoryQueue{
+		pending: make(map[int][]string),
+		delayed: make(map[string]int64),
+		leases:  make(map[string]int64),
+		holders: make(map[string]string),
+		backlog: make(map[string]string),
+		unique:  make(map[string]memoryUnique),
+		batches: make(map[string]*memoryBatch),
+		chains:  make(map[string]*memoryChain),
+		notify:  make(chan struct{}),
+	}
+}
+
+// memoryUnique - the job holding a unique key, until `expires` once it completed
+type memoryUnique struct {
+	id      string
+	expires int64
+}
+
+// claim - take the unique key of `job`, returning the ID of the job holding it
+func (mq *memoryQueue) claim(job *Job) string {
+	if job.UniqueKey == "" {
+		return job.TraceID
+	}
+
+	if holder, ok := mq.unique[job.UniqueKey]; ok && (holder.expires == 0 || holder.expires > time.Now().Unix()) {
+		return holder.id
+	}
+
+	mq.unique[job.UniqueKey] = memoryUnique{id: job.TraceID}
+
+	return job.TraceID
+}
+
+// release - give up the unique key of `job`, keeping it taken for `window` seconds
+func (mq *memoryQueue) release(job *Job, window int64) {
+	if holder, ok := mq.unique[job.UniqueKey]; !ok || holder.id != job.TraceID {
+		return
+	}
+
+	if window > 0 {
+		mq.unique[job.UniqueKey] = memoryUnique{id: job.TraceID, expires: time.Now().Unix() + window}
+	} else {
+		delete(mq.unique, job.UniqueKey)
+	}
+}
+
+// memoryBatch - a batch, the callback jobs it queues when finished and the state of its jobs
+type memoryBatch struct {
+	batch    Batch
+	complete *Job
+	failure  *Job
+	jobs     map[string]string // uuid => pending, succeeded or failed
+	expires  int64
+}
+
+// settle - count a job of its batch as succeeded or failed, queueing the
+// callback job of the batch once its last job settled
+func (mq *memoryQueue) settle(job *Job, failed bool) {
+	mb, ok := mq.batches[job.BatchID]
+	if !ok || mb.jobs[job.TraceID] != "pending" {
+		return
+	}
+
+	if failed {
+		mb.jobs[job.TraceID] = "failed"
+		mb.batch.Failed++
+	} else {
+		mb.jobs[job.TraceID] = "succeeded"
+		mb.batch.Succeeded++
+	}
+
+	if mb.batch.Pending--; mb.batch.Pending > 0 {
+		return
+	}
+
+	callback := mb.complete
+	if mb.batch.Failed > 0 {
+		callback = mb.failure
+	}
+	if callback != nil {
+		mq.backlog[callback.TraceID] = callback.Serialize()
+		mq.push(callback.TraceID)
+	}
+
+	mb.batch.FinishedAt = time.Now().Unix()
+	mb.expires = time.Now().Add(batchRetention).Unix()
+}
+
+// reopen - count a failed job of a batch as pending again
+func (mq *memoryQueue) reopen(job *Job) {
+	mb, ok := mq.batches[job.BatchID]
+	if !ok || mb.jobs[job.TraceID] != "failed" {
+		return
+	}
+
+	mb.jobs[job.TraceID] = "pending"
+	mb.batch.Failed--
+	mb.batch.Pending++
+	mb.batch.FinishedAt, mb.expires = 0, 0
+}
+
+// memoryChain - a chain of jobs, until `expires` once it completed
+type memoryChain struct {
+	chain   Chain
+	expires int64
+}
+
+// advance - queue the next step of the chain of a completed job, or complete the chain
+func (mq *memoryQueue) advance(job *Job) {
+	mc, ok := mq.chains[job.ChainID]
+	if !ok || mc.chain.JobID != job.TraceID {
+		return
+	}
+
+	if next := job.successor(); next != nil {
+		mc.chain.Step, mc.chain.JobID = next.Step, next.TraceID
+		mq.backlog[next.TraceID] = next.Serialize()
+		mq.push(next.TraceID)
+		return
+	}
+
+	mc.chain.Status, mc.chain.FinishedAt = ChainCompleted, time.Now().Unix()
+	mc.expires = time.Now().Add(chainRetention).Unix()
+}
+
+// halt - record the failed step of the chain of a job
+func (mq *memoryQueue) halt(job *Job) {
+	mc, ok := mq.chains[job.ChainID]
+	if !ok || mc.chain.JobID != job.TraceID {
+		return
+	}
+
+	mc.chain.Status, mc.chain.LastError, mc.chain.FinishedAt = ChainFailed, job.LastError, time.Now().Unix()
+}
+
+// resume - run the chain of a requeued failed step again
+func (mq *memoryQueue) resume(job *Job) {
+	mc, ok := mq.chains[job.ChainID]
+	if !ok || mc.chain.JobID != job.TraceID || mc.chain.Status != ChainFailed {
+		return
+	}
+
+	mc.chain.Status, mc.chain.LastError, mc.chain.FinishedAt = ChainRunning, "", 0
+}
+
+// holds - whether `job` was dequeued under the current lease of its ID,
+// jobs handled without a lease always are
+func (mq *memoryQueue) holds(job *Job) bool {
+	return job.lease == "" || mq.holders[job.TraceID] == job.lease
+}
+
+// unlease - drop the lease of a job
+func (mq *memoryQueue) unlease(id string) {
+	delete(mq.leases, id)
+	delete(mq.holders, id)
+}
+
+// push - make a job pending, behind the jobs of the same priority
+func (mq *memoryQueue) push(id string) {
+	var job struct{ Priority int }
+	json.Unmarshal([]byte(mq.backlog[id]), &job)
+
+	level := priorityLevel(job.Priority)
+	mq.pending[level] = append(mq.pending[level], id)
+
+	close(mq.notify)
+	mq.notify = make(chan struct{})
+}
+
+// pop - take the next pending job, highest priority first
+func (mq *memoryQueue) pop() (id string, ok bool) {
+	for _, level := range Priorities {
+		if pending := mq.pending[level]; len(pending) > 0 {
+			mq.pending[level] = pending[1:]
+			return pending[0], true
+		}
+	}
+	return "", false
+}
+
+// queue - get the state of `queue`, the caller must hold the mutex
+func (md *MemoryDriver) queue(queue string) *memoryQueue {
+	mq, ok := md.queues[queue]
+
+	if !ok {
+		mq = newMemoryQueue()
+		md.queues[queue] = mq
+	}
+
+	return mq
+}
+
+// Enqueue pushes a new job into the queue
+func (md *MemoryDriver) Enqueue(queue string, job *Job) (err error) {
+	if job.TraceID == "" {
+		job.TraceID = GenerateTraceID()
+	}
+
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mq := md.queue(queue)
+	if id := mq.claim(job); id != job.TraceID {
+		return duplicate(job, id, nil)
+	}
+
+	mq.backlog[job.TraceID] = job.Serialize()
+	mq.push(job.TraceID)
+
+	return
+}
+
+// Schedule pushes a new job into the delayed queue so that it will be processed at a later time.
+func (md *MemoryDriver) Schedule(queue string, job *Job, at time.Time) (err error) {
+	if job.TraceID == "" {
+		job.TraceID = GenerateTraceID()
+	}
+
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mq := md.queue(queue)
+	if id := mq.claim(job); id != job.TraceID {
+		return duplicate(job, id, nil)
+	}
+
+	mq.backlog[job.TraceID] = job.Serialize()
+	mq.delayed[job.TraceID] = at.Unix()
+
+	return
+}
+
+// Dequeue retrieves a job from the queue
+func (md *MemoryDriver) Dequeue(queue string) (job *Job, err error) {
+	var deadline <-chan time.Time
+
+	if settings := md.config(); settings.Blocking {
+		deadline = time.After(time.Duration(settings.ReadTimeout) * time.Second)
+	}
+
+	for {
+		md.mutex.Lock()
+		mq := md.queue(queue)
+
+		if jobID, ok := mq.pop(); ok {
+			defer md.mutex.Unlock()
+
+			// Only the ID was left, the job is dropped
+			serialized, ok := mq.backlog[jobID]
+			if !ok {
+				return nil, ErrorJobNotFound
+			}
+
+			mq.working = append(mq.working, jobID)
+
+			var lease string
+			if timeout := visibilityTimeout(md.config().VisibilityTimeout); timeout > 0 {
+				lease = GenerateTraceID()
+				mq.leases[jobID] = leaseDeadline(timeout)
+				mq.holders[jobID] = lease
+			}
+
+			job = &Job{lease: lease}
+			err = job.Unserialize(serialized)
+
+			return
+		}
+
+		wake := mq.notify
+		md.mutex.Unlock()
+
+		if deadline == nil {
+			return nil, ErrorQueueEmpty
+		}
+
+		select {
+		case <-wake:
+		case <-deadline:
+			return nil, ErrorQueueEmpty
+		}
+	}
+}
+
+// Attempt requeues the job
+func (md *MemoryDriver) Attempt(queue string, job *Job) (err error) {
+	job.Attempt()
+
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mq := md.queue(queue)
+	if !mq.holds(job) {
+		return ErrorJobLeaseLost
+	}
+
+	mq.backlog[job.TraceID] = job.Serialize()
+
+	return
+}
+
+// Requeue requeues the job
+func (md *MemoryDriver) Requeue(queue string, job *Job) (err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mq := md.queue(queue)
+	if !mq.holds(job) {
+		return ErrorJobLeaseLost
+	}
+
+	mq.working = removeString(mq.working, job.TraceID)
+	mq.unlease(job.TraceID)
+	mq.push(job.TraceID)
+
+	return
+}
+
+// Complete removes the job from the queue entirely.
+func (md *MemoryDriver) Complete(queue string, job *Job) (err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mq := md.queue(queue)
+	if !mq.holds(job) {
+		return ErrorJobLeaseLost
+	}
+
+	mq.working = removeString(mq.working, job.TraceID)
+	mq.unlease(job.TraceID)
+	delete(mq.backlog, job.TraceID)
+	mq.release(job, job.UniqueFor)
+	mq.settle(job, false)
+	mq.advance(job)
+
+	return
+}
+
+// Defer moves the job to a deferred queue for processing at a later time.
+func (md *MemoryDriver) Defer(queue string, job *Job, after time.Duration) (err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mq := md.queue(queue)
+	if !mq.holds(job) {
+		return ErrorJobLeaseLost
+	}
+
+	mq.working = removeString(mq.working, job.TraceID)
+	mq.unlease(job.TraceID)
+	mq.delayed[job.TraceID] = time.Now().Add(after).Unix()
+
+	return
+}
+
+// Fail moves the job into a failure list for trouble shooting.
+func (md *MemoryDriver) Fail(queue string, job *Job) (err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	job.FailedAt = time.Now().Unix()
+
+	mq := md.queue(queue)
+	if !mq.holds(job) {
+		return ErrorJobLeaseLost
+	}
+
+	mq.working = removeString(mq.working, job.TraceID)
+	mq.unlease(job.TraceID)
+	mq.release(job, 0)
+	mq.failure = append(mq.failure, job.TraceID)
+	mq.backlog[job.TraceID] = job.Serialize()
+	mq.settle(job, true)
+	mq.halt(job)
+
+	return
+}
+
+// RequeueAllFailed - requeue all failed jobs (move jobs from `failure` into `pending`)
+func (md *MemoryDriver) RequeueAllFailed(queue string) (jobIDs []string, err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mq := md.queue(queue)
+
+	// Walk from the head of the list, the same order as LRANGE 0 -1
+	for i := len(mq.failure) - 1; i >= 0; i-- {
+		id := mq.failure[i]
+
+		serialized, ok := mq.backlog[id]
+		if !ok {
+			mq.failure = removeString(mq.failure, id)
+			continue
+		}
+
+		job := &Job{}
+		if err = job.Unserialize(serialized); err != nil {
+			return jobIDs, err
+		}
+
+		// Another job took the unique key, leave this one failed
+		if holder := mq.claim(job); holder != id {
+			continue
+		}
+
+		// Reset attempt count
+		job.Attempts = 0
+		mq.backlog[id] = job.Serialize()
+		mq.failure = removeString(mq.failure, id)
+		mq.reopen(job)
+		mq.resume(job)
+		mq.push(id)
+
+		jobIDs = append(jobIDs, id)
+	}
+
+	return jobIDs, nil
+}
+
+// Failed - list failed jobs, most recent failure first
+func (md *MemoryDriver) Failed(queue string, offset, limit int64) (jobs []*Job, err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mq := md.queue(queue)
+
+	// Walk from the head of the list, the same order as LRANGE
+	for i := int64(len(mq.failure)) - 1 - offset; i >= 0 && int64(len(jobs)) < limit; i-- {
+		serialized, ok := mq.backlog[mq.failure[i]]
+		if !ok {
+			continue
+		}
+
+		job := &Job{}
+		if err = job.Unserialize(serialized); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return
+}
+
+// Find - get a job of the queue by its ID
+func (md *MemoryDriver) Find(queue string, id string) (job *Job, err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	serialized, ok := md.queue(queue).backlog[id]
+	if !ok {
+		return nil, ErrorJobNotFound
+	}
+
+	job = &Job{}
+	err = job.Unserialize(serialized)
+
+	return
+}
+
+// RequeueFailed - move a failed job back to `pending`, resetting its attempt count
+func (md *MemoryDriver) RequeueFailed(queue string, id string) (err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mq := md.queue(queue)
+
+	serialized, ok := mq.backlog[id]
+	if !ok || !containsString(mq.failure, id) {
+		return ErrorJobNotFound
+	}
+
+	job := &Job{}
+	if err = job.Unserialize(serialized); err != nil {
+		return
+	}
+
+	if holder := mq.claim(job); holder != id {
+		return ErrorJobDuplicate
+	}
+
+	// Reset attempt count
+	job.Attempts = 0
+	mq.backlog[id] = job.Serialize()
+	mq.failure = removeString(mq.failure, id)
+	mq.reopen(job)
+	mq.resume(job)
+	mq.push(id)
+
+	return
+}
+
+// DeleteFailed - remove a failed job from the queue entirely
+func (md *MemoryDriver) DeleteFailed(queue string, id string) (err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mq := md.queue(queue)
+
+	if !containsString(mq.failure, id) {
+		return ErrorJobNotFound
+	}
+
+	mq.failure = removeString(mq.failure, id)
+	delete(mq.backlog, id)
+
+	return
+}
+
+// PurgeFailed - remove the jobs that failed before `before`. Jobs failed
+// before their failure time was recorded are always removed.
+func (md *MemoryDriver) PurgeFailed(queue string, before time.Time) (count int64, err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mq := md.queue(queue)
+	kept := []string{}
+
+	for _, id := range mq.failure {
+		job := &Job{}
+		if serialized, ok := mq.backlog[id]; ok {
+			if er := job.Unserialize(serialized); er != nil {
+				kept, err = append(kept, id), er
+				continue
+			}
+		}
+
+		if job.FailedAt >= before.Unix() {
+			kept = append(kept, id)
+			continue
+		}
+
+		delete(mq.backlog, id)
+		count++
+	}
+
+	mq.failure = kept
+
+	return
+}
+
+// Truncate discards everything (!!DANGER!!) currently stored in the queue
+func (md *MemoryDriver) Truncate(queue string) (err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	// Keep the notify channel, a blocking Dequeue may be waiting on it
+	notify := md.queue(queue).notify
+	md.queues[queue] = newMemoryQueue()
+	md.queues[queue].notify = notify
+
+	return
+}
+
+// Stats - get the stats of the queue
+func (md *MemoryDriver) Stats(queue string) (stats *QueueStats, err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mq := md.queue(queue)
+	now := time.Now().Unix()
+
+	stats = &QueueStats{
+		Working:    int64(len(mq.working)),
+		Failure:    int64(len(mq.failure)),
+		Delayed:    int64(len(mq.delayed)),
+		Backlog:    int64(len(mq.backlog)),
+		Priorities: make(map[int]int64),
+	}
+
+	for _, level := range Priorities {
+		stats.Priorities[level] = int64(len(mq.pending[level]))
+		stats.Pending += stats.Priorities[level]
+	}
+
+	for _, at := range mq.delayed {
+		if at <= now {
+			stats.Waiting++
+		}
+	}
+
+	return stats, nil
+}
+
+// VisibilityTimeout - the lease of dequeued jobs, zero when leases are disabled
+func (md *MemoryDriver) VisibilityTimeout() time.Duration {
+	return visibilityTimeout(md.config().VisibilityTimeout)
+}
+
+// Heartbeat extends the lease of a job being processed to `lease` from now,
+// or to the visibility timeout when `lease` is zero.
+func (md *MemoryDriver) Heartbeat(queue string, job *Job, lease time.Duration) (err error) {
+	if lease <= 0 {
+		lease = visibilityTimeout(md.config().VisibilityTimeout)
+	}
+
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mq := md.queue(queue)
+	if _, ok := mq.leases[job.TraceID]; !ok {
+		return ErrorJobNotFound
+	}
+	if !mq.holds(job) {
+		return ErrorJobLeaseLost
+	}
+
+	mq.leases[job.TraceID] = leaseDeadline(lease)
+
+	return
+}
+
+// Reap moves the working jobs whose lease expired back to the pending queue,
+// counting the lost attempt.
+func (md *MemoryDriver) Reap(queue string) (count int64, err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mq := md.queue(queue)
+	now := leaseDeadline(0)
+
+	for _, id := range append([]string{}, mq.working...) {
+		if deadline, ok := mq.leases[id]; !ok || deadline > now {
+			continue
+		}
+
+		mq.unlease(id)
+		mq.working = removeString(mq.working, id)
+
+		if serialized, ok := mq.backlog[id]; ok {
+			job := &Job{}
+			if err = job.Unserialize(serialized); err != nil {
+				return
+			}
+			job.Attempt()
+			mq.backlog[id] = job.Serialize()
+		}
+
+		mq.push(id)
+		count++
+	}
+
+	return
+}
+
+// EnqueueBatch pushes the jobs of a batch into the queue, along with the batch itself
+func (md *MemoryDriver) EnqueueBatch(queue string, batch *Batch, jobs []*Job) (err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mq := md.queue(queue)
+	mb := &memoryBatch{batch: *batch, jobs: make(map[string]string, len(jobs))}
+	mb.complete, mb.failure = batch.callbacks()
+	mq.batches[batch.ID] = mb
+
+	for _, job := range jobs {
+		mb.jobs[job.TraceID] = "pending"
+		mq.backlog[job.TraceID] = job.Serialize()
+		mq.push(job.TraceID)
+	}
+
+	return
+}
+
+// FindBatch gets a batch with its counts
+func (md *MemoryDriver) FindBatch(queue string, id string) (*Batch, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mb, ok := md.queue(queue).batches[id]
+	if !ok {
+		return nil, ErrorBatchNotFound
+	}
+
+	batch := mb.batch
+
+	return &batch, nil
+}
+
+// EnqueueChain pushes the first step of a chain into the queue, along with the chain itself
+func (md *MemoryDriver) EnqueueChain(queue string, chain *Chain, job *Job) (err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mq := md.queue(queue)
+	mq.chains[chain.ID] = &memoryChain{chain: *chain}
+	mq.backlog[job.TraceID] = job.Serialize()
+	mq.push(job.TraceID)
+
+	return
+}
+
+// FindChain gets a chain with the state of its steps
+func (md *MemoryDriver) FindChain(queue string, id string) (*Chain, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mc, ok := md.queue(queue).chains[id]
+	if !ok {
+		return nil, ErrorChainNotFound
+	}
+
+	chain := mc.chain
+
+	return &chain, nil
+}
+
+// ScheduleDeferred moves deferred jobs that are ready for processing to the pending queue
+func (md *MemoryDriver) ScheduleDeferred(queue string) (count int64, err error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	mq := md.queue(queue)
+	now := time.Now().Unix()
+
+	ready := []string{}
+	for id, at := range mq.delayed {
+		if at <= now {
+			ready = append(ready, id)
+		}
+	}
+
+	// Earliest first, like ZRANGEBYSCORE
+	sort.Slice(ready, func(i, j int) bool {
+		if mq.delayed[ready[i]] != mq.delayed[ready[j]] {
+			return mq.delayed[ready[i]] < mq.delayed[ready[j]]
+		}
+		return ready[i] < ready[j]
+	})
+
+	for _, id := range ready {
+		delete(mq.delayed, id)
+		mq.push(id)
+		count++
+	}
+
+	return
+}
+
+// containsString - check whether `list` holds `value`
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// removeString - remove all occurrences of `value` from `list`, like LREM with a count of 0
+func removeString(list []string, value string) []string {
+	filtered := list[:0]
+
+	for _, v := range list {
+		if v != value {
+			filtered = append(filtered, v)
+		}
+	}
+
+	return filtered
+}
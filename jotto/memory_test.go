@@ -0,0 +1,364 @@
+package motto_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.garena.com/duanzy/motto/motto"
+)
+
+func TestMemoryQueueEnqueueDequeueComplete(t *testing.T) {
+	testQueueEnqueueDequeueComplete(t, motto.NewQueue("main", motto.NewMemoryDriver("default", nil)))
+}
+
+func TestMemoryQueueDeferAndSchedule(t *testing.T) {
+	Q := motto.NewQueue("main", motto.NewMemoryDriver("default", nil))
+
+	assert.Nil(t, Q.Schedule(&motto.Job{Payload: "later"}, time.Now().Add(time.Hour)))
+	assert.Nil(t, Q.Enqueue(&motto.Job{Payload: "now"}))
+
+	job, _ := Q.Dequeue()
+	assert.Nil(t, Q.Attempt(job))
+	assert.Nil(t, Q.Defer(job, -time.Second))
+
+	stats, _ := Q.Stats()
+	assert.Equal(t, int64(2), stats.Delayed)
+	assert.Equal(t, int64(1), stats.Waiting)
+
+	count, err := Q.Driver().ScheduleDeferred(Q.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+
+	job, _ = Q.Dequeue()
+	assert.Equal(t, "now", job.Payload)
+	assert.Equal(t, int64(1), job.Attempts)
+}
+
+func TestMemoryQueueFailAndRequeueAllFailed(t *testing.T) {
+	Q := motto.NewQueue("main", motto.NewMemoryDriver("default", nil))
+
+	assert.Nil(t, Q.Enqueue(&motto.Job{Payload: "broken"}))
+
+	job, _ := Q.Dequeue()
+	assert.Nil(t, Q.Attempt(job))
+	assert.Nil(t, Q.Fail(job))
+
+	stats, _ := Q.Stats()
+	assert.Equal(t, int64(1), stats.Failure)
+
+	ids, err := Q.RequeueAllFailed()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{job.TraceID}, ids)
+
+	job, _ = Q.Dequeue()
+	assert.Equal(t, int64(0), job.Attempts)
+
+	assert.Nil(t, Q.Driver().Truncate(Q.Name()))
+	stats, _ = Q.Stats()
+	assert.Equal(t, int64(0), stats.Backlog)
+}
+
+func TestMemoryQueueBlockingDequeue(t *testing.T) {
+	Q := motto.NewQueue("main", motto.NewMemoryDriver("default", &motto.MemorySettings{
+		Blocking:    true,
+		ReadTimeout: 1,
+	}))
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		Q.Enqueue(&motto.Job{Payload: "wake"})
+	}()
+
+	job, err := Q.Dequeue()
+	assert.Nil(t, err)
+	assert.Equal(t, "wake", job.Payload)
+}
+
+func TestMemoryQueueBlockingDequeueWakesEveryConsumer(t *testing.T) {
+	Q := motto.NewQueue("main", motto.NewMemoryDriver("default", &motto.MemorySettings{
+		Blocking:    true,
+		ReadTimeout: 2,
+	}))
+
+	start := time.Now()
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := Q.Dequeue()
+			assert.Nil(t, err)
+		}()
+	}
+
+	// Pushed at once, under a single lock
+	time.Sleep(time.Millisecond * 50)
+	assert.Nil(t, Q.EnqueueBatch(&motto.Batch{}, &motto.Job{}, &motto.Job{}, &motto.Job{}))
+	wg.Wait()
+
+	// Every consumer got a job of the burst right away
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestMemoryQueueBlockingDequeueAcrossTruncate(t *testing.T) {
+	Q := motto.NewQueue("main", motto.NewMemoryDriver("default", &motto.MemorySettings{
+		Blocking:    true,
+		ReadTimeout: 1,
+	}))
+
+	// The waiting Dequeue is woken by jobs queued after the truncation
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		Q.Driver().Truncate(Q.Name())
+		time.Sleep(time.Millisecond * 50)
+		Q.Enqueue(&motto.Job{Payload: "wake"})
+	}()
+
+	job, err := Q.Dequeue()
+	assert.Nil(t, err)
+	assert.Equal(t, "wake", job.Payload)
+}
+
+func TestMemoryQueueSelectedBySettings(t *testing.T) {
+	cfg := motto.NewDefaultSettings()
+	cfg.Motto().Queue = []*motto.QueueSettings{
+		{Name: "default", Driver: "memory", Queues: []string{"main"}},
+	}
+	app := motto.NewApplication(cfg, nil, nil, nil)
+	app.Boot()
+
+	Q := app.Queue("default:main")
+	assert.NotNil(t, Q)
+	assert.IsType(t, &motto.MemoryDriver{}, Q.Driver())
+}
+
+func TestMemoryCacheGetSetAndExpiry(t *testing.T) {
+	cache := motto.NewMemoryDriver("default", &motto.MemorySettings{JanitorInterval: -1})
+
+	_, err := cache.Get("missing")
+	assert.True(t, motto.IsCacheMiss(err))
+
+	assert.Nil(t, cache.Set("forever", "1", 0))
+	assert.Nil(t, cache.Set("short", "2", time.Millisecond*20))
+
+	value, err := cache.Get("short")
+	assert.Nil(t, err)
+	assert.Equal(t, "2", value)
+
+	time.Sleep(time.Millisecond * 30)
+
+	has, _ := cache.Has("short")
+	assert.False(t, has)
+	has, _ = cache.Has("forever")
+	assert.True(t, has)
+
+	ok, _ := cache.Expire("forever", time.Millisecond*20)
+	assert.True(t, ok)
+	ok, _ = cache.Expire("short", time.Second)
+	assert.False(t, ok)
+
+	time.Sleep(time.Millisecond * 30)
+	_, err = cache.Get("forever")
+	assert.Equal(t, motto.ErrorCacheMiss, err)
+}
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := motto.NewMemoryDriver("default", &motto.MemorySettings{MaxEntries: 2, JanitorInterval: -1})
+
+	cache.Set("a", "1", 0)
+	cache.Set("b", "2", 0)
+	cache.Get("a") // `b` becomes the least recently used
+	cache.Set("c", "3", 0)
+
+	has, _ := cache.Has("b")
+	assert.False(t, has)
+	has, _ = cache.Has("a")
+	assert.True(t, has)
+
+	cache = motto.NewMemoryDriver("default", &motto.MemorySettings{MaxBytes: 10, JanitorInterval: -1})
+
+	cache.Set("a", "1234", 0)
+	cache.Set("b", "1234", 0)
+	has, _ = cache.Has("a")
+	assert.True(t, has)
+
+	cache.Set("c", "1234", 0)
+	has, _ = cache.Has("b")
+	assert.False(t, has)
+	has, _ = cache.Has("a")
+	assert.True(t, has)
+}
+
+func TestMemoryCacheCounters(t *testing.T) {
+	cache := motto.NewMemoryDriver("default", &motto.MemorySettings{JanitorInterval: -1})
+
+	value, err := cache.Incr("counter")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), value)
+
+	cache.Expire("counter", time.Millisecond*20)
+	cache.Incr("counter")
+	value, _ = cache.Decr("counter")
+	assert.Equal(t, int64(1), value)
+
+	time.Sleep(time.Millisecond * 30)
+	has, _ := cache.Has("counter")
+	assert.False(t, has)
+
+	cache.Set("text", "abc", 0)
+	_, err = cache.Incr("text")
+	assert.NotNil(t, err)
+}
+
+func TestMemoryCacheSetNXGuardAndGetVia(t *testing.T) {
+	cache := motto.NewMemoryDriver("default", &motto.MemorySettings{JanitorInterval: -1})
+
+	ok, _ := cache.SetNX("lock", "1", time.Second)
+	assert.True(t, ok)
+	ok, _ = cache.SetNX("lock", "2", time.Second)
+	assert.False(t, ok)
+
+	assert.NotNil(t, cache.Guard("lock", time.Second, func() error { return nil }))
+	cache.Del("lock")
+
+	executed := false
+	assert.Nil(t, cache.Guard("lock", time.Second, func() error {
+		executed = true
+		return nil
+	}))
+	assert.True(t, executed)
+
+	calls := 0
+	handler := func() (string, time.Duration, error) {
+		calls++
+		return "computed", time.Minute, nil
+	}
+
+	value, _ := cache.GetVia("via", handler)
+	assert.Equal(t, "computed", value)
+	value, _ = cache.GetVia("via", handler)
+	assert.Equal(t, "computed", value)
+	assert.Equal(t, 1, calls)
+}
+
+func TestMemoryCacheBatchOperations(t *testing.T) {
+	cache := motto.NewMemoryDriver("default", &motto.MemorySettings{JanitorInterval: -1})
+
+	assert.Nil(t, cache.MSet(
+		&motto.CacheItem{Key: "a", Value: "1"},
+		&motto.CacheItem{Key: "b", Value: "2", Expiration: time.Millisecond * 20},
+	))
+
+	values, err := cache.MGet("a", "b", "c")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, values)
+
+	time.Sleep(time.Millisecond * 30)
+	values, _ = cache.MGet("a", "b")
+	assert.Equal(t, map[string]string{"a": "1"}, values)
+
+	batch := cache.Batch()
+	set := batch.Set("c", "3", 0)
+	get := batch.Get("c")
+	miss := batch.Get("missing")
+	incr := batch.Incr("counter")
+	assert.Nil(t, batch.Exec())
+
+	assert.Nil(t, set.Err())
+	value, _ := get.Result()
+	assert.Equal(t, "3", value)
+	assert.True(t, motto.IsCacheMiss(miss.Err()))
+	count, _ := incr.Int()
+	assert.Equal(t, int64(1), count)
+
+	deleted, err := cache.MDel("a", "c", "missing")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), deleted)
+}
+
+func TestMemoryDriverDataStructures(t *testing.T) {
+	cache := motto.NewMemoryDriver("mem", nil)
+	defer cache.Close()
+
+	// Hashes
+	assert.Nil(t, cache.HSet("user:1", "name", "jotto"))
+	count, err := cache.HIncrBy("user:1", "visits", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), count)
+	name, _ := cache.HGet("user:1", "name")
+	assert.Equal(t, "jotto", name)
+	_, err = cache.HGet("user:1", "missing")
+	assert.True(t, motto.IsCacheMiss(err))
+	all, _ := cache.HGetAll("user:1")
+	assert.Equal(t, map[string]string{"name": "jotto", "visits": "2"}, all)
+
+	_, err = cache.Get("user:1")
+	assert.Equal(t, motto.ErrorCacheWrongType, err)
+	_, err = cache.LPush("user:1", "x")
+	assert.Equal(t, motto.ErrorCacheWrongType, err)
+
+	deleted, _ := cache.HDel("user:1", "name", "visits")
+	assert.Equal(t, int64(2), deleted)
+	has, _ := cache.Has("user:1")
+	assert.False(t, has)
+
+	// Sorted sets
+	added, _ := cache.ZAdd("board", motto.ZMember{Member: "a", Score: 3}, motto.ZMember{Member: "b", Score: 1}, motto.ZMember{Member: "c", Score: 2})
+	assert.Equal(t, int64(3), added)
+	added, _ = cache.ZAdd("board", motto.ZMember{Member: "b", Score: 5})
+	assert.Equal(t, int64(0), added)
+
+	top, _ := cache.ZRevRange("board", 0, 1)
+	assert.Equal(t, []motto.ZMember{{Member: "b", Score: 5}, {Member: "a", Score: 3}}, top)
+	members, _ := cache.ZRange("board", -1, -1)
+	assert.Equal(t, []motto.ZMember{{Member: "b", Score: 5}}, members)
+	rank, _ := cache.ZRank("board", "a")
+	assert.Equal(t, int64(1), rank)
+	_, err = cache.ZRank("board", "z")
+	assert.True(t, motto.IsCacheMiss(err))
+
+	// Lists
+	cache.RPush("recent", "2", "3")
+	length, _ := cache.LPush("recent", "1")
+	assert.Equal(t, int64(3), length)
+	items, _ := cache.LRange("recent", 0, -1)
+	assert.Equal(t, []string{"1", "2", "3"}, items)
+
+	assert.Nil(t, cache.LTrim("recent", 0, 1))
+	items, _ = cache.LRange("recent", 0, -1)
+	assert.Equal(t, []string{"1", "2"}, items)
+
+	last, _ := cache.RPop("recent")
+	assert.Equal(t, "2", last)
+	first, _ := cache.LPop("recent")
+	assert.Equal(t, "1", first)
+	_, err = cache.LPop("recent")
+	assert.True(t, motto.IsCacheMiss(err))
+}
+
+func TestMemoryQueueDeadLetters(t *testing.T) {
+	testQueueDeadLetters(t, motto.NewQueue("main", motto.NewMemoryDriver("default", nil)))
+}
+
+func TestMemoryQueueLeases(t *testing.T) {
+	testQueueLeases(t, motto.NewQueue("main", motto.NewMemoryDriver("default", &motto.MemorySettings{VisibilityTimeout: 1})))
+}
+
+func TestMemoryQueuePriorities(t *testing.T) {
+	testQueuePriorities(t, motto.NewQueue("main", motto.NewMemoryDriver("default", nil)))
+}
+
+func TestMemoryQueueUniqueJobs(t *testing.T) {
+	testQueueUniqueJobs(t, motto.NewQueue("main", motto.NewMemoryDriver("default", nil)))
+}
+
+func TestMemoryQueueBatches(t *testing.T) {
+	testQueueBatches(t, motto.NewQueue("main", motto.NewMemoryDriver("default", nil)))
+}
+
+func TestMemoryQueueChains(t *testing.T) {
+	testQueueChains(t, motto.NewQueue("main", motto.NewMemoryDriver("default", nil)))
+}
@@ -0,0 +1,688 @@
+package jotto
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds (in seconds) of the latency histogram buckets
+var metricsLatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// MetricsRegistry collects the metrics of every instrumented cache of an
+// application. It implements `http.Handler`, serving the metrics in the
+// Prometheus text format.
+type MetricsRegistry struct {
+	mutex  sync.RWMutex
+	caches map[string]*CacheMetrics
+}
+
+// NewMetricsRegistry - create an empty registry
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{
+		caches: make(map[string]*CacheMetrics),
+	}
+}
+
+// Cache - the metrics of the cache `name`, created on first use.
+// Metrics survive reloads since they are keyed by name.
+func (r *MetricsRegistry) Cache(name string) *CacheMetrics {
+	r.mutex.RLock()
+	metrics, ok := r.caches[name]
+	r.mutex.RUnlock()
+
+	if ok {
+		return metrics
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if metrics, ok = r.caches[name]; !ok {
+		metrics = &CacheMetrics{name: name, operations: make(map[string]*operationMetrics)}
+		r.caches[name] = metrics
+	}
+
+	return metrics
+}
+
+// Stats - a snapshot of the metrics of every cache, sorted by name
+func (r *MetricsRegistry) Stats() []*CacheStats {
+	r.mutex.RLock()
+	names := make([]string, 0, len(r.caches))
+	for name := range r.caches {
+		names = append(names, name)
+	}
+	r.mutex.RUnlock()
+
+	sort.Strings(names)
+
+	stats := make([]*CacheStats, len(names))
+	for i, name := range names {
+		stats[i] = r.Cache(name).Stats()
+	}
+
+	return stats
+}
+
+// ServeHTTP - serve the metrics in the Prometheus text format
+func (r *MetricsRegistry) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(writer)
+}
+
+// WriteTo - write the metrics in the Prometheus text format to `w`
+func (r *MetricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	out := &metricsWriter{w: w}
+	stats := r.Stats()
+
+	out.printf("# TYPE motto_cache_hits_total counter\n")
+	for _, s := range stats {
+		out.printf("motto_cache_hits_total{cache=%q} %d\n", s.Name, s.Hits)
+	}
+
+	out.printf("# TYPE motto_cache_misses_total counter\n")
+	for _, s := range stats {
+		out.printf("motto_cache_misses_total{cache=%q} %d\n", s.Name, s.Misses)
+	}
+
+	out.printf("# TYPE motto_cache_operations_total counter\n")
+	for _, s := range stats {
+		for _, op := range s.operationNames() {
+			out.printf("motto_cache_operations_total{cache=%q,operation=%q} %d\n", s.Name, op, s.Operations[op].Calls)
+		}
+	}
+
+	out.printf("# TYPE motto_cache_errors_total counter\n")
+	for _, s := range stats {
+		for _, op := range s.operationNames() {
+			out.printf("motto_cache_errors_total{cache=%q,operation=%q} %d\n", s.Name, op, s.Operations[op].Errors)
+		}
+	}
+
+	out.printf("# TYPE motto_cache_keys_total counter\n")
+	for _, s := range stats {
+		for _, op := range s.operationNames() {
+			out.printf("motto_cache_keys_total{cache=%q,operation=%q} %d\n", s.Name, op, s.Operations[op].Keys)
+		}
+	}
+
+	out.printf("# TYPE motto_cache_latency_seconds histogram\n")
+	for _, s := range stats {
+		for _, op := range s.operationNames() {
+			latency := s.Operations[op].Latency
+			for i, bound := range latency.Buckets {
+				out.printf("motto_cache_latency_seconds_bucket{cache=%q,operation=%q,le=\"%g\"} %d\n", s.Name, op, bound, latency.Counts[i])
+			}
+			out.printf("motto_cache_latency_seconds_bucket{cache=%q,operation=%q,le=\"+Inf\"} %d\n", s.Name, op, latency.Count)
+			out.printf("motto_cache_latency_seconds_sum{cache=%q,operation=%q} %g\n", s.Name, op, latency.Sum)
+			out.printf("motto_cache_latency_seconds_count{cache=%q,operation=%q} %d\n", s.Name, op, latency.Count)
+		}
+	}
+
+	return out.n, out.err
+}
+
+type metricsWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (mw *metricsWriter) printf(format string, args ...interface{}) {
+	if mw.err != nil {
+		return
+	}
+
+	n, err := fmt.Fprintf(mw.w, format, args...)
+	mw.n += int64(n)
+	mw.err = err
+}
+
+// CacheMetrics - the metrics of a single cache
+type CacheMetrics struct {
+	name   string
+	hits   int64
+	misses int64
+
+	mutex      sync.RWMutex
+	operations map[string]*operationMetrics
+}
+
+type operationMetrics struct {
+	calls  int64
+	errors int64
+	keys   int64
+
+	mutex   sync.Mutex
+	latency []int64 // per bucket, not cumulative; the last one is +Inf
+	sum     float64
+}
+
+// Hit - record `n` cache hits
+func (cm *CacheMetrics) Hit(n int) {
+	atomic.AddInt64(&cm.hits, int64(n))
+}
+
+// Miss - record `n` cache misses
+func (cm *CacheMetrics) Miss(n int) {
+	atomic.AddInt64(&cm.misses, int64(n))
+}
+
+// Observe - record a call of `operation` touching `keys` keys
+func (cm *CacheMetrics) Observe(operation string, keys int, elapsed time.Duration, err error) {
+	op := cm.operation(operation)
+
+	atomic.AddInt64(&op.calls, 1)
+	atomic.AddInt64(&op.keys, int64(keys))
+	if err != nil && !IsCacheMiss(err) {
+		atomic.AddInt64(&op.errors, 1)
+	}
+
+	seconds := elapsed.Seconds()
+	bucket := sort.SearchFloat64s(metricsLatencyBuckets, seconds)
+
+	op.mutex.Lock()
+	op.latency[bucket]++
+	op.sum += seconds
+	op.mutex.Unlock()
+}
+
+func (cm *CacheMetrics) operation(name string) *operationMetrics {
+	cm.mutex.RLock()
+	op, ok := cm.operations[name]
+	cm.mutex.RUnlock()
+
+	if ok {
+		return op
+	}
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	if op, ok = cm.operations[name]; !ok {
+		op = &operationMetrics{latency: make([]int64, len(metricsLatencyBuckets)+1)}
+		cm.operations[name] = op
+	}
+
+	return op
+}
+
+// Stats - a snapshot of the metrics
+func (cm *CacheMetrics) Stats() *CacheStats {
+	stats := &CacheStats{
+		Name:       cm.name,
+		Hits:       atomic.LoadInt64(&cm.hits),
+		Misses:     atomic.LoadInt64(&cm.misses),
+		Operations: make(map[string]*OperationStats),
+	}
+
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	for name, op := range cm.operations {
+		s := &OperationStats{
+			Calls:  atomic.LoadInt64(&op.calls),
+			Errors: atomic.LoadInt64(&op.errors),
+			Keys:   atomic.LoadInt64(&op.keys),
+			Latency: HistogramStats{
+				Buckets: metricsLatencyBuckets,
+				Counts:  make([]int64, len(metricsLatencyBuckets)),
+			},
+		}
+
+		op.mutex.Lock()
+		for i, count := range op.latency {
+			s.Latency.Count += count
+			if i < len(metricsLatencyBuckets) {
+				s.Latency.Counts[i] = s.Latency.Count
+			}
+		}
+		s.Latency.Sum = op.sum
+		op.mutex.Unlock()
+
+		stats.Errors += s.Errors
+		stats.Operations[name] = s
+	}
+
+	return stats
+}
+
+// CacheStats - a snapshot of the metrics of a cache
+type CacheStats struct {
+	Name       string
+	Hits       int64
+	Misses     int64
+	Errors     int64
+	Operations map[string]*OperationStats
+}
+
+// HitRatio - hits / (hits + misses), NaN when the cache has not been read yet
+func (cs *CacheStats) HitRatio() float64 {
+	if cs.Hits+cs.Misses == 0 {
+		return math.NaN()
+	}
+
+	return float64(cs.Hits) / float64(cs.Hits+cs.Misses)
+}
+
+func (cs *CacheStats) operationNames() []string {
+	names := make([]string, 0, len(cs.Operations))
+	for name := range cs.Operations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// OperationStats - a snapshot of the metrics of one kind of cache operation
+type OperationStats struct {
+	Calls   int64
+	Errors  int64
+	Keys    int64
+	Latency HistogramStats
+}
+
+// HistogramStats - a latency histogram, `Counts[i]` is the number of
+// observations less than or equal to `Buckets[i]` seconds
+type HistogramStats struct {
+	Buckets []float64
+	Counts  []int64
+	Count   int64
+	Sum     float64
+}
+
+// MetricsDriver decorates a CacheDriver, recording hits, misses, errors,
+// latencies and the number of keys touched by each operation.
+type MetricsDriver struct {
+	inflight inflight
+	driver   CacheDriver
+	metrics  *CacheMetrics
+}
+
+// NewMetricsDriver - instrument `driver`, recording into `metrics`
+func NewMetricsDriver(driver CacheDriver, metrics *CacheMetrics) *MetricsDriver {
+	return &MetricsDriver{
+		driver:  driver,
+		metrics: metrics,
+	}
+}
+
+// Driver - the instrumented driver
+func (md *MetricsDriver) Driver() CacheDriver {
+	return md.driver
+}
+
+// Metrics - the metrics recorded by this driver
+func (md *MetricsDriver) Metrics() *CacheMetrics {
+	return md.metrics
+}
+
+// Close - close the instrumented driver
+func (md *MetricsDriver) Close() error {
+	if closer, ok := md.driver.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// begin - count an operation as running, returning its start time
+func (md *MetricsDriver) begin() time.Time {
+	md.inflight.enter()
+
+	return time.Now()
+}
+
+// observe - record an operation started with `begin`, meant to be deferred
+// with a pointer to the named error result
+func (md *MetricsDriver) observe(operation string, keys int, start time.Time, err *error) {
+	md.inflight.leave()
+
+	md.metrics.Observe(operation, keys, time.Since(start), *err)
+}
+
+// Get - retrieve `key`, counting a hit or a miss
+func (md *MetricsDriver) Get(key string) (value string, err error) {
+	defer md.observe("get", 1, md.begin(), &err)
+
+	value, err = md.driver.Get(key)
+
+	if err == nil {
+		md.metrics.Hit(1)
+	} else if IsCacheMiss(err) {
+		md.metrics.Miss(1)
+	}
+
+	return
+}
+
+// GetVia - retrieve `key`, a call of `handler` counts as a miss
+func (md *MetricsDriver) GetVia(key string, handler func() (string, time.Duration, error)) (value string, err error) {
+	start := md.begin()
+	missed := int32(0)
+
+	value, err = md.driver.GetVia(key, func() (string, time.Duration, error) {
+		atomic.StoreInt32(&missed, 1)
+		return handler()
+	})
+
+	if atomic.LoadInt32(&missed) == 1 {
+		md.metrics.Miss(1)
+	} else if err == nil {
+		md.metrics.Hit(1)
+	}
+
+	md.observe("get-via", 1, start, &err)
+
+	return
+}
+
+// Set - put `key` into the cache
+func (md *MetricsDriver) Set(key, value string, expiration time.Duration) (err error) {
+	defer md.observe("set", 1, md.begin(), &err)
+
+	return md.driver.Set(key, value, expiration)
+}
+
+// SetNX - put `key` into the cache if `key` is not exist
+func (md *MetricsDriver) SetNX(key, value string, expiration time.Duration) (ok bool, err error) {
+	defer md.observe("setnx", 1, md.begin(), &err)
+
+	return md.driver.SetNX(key, value, expiration)
+}
+
+// Has - check if `key` exists, counting a hit or a miss
+func (md *MetricsDriver) Has(key string) (has bool, err error) {
+	defer md.observe("has", 1, md.begin(), &err)
+
+	has, err = md.driver.Has(key)
+
+	if err == nil {
+		if has {
+			md.metrics.Hit(1)
+		} else {
+			md.metrics.Miss(1)
+		}
+	}
+
+	return
+}
+
+// Del - delete `keys`
+func (md *MetricsDriver) Del(keys ...string) (ok bool, err error) {
+	defer md.observe("del", len(keys), md.begin(), &err)
+
+	return md.driver.Del(keys...)
+}
+
+// Flush - flush the cache
+func (md *MetricsDriver) Flush() (ok bool, err error) {
+	defer md.observe("flush", 0, md.begin(), &err)
+
+	return md.driver.Flush()
+}
+
+// Incr - increase the value of `key`
+func (md *MetricsDriver) Incr(key string) (value int64, err error) {
+	defer md.observe("incr", 1, md.begin(), &err)
+
+	return md.driver.Incr(key)
+}
+
+// Decr - decrease the value of `key`
+func (md *MetricsDriver) Decr(key string) (value int64, err error) {
+	defer md.observe("decr", 1, md.begin(), &err)
+
+	return md.driver.Decr(key)
+}
+
+// Expire - set the expire time of `key`
+func (md *MetricsDriver) Expire(key string, expiry time.Duration) (ok bool, err error) {
+	defer md.observe("expire", 1, md.begin(), &err)
+
+	return md.driver.Expire(key, expiry)
+}
+
+// Guard - guard the execution of `handler` with a lock
+func (md *MetricsDriver) Guard(key string, expiration time.Duration, handler func() error) error {
+	return guard(md, key, expiration, handler)
+}
+
+// CompareAndDelete - delete `key` if it holds `value`
+func (md *MetricsDriver) CompareAndDelete(key, value string) (ok bool, err error) {
+	defer md.observe("compare-and-delete", 1, md.begin(), &err)
+
+	return md.driver.CompareAndDelete(key, value)
+}
+
+// CompareAndExpire - set the expire time of `key` if it holds `value`
+func (md *MetricsDriver) CompareAndExpire(key, value string, expiry time.Duration) (ok bool, err error) {
+	defer md.observe("compare-and-expire", 1, md.begin(), &err)
+
+	return md.driver.CompareAndExpire(key, value, expiry)
+}
+
+// MGet - retrieve multiple keys, counting a hit or a miss per key
+func (md *MetricsDriver) MGet(keys ...string) (values map[string]string, err error) {
+	defer md.observe("mget", len(keys), md.begin(), &err)
+
+	values, err = md.driver.MGet(keys...)
+
+	if err == nil {
+		md.metrics.Hit(len(values))
+		md.metrics.Miss(len(keys) - len(values))
+	}
+
+	return
+}
+
+// MSet - put multiple items into the cache
+func (md *MetricsDriver) MSet(items ...*CacheItem) (err error) {
+	defer md.observe("mset", len(items), md.begin(), &err)
+
+	return md.driver.MSet(items...)
+}
+
+// MDel - delete multiple keys
+func (md *MetricsDriver) MDel(keys ...string) (deleted int64, err error) {
+	defer md.observe("mdel", len(keys), md.begin(), &err)
+
+	return md.driver.MDel(keys...)
+}
+
+// HGet - get `field` of the hash at `key`, counting a hit or a miss
+func (md *MetricsDriver) HGet(key, field string) (value string, err error) {
+	defer md.observe("hget", 1, md.begin(), &err)
+
+	value, err = md.driver.HGet(key, field)
+
+	if err == nil {
+		md.metrics.Hit(1)
+	} else if IsCacheMiss(err) {
+		md.metrics.Miss(1)
+	}
+
+	return
+}
+
+// HSet - set `field` of the hash at `key`
+func (md *MetricsDriver) HSet(key, field, value string) (err error) {
+	defer md.observe("hset", 1, md.begin(), &err)
+
+	return md.driver.HSet(key, field, value)
+}
+
+// HDel - delete `fields` of the hash at `key`
+func (md *MetricsDriver) HDel(key string, fields ...string) (count int64, err error) {
+	defer md.observe("hdel", 1, md.begin(), &err)
+
+	return md.driver.HDel(key, fields...)
+}
+
+// HGetAll - get all fields of the hash at `key`
+func (md *MetricsDriver) HGetAll(key string) (values map[string]string, err error) {
+	defer md.observe("hgetall", 1, md.begin(), &err)
+
+	return md.driver.HGetAll(key)
+}
+
+// HIncrBy - add `delta` to `field` of the hash at `key`
+func (md *MetricsDriver) HIncrBy(key, field string, delta int64) (count int64, err error) {
+	defer md.observe("hincrby", 1, md.begin(), &err)
+
+	return md.driver.HIncrBy(key, field, delta)
+}
+
+// ZAdd - add `members` to the sorted set at `key`
+func (md *MetricsDriver) ZAdd(key string, members ...ZMember) (count int64, err error) {
+	defer md.observe("zadd", 1, md.begin(), &err)
+
+	return md.driver.ZAdd(key, members...)
+}
+
+// ZRange - members of the sorted set at `key` by ascending score
+func (md *MetricsDriver) ZRange(key string, start, stop int64) (members []ZMember, err error) {
+	defer md.observe("zrange", 1, md.begin(), &err)
+
+	return md.driver.ZRange(key, start, stop)
+}
+
+// ZRevRange - members of the sorted set at `key` by descending score
+func (md *MetricsDriver) ZRevRange(key string, start, stop int64) (members []ZMember, err error) {
+	defer md.observe("zrevrange", 1, md.begin(), &err)
+
+	return md.driver.ZRevRange(key, start, stop)
+}
+
+// ZRank - the rank of `member` in the sorted set at `key`
+func (md *MetricsDriver) ZRank(key, member string) (count int64, err error) {
+	defer md.observe("zrank", 1, md.begin(), &err)
+
+	return md.driver.ZRank(key, member)
+}
+
+// LPush - prepend `values` to the list at `key`
+func (md *MetricsDriver) LPush(key string, values ...string) (count int64, err error) {
+	defer md.observe("lpush", 1, md.begin(), &err)
+
+	return md.driver.LPush(key, values...)
+}
+
+// RPush - append `values` to the list at `key`
+func (md *MetricsDriver) RPush(key string, values ...string) (count int64, err error) {
+	defer md.observe("rpush", 1, md.begin(), &err)
+
+	return md.driver.RPush(key, values...)
+}
+
+// LPop - remove and return the first element of the list at `key`
+func (md *MetricsDriver) LPop(key string) (value string, err error) {
+	defer md.observe("lpop", 1, md.begin(), &err)
+
+	return md.driver.LPop(key)
+}
+
+// RPop - remove and return the last element of the list at `key`
+func (md *MetricsDriver) RPop(key string) (value string, err error) {
+	defer md.observe("rpop", 1, md.begin(), &err)
+
+	return md.driver.RPop(key)
+}
+
+// LRange - elements of the list at `key` from `start` to `stop`
+func (md *MetricsDriver) LRange(key string, start, stop int64) (values []string, err error) {
+	defer md.observe("lrange", 1, md.begin(), &err)
+
+	return md.driver.LRange(key, start, stop)
+}
+
+// LTrim - keep only the elements of the list at `key` from `start` to `stop`
+func (md *MetricsDriver) LTrim(key string, start, stop int64) (err error) {
+	defer md.observe("ltrim", 1, md.begin(), &err)
+
+	return md.driver.LTrim(key, start, stop)
+}
+
+// Throttle - count a request against the rate limit at `key`
+func (md *MetricsDriver) Throttle(key string, limit *RateLimit) (result *RateLimitResult, err error) {
+	defer md.observe("throttle", 1, md.begin(), &err)
+
+	return md.driver.Throttle(key, limit)
+}
+
+// Batch - start a batch, recorded as a single operation on Exec
+func (md *MetricsDriver) Batch() CacheBatch {
+	return &metricsBatch{driver: md, batch: md.driver.Batch()}
+}
+
+// Publish - publish through the instrumented driver, if it supports pub/sub
+func (md *MetricsDriver) Publish(channel, message string) (err error) {
+	pubsub, ok := md.driver.(PubSub)
+	if !ok {
+		return fmt.Errorf("cache driver %T does not support pub/sub", md.driver)
+	}
+	defer md.observe("publish", 0, md.begin(), &err)
+
+	return pubsub.Publish(channel, message)
+}
+
+// Subscribe - subscribe through the instrumented driver, if it supports pub/sub
+func (md *MetricsDriver) Subscribe(channel string, handler func(message string)) io.Closer {
+	if pubsub, ok := md.driver.(PubSub); ok {
+		return pubsub.Subscribe(channel, handler)
+	}
+
+	return ioutil.NopCloser(nil)
+}
+
+type metricsBatch struct {
+	driver *MetricsDriver
+	batch  CacheBatch
+	keys   int
+}
+
+func (b *metricsBatch) Get(key string) *CacheResult {
+	b.keys++
+	return b.batch.Get(key)
+}
+
+func (b *metricsBatch) Set(key, value string, expiration time.Duration) *CacheResult {
+	b.keys++
+	return b.batch.Set(key, value, expiration)
+}
+
+func (b *metricsBatch) Del(key string) *CacheResult {
+	b.keys++
+	return b.batch.Del(key)
+}
+
+func (b *metricsBatch) Incr(key string) *CacheResult {
+	b.keys++
+	return b.batch.Incr(key)
+}
+
+func (b *metricsBatch) Decr(key string) *CacheResult {
+	b.keys++
+	return b.batch.Decr(key)
+}
+
+func (b *metricsBatch) Expire(key string, expiry time.Duration) *CacheResult {
+	b.keys++
+	return b.batch.Expire(key, expiry)
+}
+
+func (b *metricsBatch) Exec() (err error) {
+	defer b.driver.observe("batch", b.keys, b.driver.begin(), &err)
+
+	b.keys = 0
+
+	return b.batch.Exec()
+}
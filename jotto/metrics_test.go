@@ -0,0 +1,110 @@
+package motto_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.garena.com/duanzy/motto/motto"
+)
+
+func TestMetricsDriverRecordsHitsAndMisses(t *testing.T) {
+	registry := motto.NewMetricsRegistry()
+	cache := motto.NewMetricsDriver(motto.NewMemoryDriver("mem", nil), registry.Cache("mem"))
+	defer cache.Close()
+
+	cache.Set("a", "1", 0)
+	cache.Set("b", "2", 0)
+
+	cache.Get("a")
+	cache.Get("missing")
+	cache.MGet("a", "b", "c")
+	cache.GetVia("lazy", func() (string, time.Duration, error) {
+		return "v", 0, nil
+	})
+	cache.GetVia("lazy", func() (string, time.Duration, error) {
+		return "", 0, errors.New("not called")
+	})
+
+	stats := registry.Cache("mem").Stats()
+	assert.Equal(t, int64(4), stats.Hits)
+	assert.Equal(t, int64(3), stats.Misses)
+	assert.Equal(t, 4.0/7.0, stats.HitRatio())
+	assert.Equal(t, int64(0), stats.Errors)
+
+	assert.Equal(t, int64(2), stats.Operations["set"].Calls)
+	assert.Equal(t, int64(3), stats.Operations["mget"].Keys)
+	assert.Equal(t, int64(2), stats.Operations["get"].Latency.Count)
+
+	_, err := cache.Incr("a")
+	assert.Nil(t, err)
+	cache.Set("text", "abc", 0)
+	_, err = cache.Incr("text")
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(1), registry.Cache("mem").Stats().Operations["incr"].Errors)
+}
+
+func TestMetricsRegistryWritesPrometheusFormat(t *testing.T) {
+	registry := motto.NewMetricsRegistry()
+	cache := motto.NewMetricsDriver(motto.NewMemoryDriver("mem", nil), registry.Cache("mem"))
+	defer cache.Close()
+
+	cache.Get("missing")
+
+	buffer := &bytes.Buffer{}
+	_, err := registry.WriteTo(buffer)
+	assert.Nil(t, err)
+	assert.Contains(t, buffer.String(), `motto_cache_misses_total{cache="mem"} 1`)
+	assert.Contains(t, buffer.String(), `motto_cache_latency_seconds_count{cache="mem",operation="get"} 1`)
+}
+
+func TestMetricsEnabledForConfiguredCaches(t *testing.T) {
+	cfg := motto.NewDefaultSettings()
+	cfg.Motto().Cache = []*motto.CacheSettings{
+		{Name: "mem", Driver: "memory"},
+	}
+	app := motto.NewApplication(cfg, nil, nil, nil)
+	app.Boot()
+
+	app.Cache("mem").Get("missing")
+
+	assert.Equal(t, int64(1), app.Metrics().Cache("mem").Stats().Misses)
+}
+
+func TestWrappedCachesForwardPubSub(t *testing.T) {
+	cfg := motto.NewDefaultSettings()
+	cfg.Motto().Cache = []*motto.CacheSettings{{
+		Name:           "wrapped",
+		Driver:         "memory",
+		Memory:         &motto.MemorySettings{},
+		CircuitBreaker: &motto.CircuitBreakerSettings{},
+		Local:          &motto.LocalCacheSettings{},
+		GetVia:         &motto.GetViaSettings{},
+	}}
+	app := motto.NewApplication(cfg, nil, nil, nil)
+	defer app.Close()
+	assert.Nil(t, app.Boot())
+
+	cache := app.Cache("wrapped")
+	assert.IsType(t, &motto.MemoryDriver{}, motto.UnwrapCache(cache))
+
+	pubsub, ok := cache.(motto.PubSub)
+	assert.True(t, ok)
+
+	received := make(chan string, 1)
+	subscription := pubsub.Subscribe("news", func(message string) { received <- message })
+	defer subscription.Close()
+
+	assert.Nil(t, pubsub.Publish("news", "hello"))
+	select {
+	case message := <-received:
+		assert.Equal(t, "hello", message)
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	assert.Equal(t, int64(1), cache.(*motto.MetricsDriver).Metrics().Stats().Operations["publish"].Calls)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -17,6 +18,62 @@ type Job struct {
 	JobID       uint64
 	DataBase    string
 	RetryTimes  int64
+	LastError   string // The error the job last failed with
+	FailedAt    int64  // When the job was moved to the failed list
+	Priority    int    // One of the Priority* levels, higher priorities are dequeued first
+
+	// UniqueKey - while a job with this key is pending, delayed or working,
+	// queueing another one with the same key fails with ErrorJobDuplicate
+	UniqueKey string
+	// UniqueFor - in seconds, how long the key stays taken once the job completed
+	UniqueFor int64
+	// Coalesce - a duplicate is not an error, the job takes the ID of the queued one
+	Coalesce bool
+
+	// BatchID - the batch the job belongs to, or the batch a callback job was queued for
+	BatchID string
+
+	// ChainID - the chain the job is a step of
+	ChainID string
+	// Step - the index of the job in its chain
+	Step int
+	// Next - the steps following the job in its chain
+	Next []*Job
+	// Result - set by the processor, becomes the payload of the next step of the chain
+	Result string
+
+	// lease - the token of the lease handed out with the job when it was dequeued
+	lease string
+}
+
+// Job priorities, from the last to the first dequeued
+const (
+	PriorityLow      = -1
+	PriorityNormal   = 0
+	PriorityHigh     = 1
+	PriorityCritical = 2
+)
+
+// Priorities - the priority levels, in the order their jobs are dequeued
+var Priorities = []int{PriorityCritical, PriorityHigh, PriorityNormal, PriorityLow}
+
+// priorityNames - the names of the priority levels in logs
+var priorityNames = map[int]string{
+	PriorityCritical: "critical",
+	PriorityHigh:     "high",
+	PriorityNormal:   "normal",
+	PriorityLow:      "low",
+}
+
+// priorityLevel - the level `priority` falls into, priorities above or below
+// the known levels count as the highest or lowest level
+func priorityLevel(priority int) int {
+	for _, level := range Priorities {
+		if priority >= level {
+			return level
+		}
+	}
+	return PriorityLow
 }
 
 func (job *Job) String() string {
@@ -29,6 +86,21 @@ func (job *Job) Attempt() {
 	job.LastAttempt = time.Now().Unix()
 }
 
+// successor - the next step of the chain of the job, taking its result as payload
+func (job *Job) successor() *Job {
+	if len(job.Next) == 0 {
+		return nil
+	}
+
+	next := *job.Next[0]
+	next.ChainID, next.Step, next.Next = job.ChainID, job.Step+1, job.Next[1:]
+	if job.Result != "" {
+		next.Payload = job.Result
+	}
+
+	return &next
+}
+
 // Serialize serializes a job into string
 func (job *Job) Serialize() (str string) {
 	bytes, err := json.Marshal(job)
@@ -53,11 +125,20 @@ type QueueStats struct {
 	Delayed int64 // Number of jobs that have been delayed
 	Backlog int64 // Total number of jobs
 	Waiting int64 // Number of jobs currently in the delayed queue and waiting to be placed back to the pending queue
+
+	Priorities map[int]int64 // Number of pending jobs by priority level
 }
 
 func (qs *QueueStats) String() string {
-	return fmt.Sprintf("QueueStats (pending=%d, working=%d, failure=%d, delayed=%d, backlog=%d, waiting=%d)",
-		qs.Pending, qs.Working, qs.Failure, qs.Delayed, qs.Backlog, qs.Waiting,
+	priorities := make([]string, 0, len(Priorities))
+	for _, level := range Priorities {
+		if count, ok := qs.Priorities[level]; ok {
+			priorities = append(priorities, fmt.Sprintf("%s=%d", priorityNames[level], count))
+		}
+	}
+
+	return fmt.Sprintf("QueueStats (pending=%d, working=%d, failure=%d, delayed=%d, backlog=%d, waiting=%d, priorities=[%s])",
+		qs.Pending, qs.Working, qs.Failure, qs.Delayed, qs.Backlog, qs.Waiting, strings.Join(priorities, " "),
 	)
 }
 
@@ -90,6 +171,21 @@ type QueueDriver interface {
 	// Requeue all failed jobs on the queue
 	RequeueAllFailed(queue string) ([]string, error)
 
+	// List failed jobs, most recent failure first
+	Failed(queue string, offset, limit int64) ([]*Job, error)
+
+	// Find a job of the queue by its ID
+	Find(queue string, id string) (*Job, error)
+
+	// Requeue a failed job
+	RequeueFailed(queue string, id string) error
+
+	// Delete a failed job
+	DeleteFailed(queue string, id string) error
+
+	// Delete jobs that failed before `before`
+	PurgeFailed(queue string, before time.Time) (int64, error)
+
 	// Clear the queue (All data will be lost)
 	Truncate(queue string) error
 
@@ -98,6 +194,46 @@ type QueueDriver interface {
 
 	// Move deferred jobs that are ready to the pending queue
 	ScheduleDeferred(queue string) (int64, error)
+
+	// The lease of dequeued jobs, zero when leases are disabled
+	VisibilityTimeout() time.Duration
+
+	// Extend the lease of a job being processed
+	Heartbeat(queue string, job *Job, lease time.Duration) error
+
+	// Move working jobs whose lease expired back to the pending queue
+	Reap(queue string) (int64, error)
+
+	// Send the jobs of a batch to queue
+	EnqueueBatch(queue string, batch *Batch, jobs []*Job) error
+
+	// Get a batch with its counts
+	FindBatch(queue string, id string) (*Batch, error)
+
+	// Send the first step of a chain to queue
+	EnqueueChain(queue string, chain *Chain, job *Job) error
+
+	// Get a chain with the state of its steps
+	FindChain(queue string, id string) (*Chain, error)
+}
+
+// DefaultVisibilityTimeout - how long a dequeued job is leased to its worker by default
+const DefaultVisibilityTimeout = 5 * time.Minute
+
+// visibilityTimeout - the lease of dequeued jobs, zero when leases are disabled
+func visibilityTimeout(seconds int) time.Duration {
+	switch {
+	case seconds < 0:
+		return 0
+	case seconds == 0:
+		return DefaultVisibilityTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// leaseDeadline - the deadline of a lease of `lease` from now, in milliseconds
+func leaseDeadline(lease time.Duration) int64 {
+	return time.Now().Add(lease).UnixNano() / int64(time.Millisecond)
 }
 
 type action string
@@ -105,20 +241,139 @@ type action string
 // QueueProcessor is a logic unit that can process a queue job `Job`
 type QueueProcessor func(*Queue, *Job, Application, Logger) error
 
+// QueueCallbackProcessor processes the callback job of a finished `Batch`
+type QueueCallbackProcessor func(*Queue, *Batch, Application, Logger) error
+
+// processor - the QueueProcessor of callback jobs, loading their batch first
+func (callback QueueCallbackProcessor) processor() QueueProcessor {
+	return func(Q *Queue, job *Job, app Application, logger Logger) error {
+		batch, err := Q.Batch(job.BatchID)
+		if err != nil {
+			return err
+		}
+		return callback(Q, batch, app, logger)
+	}
+}
+
+// Batch is a group of jobs queued together. Once every job of the batch
+// completed or failed, the callback job of type `OnComplete` (all jobs
+// completed) or `OnFailure` (some jobs failed) is queued with `Priority`;
+// its processor is registered with `Application.RegisterCallback`.
+// Finished batches are kept for a week. Requeueing a failed job reopens its batch.
+type Batch struct {
+	ID         string
+	OnComplete int    // Type of the callback job when all jobs completed, zero for none
+	OnFailure  int    // Type of the callback job when some jobs failed, zero for none
+	Payload    string // Payload of the callback job
+	Priority   int    // Priority of the callback job
+
+	Total      int64 // Number of jobs in the batch
+	Pending    int64 // Number of jobs neither completed nor failed yet
+	Succeeded  int64 // Number of completed jobs
+	Failed     int64 // Number of failed jobs
+	CreatedAt  int64
+	FinishedAt int64 // When the last job completed or failed, zero while pending
+}
+
+// Finished - whether all jobs of the batch completed or failed
+func (b *Batch) Finished() bool {
+	return b.Total > 0 && b.Pending == 0
+}
+
+// callbacks - the callback jobs of the batch, when it completes and when it fails
+func (b *Batch) callbacks() (complete, failure *Job) {
+	if b.OnComplete != 0 {
+		complete = &Job{TraceID: GenerateTraceID(), Type: b.OnComplete, Payload: b.Payload, BatchID: b.ID, Priority: b.Priority}
+	}
+	if b.OnFailure != 0 {
+		failure = &Job{TraceID: GenerateTraceID(), Type: b.OnFailure, Payload: b.Payload, BatchID: b.ID, Priority: b.Priority}
+	}
+	return
+}
+
+// batchRetention - how long a finished batch is kept
+const batchRetention = 7 * 24 * time.Hour
+
+// ErrorBatchEmpty - a batch must hold at least one job
+var ErrorBatchEmpty = errors.New("batch has no job")
+
+// ErrorBatchNotFound - the batch does not exist or expired
+var ErrorBatchNotFound = errors.New("batch not found")
+
+// Chain statuses
+const (
+	ChainRunning   = "running"
+	ChainCompleted = "completed"
+	ChainFailed    = "failed"
+)
+
+// Chain is a sequence of jobs run one after the other. Once a step completed,
+// the next one is queued with the `Result` of the step as its payload, when set.
+// A failed step halts the chain until it is requeued; the chain records which.
+// Completed chains are kept for a week, failed ones until they are resumed.
+type Chain struct {
+	ID         string
+	Steps      int    // Number of steps
+	Step       int    // Index of the step being run, or of the failed step
+	JobID      string // ID of the job of the step being run
+	Status     string // One of the Chain* statuses
+	LastError  string // The error the failed step failed with
+	CreatedAt  int64
+	FinishedAt int64 // When the last step completed or a step failed, zero while running
+}
+
+// chainRetention - how long a completed chain is kept
+const chainRetention = 7 * 24 * time.Hour
+
+// ErrorChainEmpty - a chain must have at least one step
+var ErrorChainEmpty = errors.New("chain has no step")
+
+// ErrorChainNotFound - the chain does not exist or expired
+var ErrorChainNotFound = errors.New("chain not found")
+
 // ErrorJobHandled description in error message
 var ErrorJobHandled = errors.New("job is handled by processor; runner does not need to do anything (requeue,complete,defer,fail) with this job")
 
 // ErrorJobMustRetry description in error message
 var ErrorJobMustRetry = errors.New("job must be retried regardless of its attempts count")
 
+// ErrorQueueEmpty - there is no pending job in the queue
+var ErrorQueueEmpty = errors.New("queue is empty")
+
+// ErrorJobNotFound - the job cannot be found in the backlog of the queue
+var ErrorJobNotFound = errors.New("job not found")
+
+// ErrorJobLeaseLost - the lease of the job expired and the job was reaped,
+// it belongs to whichever worker dequeued it next
+var ErrorJobLeaseLost = errors.New("job lease lost")
+
+// ErrorJobDuplicate - a job with the same unique key is already queued, the
+// TraceID of the job is set to the ID of the queued one
+var ErrorJobDuplicate = errors.New("a job with the same unique key is already queued")
+
+// duplicate - report a duplicate when the driver queued the job under another ID
+func duplicate(job *Job, id string, err error) error {
+	if err != nil || id == job.TraceID {
+		return err
+	}
+
+	job.TraceID = id
+
+	if job.Coalesce {
+		return nil
+	}
+	return ErrorJobDuplicate
+}
+
 // ErrorNilPoiner - nil pointer error
 var ErrorNilPoiner = errors.New("nil pointer")
 
 // Queue represents a logical queue that can receive async jobs
 // Multiple Queues may share the same underlying QueueDriver.
 type Queue struct {
-	name   string
-	driver QueueDriver
+	inflight inflight
+	name     string
+	driver   QueueDriver
 }
 
 // NewQueue creates a logical queue
@@ -145,11 +400,26 @@ func (q *Queue) Driver() QueueDriver {
 	return q.driver
 }
 
+// hold - keep the driver of the queue open until the returned function is
+// called, even if the queue is replaced by a reload in the meantime
+func (q *Queue) hold() func() {
+	if q == nil {
+		return func() {}
+	}
+
+	q.inflight.enter()
+
+	return q.inflight.leave
+}
+
 // Enqueue sends a job to queue
 func (q *Queue) Enqueue(job *Job) error {
 	if q == nil {
 		return ErrorNilPoiner
 	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
 	return q.driver.Enqueue(q.name, job)
 }
 
@@ -158,6 +428,9 @@ func (q *Queue) Schedule(job *Job, at time.Time) error {
 	if q == nil {
 		return ErrorNilPoiner
 	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
 	return q.driver.Schedule(q.name, job, at)
 }
 
@@ -166,6 +439,9 @@ func (q *Queue) Dequeue() (*Job, error) {
 	if q == nil {
 		return nil, ErrorNilPoiner
 	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
 	return q.driver.Dequeue(q.name)
 }
 
@@ -174,6 +450,9 @@ func (q *Queue) Attempt(job *Job) error {
 	if q == nil {
 		return ErrorNilPoiner
 	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
 	return q.driver.Attempt(q.name, job)
 }
 
@@ -182,44 +461,238 @@ func (q *Queue) Requeue(job *Job) error {
 	if q == nil {
 		return ErrorNilPoiner
 	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
 	return q.driver.Requeue(q.name, job)
 }
 
-// Complete marks a job as completed and remove it from the queue
+// Complete marks a job as completed and remove it from the queue.
+// Nothing is done, and ErrorJobLeaseLost returned, when the job was reaped while processed.
 func (q *Queue) Complete(job *Job) error {
 	if q == nil {
 		return ErrorNilPoiner
 	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
 	return q.driver.Complete(q.name, job)
 }
 
-// Defer a job to be processed at a later time
+// Defer a job to be processed at a later time, unless it was reaped (ErrorJobLeaseLost)
 func (q *Queue) Defer(job *Job, after time.Duration) error {
 	if q == nil {
 		return ErrorNilPoiner
 	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
 	return q.driver.Defer(q.name, job, after)
 }
 
-// Fail marks a job as failed and move it to the failed list
+// Fail marks a job as failed and move it to the failed list, unless it was reaped (ErrorJobLeaseLost)
 func (q *Queue) Fail(job *Job) error {
 	if q == nil {
 		return ErrorNilPoiner
 	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
 	return q.driver.Fail(q.name, job)
 }
 
+// RequeueAllFailed moves the failed jobs back to the pending list, returning their IDs.
+// Jobs whose unique key was taken by another job in the meantime are left failed.
 func (q *Queue) RequeueAllFailed() ([]string, error) {
 	if q == nil {
 		return nil, ErrorNilPoiner
 	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
 	return q.driver.RequeueAllFailed(q.name)
 }
 
+// Failed lists up to `limit` failed jobs from `offset`, most recent failure first
+func (q *Queue) Failed(offset, limit int64) ([]*Job, error) {
+	if q == nil {
+		return nil, ErrorNilPoiner
+	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
+	return q.driver.Failed(q.name, offset, limit)
+}
+
+// Find gets a job of the queue by its ID, whatever its state
+func (q *Queue) Find(id string) (*Job, error) {
+	if q == nil {
+		return nil, ErrorNilPoiner
+	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
+	return q.driver.Find(q.name, id)
+}
+
+// RequeueFailed moves a failed job back to the pending list, resetting its attempt count.
+// It fails with ErrorJobDuplicate, leaving the job failed, when another job took its unique key.
+func (q *Queue) RequeueFailed(id string) error {
+	if q == nil {
+		return ErrorNilPoiner
+	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
+	return q.driver.RequeueFailed(q.name, id)
+}
+
+// DeleteFailed removes a failed job from the queue entirely
+func (q *Queue) DeleteFailed(id string) error {
+	if q == nil {
+		return ErrorNilPoiner
+	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
+	return q.driver.DeleteFailed(q.name, id)
+}
+
+// PurgeFailed removes the jobs that failed before `before`, returning how many were removed
+func (q *Queue) PurgeFailed(before time.Time) (int64, error) {
+	if q == nil {
+		return 0, ErrorNilPoiner
+	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
+	return q.driver.PurgeFailed(q.name, before)
+}
+
+// VisibilityTimeout - how long a dequeued job is leased to its worker,
+// zero when leases are disabled
+func (q *Queue) VisibilityTimeout() time.Duration {
+	if q == nil {
+		return 0
+	}
+
+	return q.driver.VisibilityTimeout()
+}
+
+// Heartbeat extends the lease of a job being processed to `lease` from now,
+// or to the visibility timeout of the driver when `lease` is zero.
+// ErrorJobNotFound or ErrorJobLeaseLost is returned when the job lost its lease already.
+func (q *Queue) Heartbeat(job *Job, lease time.Duration) error {
+	if q == nil {
+		return ErrorNilPoiner
+	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
+	return q.driver.Heartbeat(q.name, job, lease)
+}
+
+// Reap moves the jobs whose worker did not complete them within their lease
+// back to the pending queue, returning how many were moved
+func (q *Queue) Reap() (int64, error) {
+	if q == nil {
+		return 0, ErrorNilPoiner
+	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
+	return q.driver.Reap(q.name)
+}
+
+// EnqueueBatch sends the jobs of a batch to queue at once. The ID of the batch
+// is generated when empty. The unique keys of the jobs are not checked.
+func (q *Queue) EnqueueBatch(batch *Batch, jobs ...*Job) error {
+	if q == nil {
+		return ErrorNilPoiner
+	}
+	if len(jobs) == 0 {
+		return ErrorBatchEmpty
+	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
+	if batch.ID == "" {
+		batch.ID = GenerateTraceID()
+	}
+	batch.Total, batch.Pending, batch.Succeeded, batch.Failed = int64(len(jobs)), int64(len(jobs)), 0, 0
+	batch.CreatedAt, batch.FinishedAt = time.Now().Unix(), 0
+
+	for _, job := range jobs {
+		if job.TraceID == "" {
+			job.TraceID = GenerateTraceID()
+		}
+		job.BatchID = batch.ID
+	}
+
+	return q.driver.EnqueueBatch(q.name, batch, jobs)
+}
+
+// Batch gets a batch with its counts
+func (q *Queue) Batch(id string) (*Batch, error) {
+	if q == nil {
+		return nil, ErrorNilPoiner
+	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
+	return q.driver.FindBatch(q.name, id)
+}
+
+// EnqueueChain sends the first of `jobs` to queue, each following job is queued
+// once the previous one completed. The ID of the chain is generated when empty.
+// The unique keys of the jobs are not checked.
+func (q *Queue) EnqueueChain(chain *Chain, jobs ...*Job) error {
+	if q == nil {
+		return ErrorNilPoiner
+	}
+	if len(jobs) == 0 {
+		return ErrorChainEmpty
+	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
+	if chain.ID == "" {
+		chain.ID = GenerateTraceID()
+	}
+
+	for i, job := range jobs {
+		if job.TraceID == "" {
+			job.TraceID = GenerateTraceID()
+		}
+		job.ChainID, job.Step, job.Next = chain.ID, i, nil
+	}
+	jobs[0].Next = jobs[1:]
+
+	chain.Steps, chain.Step, chain.JobID = len(jobs), 0, jobs[0].TraceID
+	chain.Status, chain.LastError = ChainRunning, ""
+	chain.CreatedAt, chain.FinishedAt = time.Now().Unix(), 0
+
+	return q.driver.EnqueueChain(q.name, chain, jobs[0])
+}
+
+// Chain gets a chain with the state of its steps, e.g. which step failed
+func (q *Queue) Chain(id string) (*Chain, error) {
+	if q == nil {
+		return nil, ErrorNilPoiner
+	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
+	return q.driver.FindChain(q.name, id)
+}
+
 // Stats gets the stats of a quuee
 func (q *Queue) Stats() (*QueueStats, error) {
 	if q == nil {
 		return nil, ErrorNilPoiner
 	}
+	q.inflight.enter()
+	defer q.inflight.leave()
+
 	return q.driver.Stats(q.name)
 }
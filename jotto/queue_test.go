@@ -0,0 +1,320 @@
+package motto_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+
+	"git.garena.com/duanzy/motto/motto"
+)
+
+// The queue scenarios below run against every queue driver, see
+// memory_test.go and redis_test.go
+
+// assertQueueEmpty - the drivers report an empty queue differently
+func assertQueueEmpty(t *testing.T, Q *motto.Queue) {
+	job, err := Q.Dequeue()
+	assert.Nil(t, job)
+	assert.True(t, err == motto.ErrorQueueEmpty || err == redis.Nil, "expected an empty queue, got %v", err)
+}
+
+func testQueueEnqueueDequeueComplete(t *testing.T, Q *motto.Queue) {
+	first := &motto.Job{Type: 1, Payload: "first"}
+	second := &motto.Job{Type: 1, Payload: "second"}
+
+	assert.Nil(t, Q.Enqueue(first))
+	assert.Nil(t, Q.Enqueue(second))
+	assert.NotEmpty(t, first.TraceID)
+
+	job, err := Q.Dequeue()
+	assert.Nil(t, err)
+	assert.Equal(t, "first", job.Payload)
+
+	stats, _ := Q.Stats()
+	assert.Equal(t, int64(1), stats.Pending)
+	assert.Equal(t, int64(1), stats.Working)
+	assert.Equal(t, int64(2), stats.Backlog)
+
+	assert.Nil(t, Q.Complete(job))
+
+	stats, _ = Q.Stats()
+	assert.Equal(t, int64(0), stats.Working)
+	assert.Equal(t, int64(1), stats.Backlog)
+
+	job, _ = Q.Dequeue()
+	assert.Equal(t, "second", job.Payload)
+
+	assertQueueEmpty(t, Q)
+}
+
+func testQueueDeadLetters(t *testing.T, Q *motto.Queue) {
+	ids := []string{}
+	for _, payload := range []string{"first", "second", "third"} {
+		assert.Nil(t, Q.Enqueue(&motto.Job{Payload: payload}))
+
+		job, _ := Q.Dequeue()
+		job.LastError = payload + " failed"
+		assert.Nil(t, Q.Fail(job))
+
+		ids = append(ids, job.TraceID)
+	}
+
+	jobs, err := Q.Failed(0, 2)
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 2)
+	assert.Equal(t, "third", jobs[0].Payload)
+	assert.Equal(t, "second", jobs[1].Payload)
+
+	jobs, _ = Q.Failed(2, 2)
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, "first failed", jobs[0].LastError)
+	assert.NotZero(t, jobs[0].FailedAt)
+
+	job, err := Q.Find(ids[1])
+	assert.Nil(t, err)
+	assert.Equal(t, "second", job.Payload)
+
+	_, err = Q.Find("missing")
+	assert.Equal(t, motto.ErrorJobNotFound, err)
+
+	assert.Nil(t, Q.RequeueFailed(ids[0]))
+	assert.Equal(t, motto.ErrorJobNotFound, Q.RequeueFailed(ids[0]))
+
+	job, _ = Q.Dequeue()
+	assert.Equal(t, "first", job.Payload)
+
+	assert.Nil(t, Q.DeleteFailed(ids[1]))
+	assert.Equal(t, motto.ErrorJobNotFound, Q.DeleteFailed(ids[1]))
+
+	count, err := Q.PurgeFailed(time.Now().Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+
+	count, err = Q.PurgeFailed(time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+
+	stats, _ := Q.Stats()
+	assert.Equal(t, int64(0), stats.Failure)
+	assert.Equal(t, int64(1), stats.Backlog)
+}
+
+func testQueueLeases(t *testing.T, Q *motto.Queue) {
+	assert.Nil(t, Q.Enqueue(&motto.Job{Payload: "slow"}))
+	assert.Nil(t, Q.Enqueue(&motto.Job{Payload: "stuck"}))
+
+	slow, _ := Q.Dequeue()
+	stuck, _ := Q.Dequeue()
+
+	assert.Nil(t, Q.Heartbeat(slow, time.Minute))
+
+	count, err := Q.Reap()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	count, err = Q.Reap()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+	assert.Equal(t, motto.ErrorJobNotFound, Q.Heartbeat(stuck, 0))
+
+	job, _ := Q.Dequeue()
+	assert.Equal(t, "stuck", job.Payload)
+	assert.Equal(t, int64(1), job.Attempts)
+
+	// The reaped job now belongs to its new worker, the first one can no longer settle it
+	assert.Equal(t, motto.ErrorJobLeaseLost, Q.Heartbeat(stuck, 0))
+	assert.Equal(t, motto.ErrorJobLeaseLost, Q.Complete(stuck))
+	assert.Equal(t, motto.ErrorJobLeaseLost, Q.Fail(stuck))
+
+	assert.Nil(t, Q.Complete(slow))
+	assert.Equal(t, motto.ErrorJobNotFound, Q.Heartbeat(slow, 0))
+
+	stats, _ := Q.Stats()
+	assert.Equal(t, int64(1), stats.Working)
+	assert.Equal(t, int64(0), stats.Failure)
+
+	assert.Nil(t, Q.Complete(job))
+}
+
+func testQueuePriorities(t *testing.T, Q *motto.Queue) {
+	assert.Nil(t, Q.Enqueue(&motto.Job{Payload: "low", Priority: motto.PriorityLow}))
+	assert.Nil(t, Q.Enqueue(&motto.Job{Payload: "normal"}))
+	assert.Nil(t, Q.Enqueue(&motto.Job{Payload: "high", Priority: motto.PriorityHigh}))
+	assert.Nil(t, Q.Enqueue(&motto.Job{Payload: "urgent", Priority: 100}))
+	assert.Nil(t, Q.Schedule(&motto.Job{Payload: "deferred", Priority: motto.PriorityHigh}, time.Now().Add(-time.Second)))
+
+	count, err := Q.Driver().ScheduleDeferred(Q.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+
+	stats, _ := Q.Stats()
+	assert.Equal(t, int64(5), stats.Pending)
+	assert.Equal(t, map[int]int64{
+		motto.PriorityCritical: 1,
+		motto.PriorityHigh:     2,
+		motto.PriorityNormal:   1,
+		motto.PriorityLow:      1,
+	}, stats.Priorities)
+	assert.Equal(t, "QueueStats (pending=5, working=0, failure=0, delayed=0, backlog=5, waiting=0, priorities=[critical=1 high=2 normal=1 low=1])", stats.String())
+
+	for _, payload := range []string{"urgent", "high", "deferred", "normal", "low"} {
+		job, err := Q.Dequeue()
+		assert.Nil(t, err)
+		assert.Equal(t, payload, job.Payload)
+	}
+}
+
+func testQueueUniqueJobs(t *testing.T, Q *motto.Queue) {
+	first := &motto.Job{Payload: "first", UniqueKey: "order:42", UniqueFor: 60}
+	assert.Nil(t, Q.Enqueue(first))
+
+	duplicate := &motto.Job{Payload: "duplicate", UniqueKey: "order:42"}
+	assert.Equal(t, motto.ErrorJobDuplicate, Q.Enqueue(duplicate))
+	assert.Equal(t, first.TraceID, duplicate.TraceID)
+
+	coalesced := &motto.Job{Payload: "coalesced", UniqueKey: "order:42", Coalesce: true}
+	assert.Nil(t, Q.Schedule(coalesced, time.Now().Add(time.Minute)))
+	assert.Equal(t, first.TraceID, coalesced.TraceID)
+
+	job, _ := Q.Dequeue()
+	assert.Equal(t, motto.ErrorJobDuplicate, Q.Enqueue(&motto.Job{UniqueKey: "order:42"}))
+
+	// Taken for a minute after completion
+	assert.Nil(t, Q.Complete(job))
+	assert.Equal(t, motto.ErrorJobDuplicate, Q.Enqueue(&motto.Job{UniqueKey: "order:42"}))
+
+	// Released at once on failure
+	other := &motto.Job{Payload: "other", UniqueKey: "order:43"}
+	assert.Nil(t, Q.Enqueue(other))
+	job, _ = Q.Dequeue()
+	assert.Nil(t, Q.Fail(job))
+	assert.Nil(t, Q.Enqueue(&motto.Job{UniqueKey: "order:43"}))
+
+	stats, _ := Q.Stats()
+	assert.Equal(t, int64(1), stats.Pending)
+	assert.Equal(t, int64(0), stats.Delayed)
+
+	// The failed job cannot be requeued while the new one holds its key
+	assert.Equal(t, motto.ErrorJobDuplicate, Q.RequeueFailed(job.TraceID))
+	ids, err := Q.RequeueAllFailed()
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+
+	failed, _ := Q.Failed(0, 10)
+	assert.Len(t, failed, 1)
+
+	job, _ = Q.Dequeue()
+	assert.Nil(t, Q.Complete(job))
+	assert.Nil(t, Q.RequeueFailed(failed[0].TraceID))
+}
+
+func testQueueBatches(t *testing.T, Q *motto.Queue) {
+	assert.Equal(t, motto.ErrorBatchEmpty, Q.EnqueueBatch(&motto.Batch{}))
+
+	batch := &motto.Batch{OnComplete: 10, OnFailure: 11, Payload: "report"}
+	assert.Nil(t, Q.EnqueueBatch(batch, &motto.Job{Type: 1}, &motto.Job{Type: 1}))
+	assert.NotEmpty(t, batch.ID)
+
+	first, _ := Q.Dequeue()
+	second, _ := Q.Dequeue()
+	assert.Equal(t, batch.ID, first.BatchID)
+
+	assert.Nil(t, Q.Complete(first))
+	assert.Nil(t, Q.Fail(second))
+
+	found, err := Q.Batch(batch.ID)
+	assert.Nil(t, err)
+	assert.True(t, found.Finished())
+	assert.Equal(t, int64(1), found.Succeeded)
+	assert.Equal(t, int64(1), found.Failed)
+
+	// Some jobs failed, the failure callback is queued
+	callback, err := Q.Dequeue()
+	assert.Nil(t, err)
+	assert.Equal(t, 11, callback.Type)
+	assert.Equal(t, "report", callback.Payload)
+	assert.Equal(t, batch.ID, callback.BatchID)
+	assert.Nil(t, Q.Complete(callback))
+
+	// Requeueing the failed job reopens the batch, it completes this time
+	assert.Nil(t, Q.RequeueFailed(second.TraceID))
+	found, _ = Q.Batch(batch.ID)
+	assert.False(t, found.Finished())
+
+	second, _ = Q.Dequeue()
+	assert.Nil(t, Q.Complete(second))
+
+	callback, _ = Q.Dequeue()
+	assert.Equal(t, 10, callback.Type)
+
+	_, err = Q.Batch("missing")
+	assert.Equal(t, motto.ErrorBatchNotFound, err)
+
+	// The callback is queued with the priority of the batch, ahead of normal jobs
+	urgent := &motto.Batch{OnComplete: 12, Priority: motto.PriorityHigh}
+	assert.Nil(t, Q.EnqueueBatch(urgent, &motto.Job{Type: 1}))
+
+	job, _ := Q.Dequeue()
+	assert.Nil(t, Q.Enqueue(&motto.Job{Type: 2}))
+	assert.Nil(t, Q.Complete(job))
+
+	callback, _ = Q.Dequeue()
+	assert.Equal(t, 12, callback.Type)
+	assert.Equal(t, motto.PriorityHigh, callback.Priority)
+
+	found, _ = Q.Batch(urgent.ID)
+	assert.Equal(t, motto.PriorityHigh, found.Priority)
+}
+
+func testQueueChains(t *testing.T, Q *motto.Queue) {
+	assert.Equal(t, motto.ErrorChainEmpty, Q.EnqueueChain(&motto.Chain{}))
+
+	chain := &motto.Chain{}
+	assert.Nil(t, Q.EnqueueChain(chain, &motto.Job{Type: 1, Payload: "a"}, &motto.Job{Type: 2}, &motto.Job{Type: 3}))
+	assert.Equal(t, 3, chain.Steps)
+
+	// The result of a step is the payload of the next one
+	job, _ := Q.Dequeue()
+	assert.Equal(t, 1, job.Type)
+	job.Result = "output of a"
+	assert.Nil(t, Q.Complete(job))
+
+	job, _ = Q.Dequeue()
+	assert.Equal(t, 2, job.Type)
+	assert.Equal(t, "output of a", job.Payload)
+
+	// A failed step halts the chain
+	job.LastError = "boom"
+	assert.Nil(t, Q.Fail(job))
+
+	found, err := Q.Chain(chain.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, motto.ChainFailed, found.Status)
+	assert.Equal(t, 1, found.Step)
+	assert.Equal(t, job.TraceID, found.JobID)
+	assert.Equal(t, "boom", found.LastError)
+
+	assertQueueEmpty(t, Q)
+
+	// Requeueing the failed step resumes the chain
+	assert.Nil(t, Q.RequeueFailed(job.TraceID))
+	found, _ = Q.Chain(chain.ID)
+	assert.Equal(t, motto.ChainRunning, found.Status)
+
+	job, _ = Q.Dequeue()
+	assert.Nil(t, Q.Complete(job))
+	job, _ = Q.Dequeue()
+	assert.Equal(t, 3, job.Type)
+	assert.Nil(t, Q.Complete(job))
+
+	found, _ = Q.Chain(chain.ID)
+	assert.Equal(t, motto.ChainCompleted, found.Status)
+	assert.Equal(t, 2, found.Step)
+
+	_, err = Q.Chain("missing")
+	assert.Equal(t, motto.ErrorChainNotFound, err)
+}
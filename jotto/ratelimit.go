@@ -0,0 +1,210 @@
+package jotto
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Rate limiting algorithms
+const (
+	// RateLimitFixedWindow - at most `Limit` requests per `Period`, the window starts with the first request
+	RateLimitFixedWindow = "fixed-window"
+
+	// RateLimitSlidingWindow - at most `Limit` requests in any `Period`, keeping a log of request times
+	RateLimitSlidingWindow = "sliding-window"
+
+	// RateLimitTokenBucket - `Limit` tokens refilled per `Period`, up to `Burst` tokens
+	RateLimitTokenBucket = "token-bucket"
+)
+
+// RateLimit describes how many requests are allowed
+type RateLimit struct {
+	// Algorithm - one of the RateLimit* algorithms, defaults to RateLimitFixedWindow
+	Algorithm string
+	// Limit - the number of requests allowed per `Period`
+	Limit int64
+	// Period - the length of the window, or the time to refill `Limit` tokens
+	Period time.Duration
+	// Burst - the capacity of the token bucket, defaults to `Limit`
+	Burst int64
+}
+
+// burst - the capacity of the token bucket
+func (rl *RateLimit) burst() int64 {
+	if rl.Burst > 0 {
+		return rl.Burst
+	}
+	return rl.Limit
+}
+
+// RateLimitResult - the outcome of a rate limited request
+type RateLimitResult struct {
+	Allowed bool
+	// Remaining - how many more requests are allowed right now
+	Remaining int64
+	// RetryAfter - when not allowed, how long until the next request may be allowed
+	RetryAfter time.Duration
+}
+
+// RateLimiter limits requests per key with a RateLimit, keeping its state in
+// a CacheDriver. Every check is a single atomic operation on the driver.
+//
+//	limiter := jotto.NewAppRateLimiter(app, "default", "login", &jotto.RateLimit{
+//		Algorithm: jotto.RateLimitSlidingWindow,
+//		Limit:     5,
+//		Period:    time.Minute,
+//	})
+//	result, err := limiter.Allow(username)
+type RateLimiter struct {
+	cache cacheRef
+	name  string
+	limit RateLimit
+}
+
+// NewRateLimiter - create a rate limiter, `name` scopes its keys in the cache
+func NewRateLimiter(cache CacheDriver, name string, limit *RateLimit) *RateLimiter {
+	return newRateLimiter(cacheRef{driver: cache}, name, limit)
+}
+
+// NewAppRateLimiter - create a rate limiter keeping its state in the cache of `app`
+// named `cache`, looked up for every call so that it follows the cache across reloads
+func NewAppRateLimiter(app Application, cache string, name string, limit *RateLimit) *RateLimiter {
+	return newRateLimiter(cacheRef{app: app, name: cache}, name, limit)
+}
+
+func newRateLimiter(cache cacheRef, name string, limit *RateLimit) *RateLimiter {
+	rl := &RateLimiter{
+		cache: cache,
+		name:  name,
+		limit: *limit,
+	}
+
+	if rl.limit.Algorithm == "" {
+		rl.limit.Algorithm = RateLimitFixedWindow
+	}
+
+	return rl
+}
+
+// Allow - count a request for `key` and check whether it is allowed
+func (rl *RateLimiter) Allow(key string) (*RateLimitResult, error) {
+	return rl.cache.get().Throttle(rl.Key(key), &rl.limit)
+}
+
+// Reset - forget the requests counted for `key`
+func (rl *RateLimiter) Reset(key string) error {
+	_, err := rl.cache.get().Del(rl.Key(key))
+
+	return err
+}
+
+// Key - the cache key holding the state of `key`
+func (rl *RateLimiter) Key(key string) string {
+	return "ratelimit:" + rl.name + ":" + key
+}
+
+// validate - check that `limit` can be enforced
+func (limit *RateLimit) validate() error {
+	if limit.Limit <= 0 || limit.Period <= 0 {
+		return fmt.Errorf("invalid rate limit: %d per %s", limit.Limit, limit.Period)
+	}
+
+	switch limit.Algorithm {
+	case "", RateLimitFixedWindow, RateLimitSlidingWindow, RateLimitTokenBucket:
+		return nil
+	}
+
+	return fmt.Errorf("unknown rate limit algorithm: %s", limit.Algorithm)
+}
+
+// Rate limit scopes of the middleware
+const (
+	// RateLimitPerRoute - each route has its own limit
+	RateLimitPerRoute = "route"
+
+	// RateLimitPerGroup - routes of the same `Route.Group()` share a limit
+	RateLimitPerGroup = "group"
+)
+
+// RateLimitOptions - options of the rate limiting middleware
+type RateLimitOptions struct {
+	RateLimit
+
+	// Cache - the name of the cache holding the counters
+	Cache string
+	// Scope - RateLimitPerRoute (default), RateLimitPerGroup or any fixed name shared by processors
+	Scope string
+	// Key - extract the key to limit by (e.g. user ID, client IP) from the request,
+	// all requests in the scope share one limit when nil
+	Key func(ctx context.Context, request interface{}) string
+	// Code - the code returned when the request is limited, defaults to 429
+	Code int32
+	// FailClosed - reject requests when the cache cannot be reached, instead of letting them through
+	FailClosed bool
+}
+
+// NewRateLimitMiddleware - create a middleware that rejects requests over the limit.
+// Under HTTP a `Retry-After` header is attached to rejected requests.
+func NewRateLimitMiddleware(options *RateLimitOptions) Middleware {
+	code := options.Code
+	if code == 0 {
+		code = 429
+	}
+
+	scope := options.Scope
+	if scope == "" {
+		scope = RateLimitPerRoute
+	}
+
+	return func(ctx context.Context, app Application, request, response interface{}, next MiddlewareChainer) (int32, context.Context) {
+		key := rateLimitScope(ctx, scope)
+		if options.Key != nil {
+			key += ":" + options.Key(ctx, request)
+		}
+
+		result, err := NewRateLimiter(app.Cache(options.Cache), "middleware", &options.RateLimit).Allow(key)
+
+		if err != nil {
+			GetLogger(ctx).Errorf("motto|rate_limit|failed_to_check_limit|key=%s,err=%v", key, err)
+
+			if options.FailClosed {
+				return code, ctx
+			}
+
+			return next(ctx)
+		}
+
+		if !result.Allowed {
+			if GetHTTPRequest(ctx) != nil {
+				headers := map[string]string{}
+				if existing, ok := ctx.Value(CtxHTTPResponseHeaders).(map[string]string); ok {
+					for k, v := range existing {
+						headers[k] = v
+					}
+				}
+				headers["Retry-After"] = strconv.FormatInt(int64((result.RetryAfter+time.Second-1)/time.Second), 10)
+				ctx = context.WithValue(ctx, CtxHTTPResponseHeaders, headers)
+			}
+
+			return code, ctx
+		}
+
+		return next(ctx)
+	}
+}
+
+// rateLimitScope - the part of the key identifying the limited routes
+func rateLimitScope(ctx context.Context, scope string) string {
+	route := GetRoute(ctx)
+
+	switch {
+	case scope == RateLimitPerRoute && route != nil:
+		return fmt.Sprintf("route:%d:%s:%s", route.ID(), route.Method(), route.URI())
+	case scope == RateLimitPerGroup && route != nil:
+		return "group:" + route.Group()
+	}
+
+	return scope
+}
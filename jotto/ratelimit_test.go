@@ -0,0 +1,81 @@
+package motto_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.garena.com/duanzy/motto/motto"
+)
+
+func TestRateLimiterAlgorithms(t *testing.T) {
+	cache := motto.NewMemoryDriver("mem", nil)
+	defer cache.Close()
+
+	for _, algorithm := range []string{motto.RateLimitFixedWindow, motto.RateLimitSlidingWindow, motto.RateLimitTokenBucket} {
+		limiter := motto.NewRateLimiter(cache, algorithm, &motto.RateLimit{
+			Algorithm: algorithm,
+			Limit:     3,
+			Period:    time.Millisecond * 100,
+		})
+
+		for i := int64(0); i < 3; i++ {
+			result, err := limiter.Allow("user")
+			assert.Nil(t, err, algorithm)
+			assert.True(t, result.Allowed, algorithm)
+			assert.Equal(t, 2-i, result.Remaining, algorithm)
+		}
+
+		result, _ := limiter.Allow("user")
+		assert.False(t, result.Allowed, algorithm)
+		assert.True(t, result.RetryAfter > 0 && result.RetryAfter <= time.Millisecond*100, algorithm)
+
+		// Other keys have their own limit
+		result, _ = limiter.Allow("other")
+		assert.True(t, result.Allowed, algorithm)
+
+		time.Sleep(result.RetryAfter + time.Millisecond*110)
+		result, _ = limiter.Allow("user")
+		assert.True(t, result.Allowed, algorithm)
+
+		assert.Nil(t, limiter.Reset("user"))
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	cfg := motto.NewDefaultSettings()
+	cfg.Motto().Cache = []*motto.CacheSettings{{Name: "mem", Driver: "memory"}}
+	app := motto.NewApplication(cfg, nil, nil, nil)
+	app.Boot()
+
+	limit := motto.NewRateLimitMiddleware(&motto.RateLimitOptions{
+		RateLimit: motto.RateLimit{Limit: 1, Period: time.Minute},
+		Cache:     "mem",
+		Scope:     motto.RateLimitPerGroup,
+		Key: func(ctx context.Context, request interface{}) string {
+			return request.(string)
+		},
+		Code: 42,
+	})
+
+	processor := motto.NewProcessor(nil, nil, func(ctx context.Context, app motto.Application, request, response interface{}) (int32, context.Context) {
+		return 0, ctx
+	}, []motto.Middleware{limit})
+
+	serve := func(route motto.Route, user string) int32 {
+		ctx := context.WithValue(context.Background(), motto.CtxRoute, route)
+		code, _ := app.Execute(ctx, processor, user, nil)
+		return code
+	}
+
+	first := motto.NewRoute(1, "GET", "/a", "api")
+	second := motto.NewRoute(2, "GET", "/b", "api")
+	other := motto.NewRoute(3, "GET", "/c", "admin")
+
+	assert.Equal(t, int32(0), serve(first, "alice"))
+	assert.Equal(t, int32(42), serve(second, "alice"))
+	assert.Equal(t, int32(0), serve(second, "bob"))
+	assert.Equal(t, int32(0), serve(other, "alice"))
+}
@@ -0,0 +1,61 @@
+package motto_test
+
+import (
+	"os"
+	"testing"
+
+	"git.garena.com/duanzy/motto/motto"
+)
+
+// newRedisQueue - a queue on the Redis server at $MOTTO_TEST_REDIS, the test
+// is skipped when it is not set. Every queue gets a fresh name and is
+// truncated when the test ends.
+func newRedisQueue(t *testing.T, settings *motto.RedisSettings) *motto.Queue {
+	address := os.Getenv("MOTTO_TEST_REDIS")
+	if address == "" {
+		t.Skip("MOTTO_TEST_REDIS is not set")
+	}
+
+	if settings == nil {
+		settings = &motto.RedisSettings{}
+	}
+	settings.Address = address
+
+	driver := motto.NewRedisDriver("redis", settings)
+	Q := motto.NewQueue("motto_test:"+motto.GenerateTraceID(), driver)
+
+	t.Cleanup(func() {
+		driver.Truncate(Q.Name())
+		driver.Close()
+	})
+
+	return Q
+}
+
+func TestRedisQueueEnqueueDequeueComplete(t *testing.T) {
+	testQueueEnqueueDequeueComplete(t, newRedisQueue(t, nil))
+}
+
+func TestRedisQueueDeadLetters(t *testing.T) {
+	testQueueDeadLetters(t, newRedisQueue(t, nil))
+}
+
+func TestRedisQueueLeases(t *testing.T) {
+	testQueueLeases(t, newRedisQueue(t, &motto.RedisSettings{VisibilityTimeout: 1}))
+}
+
+func TestRedisQueuePriorities(t *testing.T) {
+	testQueuePriorities(t, newRedisQueue(t, nil))
+}
+
+func TestRedisQueueUniqueJobs(t *testing.T) {
+	testQueueUniqueJobs(t, newRedisQueue(t, nil))
+}
+
+func TestRedisQueueBatches(t *testing.T) {
+	testQueueBatches(t, newRedisQueue(t, nil))
+}
+
+func TestRedisQueueChains(t *testing.T) {
+	testQueueChains(t, newRedisQueue(t, nil))
+}
@@ -0,0 +1,105 @@
+package jotto
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+// RedisRegistry shares Redis clients between drivers: drivers created with
+// identical connection settings use the same client and connection pool.
+// A client is closed once the last driver using it is closed.
+type RedisRegistry struct {
+	mutex   sync.Mutex
+	clients map[string]*redisConnection
+}
+
+type redisConnection struct {
+	client redis.UniversalClient
+	refs   int
+}
+
+// NewRedisRegistry - create an empty registry
+func NewRedisRegistry() *RedisRegistry {
+	return &RedisRegistry{
+		clients: make(map[string]*redisConnection),
+	}
+}
+
+// Driver - create a Redis driver named `name`, sharing the client of
+// drivers with the same connection settings
+func (r *RedisRegistry) Driver(name string, settings *RedisSettings) *RedisDriver {
+	fingerprint := redisFingerprint(settings)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	connection, ok := r.clients[fingerprint]
+	if !ok {
+		connection = &redisConnection{client: redis.NewUniversalClient(redisOptions(settings))}
+		r.clients[fingerprint] = connection
+	}
+	connection.refs++
+
+	rd := newRedisDriver(name, settings, connection.client)
+	rd.release = func() error {
+		return r.release(fingerprint)
+	}
+
+	return rd
+}
+
+// release - drop a reference to a client, closing it when it is no longer used
+func (r *RedisRegistry) release(fingerprint string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	connection, ok := r.clients[fingerprint]
+	if !ok {
+		return nil
+	}
+
+	if connection.refs--; connection.refs > 0 {
+		return nil
+	}
+
+	delete(r.clients, fingerprint)
+
+	return connection.client.Close()
+}
+
+// Len - the number of open clients
+func (r *RedisRegistry) Len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return len(r.clients)
+}
+
+// Close - close every client, whether drivers still use them or not
+func (r *RedisRegistry) Close() (err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for fingerprint, connection := range r.clients {
+		if er := connection.client.Close(); er != nil && err == nil {
+			err = er
+		}
+		delete(r.clients, fingerprint)
+	}
+
+	return
+}
+
+// redisFingerprint - identify the connection described by `settings`,
+// leaving out the options that only change how a driver uses it
+func redisFingerprint(settings *RedisSettings) string {
+	connection := *settings
+	connection.Blocking = false
+	connection.VisibilityTimeout = 0
+
+	fingerprint, _ := json.Marshal(&connection)
+
+	return string(fingerprint)
+}
@@ -0,0 +1,33 @@
+package motto_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.garena.com/duanzy/motto/motto"
+)
+
+func TestRedisRegistrySharesClients(t *testing.T) {
+	registry := motto.NewRedisRegistry()
+
+	settings := &motto.RedisSettings{Address: "127.0.0.1:6379"}
+
+	first := registry.Driver("first", settings)
+	second := registry.Driver("second", &motto.RedisSettings{Address: "127.0.0.1:6379", Blocking: true})
+	other := registry.Driver("other", &motto.RedisSettings{Address: "127.0.0.1:6379", Database: 1})
+
+	assert.Equal(t, 2, registry.Len())
+	assert.Same(t, first.Client(), second.Client())
+	assert.NotSame(t, first.Client(), other.Client())
+
+	assert.Nil(t, first.Close())
+	assert.Nil(t, first.Close())
+	assert.Equal(t, 2, registry.Len())
+
+	assert.Nil(t, second.Close())
+	assert.Equal(t, 1, registry.Len())
+
+	assert.Nil(t, registry.Close())
+	assert.Equal(t, 0, registry.Len())
+}
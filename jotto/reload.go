@@ -0,0 +1,99 @@
+package jotto
+
+import (
+	"encoding/json"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// defaultDrainTimeout - how long a reload waits for the operations running
+// on replaced drivers before closing them anyway
+const defaultDrainTimeout = 30 * time.Second
+
+// inflight counts the operations running on a driver, so that a driver
+// replaced on reload is only closed once they are done
+type inflight struct {
+	count int64
+}
+
+// enter - count an operation as running
+func (i *inflight) enter() {
+	atomic.AddInt64(&i.count, 1)
+}
+
+// leave - count an operation as done
+func (i *inflight) leave() {
+	atomic.AddInt64(&i.count, -1)
+}
+
+// drain - wait until no operation is running, or `deadline` is reached
+func (i *inflight) drain(deadline time.Time) bool {
+	for atomic.LoadInt64(&i.count) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return true
+}
+
+// cacheRef - a cache driver, either held or looked up in an application for
+// every call so that it follows the caches replaced on reload
+type cacheRef struct {
+	driver CacheDriver
+	app    Application
+	name   string
+}
+
+// get - the driver to call
+func (r *cacheRef) get() CacheDriver {
+	if r.app != nil {
+		return r.app.Cache(r.name)
+	}
+	return r.driver
+}
+
+// settingsFingerprint - identify the settings of a cache or queue instance,
+// an instance is only recreated on reload when its fingerprint changes
+func settingsFingerprint(settings interface{}) string {
+	fingerprint, _ := json.Marshal(settings)
+
+	return string(fingerprint)
+}
+
+// retire - wait for the operations running on replaced caches and queues,
+// then close their drivers, except those still used by the current queues.
+// Only running operations are waited for, counted by the MetricsDriver every
+// cache is wrapped in and by the Queue; see Application.Cache for holders.
+func (app *BaseApplication) retire(caches map[string]CacheDriver, queues map[string]*Queue, keep map[QueueDriver]bool) {
+	timeout := defaultDrainTimeout
+	if seconds := app.settings.Motto().DrainTimeout; seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+
+	logger := app.MakeLogger(nil)
+
+	for name, driver := range caches {
+		if md, ok := driver.(*MetricsDriver); ok && !md.inflight.drain(deadline) {
+			logger.Errorf("motto|reload|drain_timeout|cache=%s", name)
+		}
+		if closer, ok := driver.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+
+	for name, queue := range queues {
+		if !queue.inflight.drain(deadline) {
+			logger.Errorf("motto|reload|drain_timeout|queue=%s", name)
+		}
+	}
+	for _, queue := range queues {
+		if closer, ok := queue.Driver().(io.Closer); ok && !keep[queue.Driver()] {
+			keep[queue.Driver()] = true
+			closer.Close()
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package jotto
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff strategies of a RetryPolicy
+const (
+	// BackoffFixed - wait `Delay` before every retry
+	BackoffFixed = "fixed"
+
+	// BackoffLinear - wait `Delay` times the number of attempts
+	BackoffLinear = "linear"
+
+	// BackoffExponential - wait `Delay`, doubled after every attempt
+	BackoffExponential = "exponential"
+)
+
+// DefaultRetryPolicy - the policy of job types without one: up to 10 retries,
+// waiting 2^n seconds after the nth attempt
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxAttempts: 11,
+	Backoff:     BackoffExponential,
+	Delay:       2 * time.Second,
+}
+
+// maxRetryDelay - the longest delay NextDelay returns, far below the largest
+// time.Duration so that converting from float64 cannot overflow
+const maxRetryDelay = time.Duration(1 << 62)
+
+// RetryPolicy decides whether and when a failed job is attempted again.
+// A non-zero `Job.RetryTimes` overrides `MaxAttempts` for that job, allowing
+// as many retries after the first attempt.
+//
+//	app.SetRetryPolicy(JobSendMail, &jotto.RetryPolicy{
+//		MaxAttempts:  5,
+//		Backoff:      jotto.BackoffExponential,
+//		Delay:        time.Second,
+//		MaxDelay:     time.Minute,
+//		Jitter:       0.2,
+//		NonRetryable: []error{ErrorInvalidAddress},
+//	})
+type RetryPolicy struct {
+	// MaxAttempts - the number of attempts, including the first one, before a job fails,
+	// defaults to the attempts of DefaultRetryPolicy
+	MaxAttempts int64
+	// Backoff - one of the Backoff* strategies, defaults to BackoffExponential
+	Backoff string
+	// Delay - the base delay of the backoff strategy, defaults to the delay of DefaultRetryPolicy
+	Delay time.Duration
+	// MaxDelay - the longest delay between two attempts, unlimited when zero
+	MaxDelay time.Duration
+	// Jitter - the fraction, between 0 and 1, of the delay randomly taken off
+	Jitter float64
+	// NonRetryable - errors failing the job at once, matched with errors.Is
+	NonRetryable []error
+	// Retryable - classify the other errors, all of them are retried when nil
+	Retryable func(err error) bool
+}
+
+// ShouldRetry - check whether `job` is to be attempted again after failing with `err`
+func (rp *RetryPolicy) ShouldRetry(job *Job, err error) bool {
+	if err == ErrorJobMustRetry {
+		return true
+	}
+
+	for _, permanent := range rp.NonRetryable {
+		if errors.Is(err, permanent) {
+			return false
+		}
+	}
+
+	if rp.Retryable != nil && !rp.Retryable(err) {
+		return false
+	}
+
+	maxAttempts := rp.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if job.RetryTimes > 0 {
+		maxAttempts = job.RetryTimes + 1
+	}
+
+	return job.Attempts < maxAttempts
+}
+
+// NextDelay - how long to wait before attempting a job again after `attempts` attempts
+func (rp *RetryPolicy) NextDelay(attempts int64) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	delay := float64(rp.Delay)
+	if delay <= 0 {
+		delay = float64(DefaultRetryPolicy.Delay)
+	}
+
+	switch rp.Backoff {
+	case BackoffFixed:
+	case BackoffLinear:
+		delay *= float64(attempts)
+	default:
+		delay *= math.Pow(2, float64(attempts-1))
+	}
+
+	if rp.MaxDelay > 0 && delay > float64(rp.MaxDelay) {
+		delay = float64(rp.MaxDelay)
+	}
+	if delay > float64(maxRetryDelay) {
+		delay = float64(maxRetryDelay)
+	}
+
+	if rp.Jitter > 0 {
+		delay -= delay * math.Min(rp.Jitter, 1) * rand.Float64()
+	}
+
+	return time.Duration(delay)
+}
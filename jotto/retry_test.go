@@ -0,0 +1,71 @@
+package motto_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.garena.com/duanzy/motto/motto"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	cases := []struct {
+		policy   motto.RetryPolicy
+		attempts int64
+		delay    time.Duration
+	}{
+		{motto.RetryPolicy{Backoff: motto.BackoffFixed, Delay: time.Second}, 5, time.Second},
+		{motto.RetryPolicy{Backoff: motto.BackoffLinear, Delay: time.Second}, 3, 3 * time.Second},
+		{motto.RetryPolicy{Backoff: motto.BackoffExponential, Delay: time.Second}, 4, 8 * time.Second},
+		{motto.RetryPolicy{Backoff: motto.BackoffExponential, Delay: time.Second, MaxDelay: 5 * time.Second}, 4, 5 * time.Second},
+		{motto.RetryPolicy{Backoff: motto.BackoffExponential, Delay: time.Second, MaxDelay: time.Hour}, 1000, time.Hour},
+		{motto.RetryPolicy{Backoff: motto.BackoffExponential, Delay: time.Second}, 1000, time.Duration(1 << 62)},
+		{motto.RetryPolicy{Backoff: motto.BackoffLinear, Delay: time.Hour}, 1 << 40, time.Duration(1 << 62)},
+		{*motto.DefaultRetryPolicy, 3, 8 * time.Second},
+		{motto.RetryPolicy{MaxAttempts: 3}, 2, 4 * time.Second},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.delay, c.policy.NextDelay(c.attempts))
+	}
+
+	jittered := &motto.RetryPolicy{Backoff: motto.BackoffFixed, Delay: time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		delay := jittered.NextDelay(1)
+		assert.True(t, delay > 500*time.Millisecond && delay <= time.Second, delay)
+	}
+}
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	permanent := errors.New("invalid payload")
+
+	policy := &motto.RetryPolicy{
+		MaxAttempts:  3,
+		NonRetryable: []error{permanent},
+		Retryable: func(err error) bool {
+			return err.Error() != "gone"
+		},
+	}
+
+	job := &motto.Job{Attempts: 2}
+	assert.True(t, policy.ShouldRetry(job, errors.New("timeout")))
+	assert.False(t, policy.ShouldRetry(job, fmt.Errorf("decode: %w", permanent)))
+	assert.False(t, policy.ShouldRetry(job, errors.New("gone")))
+
+	job.Attempts = 3
+	assert.False(t, policy.ShouldRetry(job, errors.New("timeout")))
+	assert.True(t, policy.ShouldRetry(job, motto.ErrorJobMustRetry))
+
+	job.RetryTimes = 5
+	assert.True(t, policy.ShouldRetry(job, errors.New("timeout")))
+	job.Attempts = 6
+	assert.False(t, policy.ShouldRetry(job, errors.New("timeout")))
+
+	// Without MaxAttempts, the attempts of the default policy apply
+	unbounded := &motto.RetryPolicy{}
+	assert.True(t, unbounded.ShouldRetry(&motto.Job{Attempts: 10}, errors.New("timeout")))
+	assert.False(t, unbounded.ShouldRetry(&motto.Job{Attempts: 11}, errors.New("timeout")))
+}
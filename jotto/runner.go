@@ -7,12 +7,12 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math"
 	"net"
 	"net/http"
 	"os"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -39,6 +39,7 @@ func NewRunner(protocol string) (runner Runner) {
 	case TCP:
 		runner = &TcpRunner{
 			routes: make(map[uint32]Processor),
+			info:   make(map[uint32]Route),
 			alive:  true,
 			wg:     &sync.WaitGroup{},
 		}
@@ -112,13 +113,17 @@ func (r *HttpRunner) Attach(app Application) (err error) {
 
 	for route, processor := range app.Routes() {
 		// Setup HTTP router
-		r.router.HandleFunc(route.URI(), r.handler(processor, app)).Methods(route.Method())
+		r.router.HandleFunc(route.URI(), r.handler(route, processor, app)).Methods(route.Method())
+	}
+
+	if path := app.Settings().Motto().MetricsPath; path != "" {
+		r.router.Handle(path, app.Metrics()).Methods(http.MethodGet)
 	}
 
 	return
 }
 
-func (r *HttpRunner) handler(processor Processor, app Application) HttpHandler {
+func (r *HttpRunner) handler(route Route, processor Processor, app Application) HttpHandler {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		logger := app.MakeLogger(map[string]interface{}{
 			"trace_id": GenerateTraceID(),
@@ -136,6 +141,7 @@ func (r *HttpRunner) handler(processor Processor, app Application) HttpHandler {
 		ctx = context.WithValue(ctx, CtxHTTPResponse, writer)
 		ctx = context.WithValue(ctx, CtxLogger, logger)
 		ctx = context.WithValue(ctx, CtxTime, uint32(time.Now().Unix()))
+		ctx = context.WithValue(ctx, CtxRoute, route)
 		ctx = r.app.MakeContext(ctx, processor)
 
 		defer func() {
@@ -203,6 +209,7 @@ func (r *HttpRunner) respond(ctx context.Context, writer http.ResponseWriter, re
 type TcpRunner struct {
 	app    Application
 	routes map[uint32]Processor
+	info   map[uint32]Route
 	alive  bool
 	wg     *sync.WaitGroup
 }
@@ -214,6 +221,7 @@ func (r *TcpRunner) Attach(app Application) (err error) {
 	for route, processor := range app.Routes() {
 		// Setup TCP router
 		r.routes[route.ID()] = processor
+		r.info[route.ID()] = route
 	}
 
 	return
@@ -312,6 +320,7 @@ func (r *TcpRunner) worker(connection net.Conn) {
 			continue
 		}
 
+		ctx = context.WithValue(ctx, CtxRoute, r.info[kind])
 		ctx = r.app.MakeContext(ctx, processor)
 
 		message := proto.Clone(processor.Message())
@@ -397,24 +406,74 @@ func (r *CliRunner) help() {
 }
 
 func NewQueueWorkerRunner(queue string, size int) *QueueWorkerRunner {
+	return NewMultiQueueWorkerRunner(size, PollStrictPriority, &WorkerQueue{Name: queue})
+}
+
+// Polling policies of a QueueWorkerRunner consuming several queues
+const (
+	// PollStrictPriority - take the next job from the first queue that has one
+	PollStrictPriority = "strict-priority"
+
+	// PollWeightedRoundRobin - take jobs from the queues in proportion to their weight
+	PollWeightedRoundRobin = "weighted-round-robin"
+)
+
+// pollIdle - how long a runner consuming several queues waits once they are all empty
+const pollIdle = 100 * time.Millisecond
+
+// WorkerQueue is a queue consumed by a QueueWorkerRunner
+type WorkerQueue struct {
+	// Name - the name of the queue in `Application.Queue`
+	Name string
+	// Weight - the share of the jobs taken from the queue under PollWeightedRoundRobin, defaults to 1
+	Weight int
+	// Concurrency - at most that many jobs of the queue are processed at once, no cap when zero
+	Concurrency int
+}
+
+// workerQueue - a consumed queue along with its polling state and counters
+type workerQueue struct {
+	WorkerQueue
+
+	current   int   // the smooth weighted round robin counter
+	missing   bool  // the queue is not configured, only logged when first found missing
+	busy      int64 // jobs being processed
+	processed int64 // jobs processed so far
+}
+
+// NewMultiQueueWorkerRunner creates a runner consuming `queues` with one pool of `size` workers.
+// The queues are polled in turn, so a blocking queue delays the others by up to its read timeout.
+func NewMultiQueueWorkerRunner(size int, polling string, queues ...*WorkerQueue) *QueueWorkerRunner {
 	workers := make(chan bool, size)
 
 	for i := 0; i < size; i++ {
 		workers <- true
 	}
 
-	return &QueueWorkerRunner{
-		queue:   queue,
-		alive:   true,
+	r := &QueueWorkerRunner{
+		polling: polling,
+		alive:   1,
 		workers: workers,
 	}
+
+	for _, queue := range queues {
+		wq := &workerQueue{WorkerQueue: *queue}
+		if wq.Weight <= 0 {
+			wq.Weight = 1
+		}
+		r.queues = append(r.queues, wq)
+	}
+
+	return r
 }
 
 type QueueWorkerRunner struct {
 	app     Application
-	queue   string
-	alive   bool
+	queues  []*workerQueue
+	polling string
+	alive   int32 // set to zero on shutdown, read by the workers
 	workers chan bool
+	wg      sync.WaitGroup // the polling loop and the jobs being processed
 }
 
 func (r *QueueWorkerRunner) Attach(app Application) error {
@@ -430,11 +489,18 @@ func (r *QueueWorkerRunner) Run() error {
 		}
 	}()
 
-	Q := r.app.Queue(r.queue)
+	r.wg.Add(1)
+	defer r.wg.Done()
+
+	for _, wq := range r.queues {
+		if r.app.Queue(wq.Name) == nil {
+			return fmt.Errorf("queue %s is not configured", wq.Name)
+		}
+	}
 
 	go r.watcher()
 
-	for r.alive {
+	for r.running() {
 		logger := r.app.MakeLogger(map[string]interface{}{
 			"trace_id": GenerateTraceID(),
 		})
@@ -445,13 +511,13 @@ func (r *QueueWorkerRunner) Run() error {
 			continue
 		}
 
-		job, err := Q.Dequeue()
+		Q, job, done := r.poll(logger)
 
-		if err != nil {
-			if err != redis.Nil {
-				logger.Errorf("Pop job error: %v", err)
-			}
+		if job == nil {
 			r.release()
+			if len(r.queues) > 1 {
+				time.Sleep(pollIdle)
+			}
 			continue
 		}
 
@@ -461,19 +527,110 @@ func (r *QueueWorkerRunner) Run() error {
 
 		processor, ok := jobs[job.Type]
 
+		if !ok {
+			var callback QueueCallbackProcessor
+			if callback, ok = r.app.Callbacks()[job.Type]; ok {
+				processor = callback.processor()
+			}
+		}
+
 		if !ok {
 			logger.Errorf("Job processor not found for job %s", job.TraceID)
+			job.LastError = "job processor not found"
 			Q.Fail(job)
+			done()
 			r.release()
 			continue
 		}
 
-		go r.process(processor, job, r.app, logger, Q)
+		r.wg.Add(1)
+		go func(Q *Queue, job *Job, logger Logger) {
+			defer r.wg.Done()
+			defer done()
+			r.process(processor, job, r.app, logger, Q)
+		}(Q, job, logger)
 	}
 
 	return nil
 }
 
+// poll - dequeue a job from the first queue, in polling order, that has one and
+// is under its concurrency cap. The queue is held until `done` is called.
+func (r *QueueWorkerRunner) poll(logger Logger) (Q *Queue, job *Job, done func()) {
+	for _, wq := range r.order() {
+		if wq.Concurrency > 0 && atomic.LoadInt64(&wq.busy) >= int64(wq.Concurrency) {
+			continue
+		}
+
+		// Look the queue up for every job, it may be replaced on reload
+		Q = r.app.Queue(wq.Name)
+		if Q == nil {
+			if !wq.missing {
+				logger.Errorf("Queue %s is not configured anymore, skipping it until it is.", wq.Name)
+			}
+			wq.missing = true
+			continue
+		}
+		wq.missing = false
+		release := Q.hold()
+
+		job, err := Q.Dequeue()
+
+		if err != nil {
+			if err != redis.Nil && err != ErrorQueueEmpty {
+				logger.Errorf("Pop job error: %v (queue=%s)", err, wq.Name)
+			}
+			release()
+			continue
+		}
+
+		// Only this goroutine takes slots, checking then counting is safe
+		atomic.AddInt64(&wq.busy, 1)
+
+		return Q, job, func() {
+			atomic.AddInt64(&wq.busy, -1)
+			atomic.AddInt64(&wq.processed, 1)
+			release()
+		}
+	}
+
+	return nil, nil, nil
+}
+
+// order - the queues in the order they are polled for the next job
+func (r *QueueWorkerRunner) order() []*workerQueue {
+	if r.polling != PollWeightedRoundRobin || len(r.queues) < 2 {
+		return r.queues
+	}
+
+	// Smooth weighted round robin: the queue picked first is spread evenly
+	// over the polls, the others are tried when it has no job
+	var picked *workerQueue
+	total := 0
+	for _, wq := range r.queues {
+		wq.current += wq.Weight
+		total += wq.Weight
+		if picked == nil || wq.current > picked.current {
+			picked = wq
+		}
+	}
+	picked.current -= total
+
+	order := []*workerQueue{picked}
+	for _, wq := range r.queues {
+		if wq != picked {
+			order = append(order, wq)
+		}
+	}
+
+	return order
+}
+
+// running - whether the runner is not shut down
+func (r *QueueWorkerRunner) running() bool {
+	return atomic.LoadInt32(&r.alive) == 1
+}
+
 // Acquire a worker from pool
 func (r *QueueWorkerRunner) acquire(timeout time.Duration) bool {
 	select {
@@ -495,7 +652,12 @@ func (r *QueueWorkerRunner) release() bool {
 }
 
 func (r *QueueWorkerRunner) process(processor QueueProcessor, job *Job, app Application, logger Logger, Q *Queue) (err error) {
+	policy := app.RetryPolicy(job.Type)
+	stop := r.heartbeat(Q, job, logger)
+
 	defer func() {
+		stop()
+
 		er := Q.Attempt(job)
 
 		if er != nil {
@@ -512,17 +674,15 @@ func (r *QueueWorkerRunner) process(processor QueueProcessor, job *Job, app Appl
 			switch err {
 			case ErrorJobHandled: // ignore handled job
 				action = "ignore"
-			case ErrorJobMustRetry: // we must retry this job; use exponential backoff to attempt it later
-				perr = Q.Defer(job, r.backoff(job.Attempts))
-				action = "defer"
-			case nil: // auto complete
+			case nil: // auto complete, the next step of its chain is queued along
 				perr = Q.Complete(job)
 				action = "complete"
-			default: // auto retry on error
-				if job.Attempts <= 10 { // Backoff exponentially for 10 times
-					perr = Q.Defer(job, r.backoff(job.Attempts))
+			default: // retry on error as the policy of the job type allows, ErrorJobMustRetry is always retried
+				if policy.ShouldRetry(job, err) {
+					perr = Q.Defer(job, policy.NextDelay(job.Attempts))
 					action = "defer"
-				} else { // Failed 10 times in a row, giving up
+				} else { // Out of attempts or not retryable, giving up
+					job.LastError = err.Error()
 					perr = Q.Fail(job)
 					action = "fail"
 				}
@@ -536,10 +696,11 @@ func (r *QueueWorkerRunner) process(processor QueueProcessor, job *Job, app Appl
 			logger.Errorf("QueueWorkerRunner|process|panic=%v,stack=%s", ex, debug.Stack())
 
 			action := ""
-			if job.Attempts <= 10 { // Backoff exponentially for 10 times
-				err = Q.Defer(job, r.backoff(job.Attempts))
+			if crash := fmt.Errorf("panic: %v", ex); policy.ShouldRetry(job, crash) {
+				err = Q.Defer(job, policy.NextDelay(job.Attempts))
 				action = "defer"
-			} else { // Failed 10 times in a row, giving up
+			} else { // Out of attempts or not retryable, giving up
+				job.LastError = crash.Error()
 				err = Q.Fail(job)
 				action = "fail"
 			}
@@ -559,41 +720,113 @@ func (r *QueueWorkerRunner) process(processor QueueProcessor, job *Job, app Appl
 	return
 }
 
-func (r *QueueWorkerRunner) backoff(attempt int64) time.Duration {
-	return time.Second * time.Duration(math.Pow(2, float64(attempt)))
+// heartbeat - keep extending the lease of `job` while it is processed, every
+// third of the visibility timeout, until the returned func is called
+func (r *QueueWorkerRunner) heartbeat(Q *Queue, job *Job, logger Logger) (stop func()) {
+	timeout := Q.VisibilityTimeout()
+	if timeout <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(timeout / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := Q.Heartbeat(job, 0)
+				if err == nil {
+					continue
+				}
+
+				logger.Errorf("QueueWorkerRunner|heartbeat|failed_to_extend_lease|err=%v,job_id=%s", err, job.TraceID)
+				if err == ErrorJobNotFound || err == ErrorJobLeaseLost {
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
 }
 
 func (r *QueueWorkerRunner) watcher() {
-	Q := r.app.Queue(r.queue)
 	logger := r.app.MakeLogger(nil)
 
-	for r.alive {
-		stats, err := Q.Stats()
+	for r.running() {
+		for _, wq := range r.queues {
+			r.watch(wq, logger)
+		}
 
-		logger.Dataf("%+v", stats)
+		time.Sleep(time.Duration(1) * time.Second)
+	}
+}
 
-		if err == nil {
-			if stats.Waiting > 0 {
-				scheduled, err := Q.driver.ScheduleDeferred(Q.name)
+// watch - log the stats of a queue, schedule its deferred jobs and reap its expired leases
+func (r *QueueWorkerRunner) watch(wq *workerQueue, logger Logger) {
+	Q := r.app.Queue(wq.Name)
+	if Q == nil {
+		return
+	}
+	done := Q.hold()
+	defer done()
 
-				if err == nil {
-					logger.Dataf("Queue: scheduled %d jobs.", scheduled)
-				} else {
-					logger.Errorf("Queue: failed to schedule deferred jobs. (err=%v)", err)
-				}
-			}
+	stats, err := Q.Stats()
+
+	logger.Dataf("queue=%s,busy=%d,processed=%d,stats=%+v", wq.Name, atomic.LoadInt64(&wq.busy), atomic.LoadInt64(&wq.processed), stats)
+
+	if err != nil {
+		logger.Errorf("Queue %s: failed to retrieve queue stats. (err=%v)", wq.Name, err)
+		return
+	}
+
+	if stats.Waiting > 0 {
+		scheduled, err := Q.driver.ScheduleDeferred(Q.name)
+
+		if err == nil {
+			logger.Dataf("Queue %s: scheduled %d jobs.", wq.Name, scheduled)
 		} else {
-			logger.Errorf("Queue: failed to retrieve queue stats. (err=%v)", err)
+			logger.Errorf("Queue %s: failed to schedule deferred jobs. (err=%v)", wq.Name, err)
 		}
+	}
+	if stats.Working > 0 {
+		reaped, err := Q.Reap()
 
-		time.Sleep(time.Duration(1) * time.Second)
+		if err != nil {
+			logger.Errorf("Queue %s: failed to reap expired jobs. (err=%v)", wq.Name, err)
+		} else if reaped > 0 {
+			logger.Dataf("Queue %s: requeued %d jobs whose lease expired.", wq.Name, reaped)
+		}
 	}
 }
 
-// Shutdown - shutdown the runner
+// Shutdown - stop polling and wait, up to `timeout`, for the jobs being processed
 func (r *QueueWorkerRunner) Shutdown(timeout time.Duration) error {
-	r.alive = false
-	return nil
+	atomic.StoreInt32(&r.alive, 0)
+
+	c := make(chan struct{})
+	go func() {
+		defer close(c)
+		r.wg.Wait()
+	}()
+
+	select {
+	case <-c:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("Shutdown wait timeout")
+	}
 }
 
 // SpexRunner - run the application in Spex
@@ -0,0 +1,217 @@
+package motto_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.garena.com/duanzy/motto/motto"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// runQueues - process the jobs queued by `enqueue` into queues "a" and "b"
+// with `runner`, returning the queue of each job in processing order
+func runQueues(t *testing.T, runner *motto.QueueWorkerRunner, jobs int, processing time.Duration, enqueue func(a, b *motto.Queue)) (order []string, busiest map[string]int) {
+	cfg := motto.NewDefaultSettings()
+	cfg.Motto().Queue = []*motto.QueueSettings{
+		{Name: "memory", Driver: "memory", Queues: []string{"a", "b"}, Memory: &motto.MemorySettings{}},
+	}
+
+	var mutex sync.Mutex
+	busy := map[string]int{}
+	busiest = map[string]int{}
+	processed := make(chan struct{}, jobs)
+
+	processor := func(Q *motto.Queue, job *motto.Job, app motto.Application, logger motto.Logger) error {
+		mutex.Lock()
+		order = append(order, job.Payload)
+		busy[job.Payload]++
+		if busy[job.Payload] > busiest[job.Payload] {
+			busiest[job.Payload] = busy[job.Payload]
+		}
+		mutex.Unlock()
+
+		time.Sleep(processing)
+
+		mutex.Lock()
+		busy[job.Payload]--
+		mutex.Unlock()
+
+		processed <- struct{}{}
+		return nil
+	}
+
+	app := motto.NewApplication(cfg, nil, map[int]motto.QueueProcessor{1: processor}, runner)
+	defer app.Close()
+	assert.Nil(t, app.Boot())
+
+	enqueue(app.Queue("memory:a"), app.Queue("memory:b"))
+
+	go app.Run()
+	defer runner.Shutdown(time.Second)
+
+	for i := 0; i < jobs; i++ {
+		select {
+		case <-processed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("processed %d jobs out of %d", i, jobs)
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return append([]string{}, order...), busiest
+}
+
+func TestMultiQueueWorkerRunnerStrictPriority(t *testing.T) {
+	runner := motto.NewMultiQueueWorkerRunner(1, motto.PollStrictPriority,
+		&motto.WorkerQueue{Name: "memory:a"},
+		&motto.WorkerQueue{Name: "memory:b"},
+	)
+
+	order, _ := runQueues(t, runner, 6, 0, func(a, b *motto.Queue) {
+		for i := 0; i < 3; i++ {
+			b.Enqueue(&motto.Job{Type: 1, Payload: "b"})
+			a.Enqueue(&motto.Job{Type: 1, Payload: "a"})
+		}
+	})
+
+	assert.Equal(t, []string{"a", "a", "a", "b", "b", "b"}, order)
+}
+
+func TestMultiQueueWorkerRunnerWeightedRoundRobin(t *testing.T) {
+	runner := motto.NewMultiQueueWorkerRunner(1, motto.PollWeightedRoundRobin,
+		&motto.WorkerQueue{Name: "memory:a", Weight: 2},
+		&motto.WorkerQueue{Name: "memory:b"},
+	)
+
+	order, _ := runQueues(t, runner, 8, 0, func(a, b *motto.Queue) {
+		for i := 0; i < 4; i++ {
+			a.Enqueue(&motto.Job{Type: 1, Payload: "a"})
+			b.Enqueue(&motto.Job{Type: 1, Payload: "b"})
+		}
+	})
+
+	// Two jobs of "a" for one of "b", then "b" alone once "a" is drained
+	assert.Equal(t, []string{"a", "b", "a", "a", "b", "a", "b", "b"}, order)
+}
+
+func TestMultiQueueWorkerRunnerConcurrency(t *testing.T) {
+	runner := motto.NewMultiQueueWorkerRunner(4, motto.PollStrictPriority,
+		&motto.WorkerQueue{Name: "memory:a", Concurrency: 1},
+		&motto.WorkerQueue{Name: "memory:b"},
+	)
+
+	_, busiest := runQueues(t, runner, 12, 20*time.Millisecond, func(a, b *motto.Queue) {
+		for i := 0; i < 6; i++ {
+			a.Enqueue(&motto.Job{Type: 1, Payload: "a"})
+			b.Enqueue(&motto.Job{Type: 1, Payload: "b"})
+		}
+	})
+
+	assert.Equal(t, 1, busiest["a"])
+	assert.Equal(t, 3, busiest["b"])
+}
+
+func TestMultiQueueWorkerRunnerUnknownQueue(t *testing.T) {
+	cfg := motto.NewDefaultSettings()
+	cfg.Motto().Queue = []*motto.QueueSettings{
+		{Name: "memory", Driver: "memory", Queues: []string{"a"}, Memory: &motto.MemorySettings{}},
+	}
+
+	runner := motto.NewMultiQueueWorkerRunner(1, motto.PollStrictPriority,
+		&motto.WorkerQueue{Name: "memory:a"},
+		&motto.WorkerQueue{Name: "memory:typo"},
+	)
+
+	app := motto.NewApplication(cfg, nil, nil, runner)
+	defer app.Close()
+	assert.Nil(t, app.Boot())
+
+	assert.EqualError(t, app.Run(), "queue memory:typo is not configured")
+}
+
+func TestQueueWorkerRunnerKeepsLeaseOfSlowJobs(t *testing.T) {
+	cfg := motto.NewDefaultSettings()
+	cfg.Motto().Queue = []*motto.QueueSettings{
+		{Name: "memory", Driver: "memory", Queues: []string{"slow"}, Memory: &motto.MemorySettings{VisibilityTimeout: 1}},
+	}
+
+	var calls int32
+	processed := make(chan struct{}, 2)
+	processor := func(Q *motto.Queue, job *motto.Job, app motto.Application, logger motto.Logger) error {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(2500 * time.Millisecond)
+		processed <- struct{}{}
+		return nil
+	}
+
+	runner := motto.NewQueueWorkerRunner("memory:slow", 2)
+	app := motto.NewApplication(cfg, nil, map[int]motto.QueueProcessor{1: processor}, runner)
+	defer app.Close()
+	assert.Nil(t, app.Boot())
+
+	Q := app.Queue("memory:slow")
+	assert.Nil(t, Q.Enqueue(&motto.Job{Type: 1}))
+
+	go app.Run()
+	defer runner.Shutdown(time.Second)
+
+	select {
+	case <-processed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job not processed")
+	}
+
+	// Processed longer than its lease, the job was never reaped
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	var stats *motto.QueueStats
+	for i := 0; i < 20; i++ {
+		if stats, _ = Q.Stats(); stats.Working == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, int64(0), stats.Working)
+	assert.Equal(t, int64(0), stats.Pending)
+}
+
+func TestQueueWorkerRunnerShutdownWaitsForJobs(t *testing.T) {
+	cfg := motto.NewDefaultSettings()
+	cfg.Motto().Queue = []*motto.QueueSettings{
+		{Name: "memory", Driver: "memory", Queues: []string{"main"}},
+	}
+
+	var finished int32
+	started := make(chan struct{})
+	processor := func(Q *motto.Queue, job *motto.Job, app motto.Application, logger motto.Logger) error {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		atomic.StoreInt32(&finished, 1)
+		return nil
+	}
+
+	runner := motto.NewQueueWorkerRunner("memory:main", 1)
+	app := motto.NewApplication(cfg, nil, map[int]motto.QueueProcessor{1: processor}, runner)
+	defer app.Close()
+	assert.Nil(t, app.Boot())
+
+	Q := app.Queue("memory:main")
+	assert.Nil(t, Q.Enqueue(&motto.Job{Type: 1}))
+
+	go app.Run()
+	<-started
+
+	assert.EqualError(t, runner.Shutdown(10*time.Millisecond), "Shutdown wait timeout")
+	assert.Nil(t, runner.Shutdown(5*time.Second))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&finished))
+
+	// Settled before Shutdown returned, the clients can be closed
+	stats, _ := Q.Stats()
+	assert.Equal(t, int64(0), stats.Working)
+	assert.Equal(t, int64(0), stats.Backlog)
+}
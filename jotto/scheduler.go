@@ -0,0 +1,277 @@
+package jotto
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Policies for the runs of a recurring job missed while no scheduler was running
+const (
+	// MissedSkip - drop the missed runs
+	MissedSkip = "skip"
+
+	// MissedRunOnce - fire a single job for the latest missed run
+	MissedRunOnce = "run-once"
+
+	// MissedCatchUp - fire a job for every missed run, oldest first, up to `MaxCatchUp`
+	MissedCatchUp = "catch-up"
+)
+
+// RecurringJob - a job queued on a schedule
+type RecurringJob struct {
+	// Name - identifies the job in the fleet, the state of its runs is kept under it
+	Name string
+	// Cron - when the job runs, see ParseCron
+	Cron string
+	// Every - when `Cron` is empty, the job runs at this interval
+	Every time.Duration
+	// Location - the time zone of `Cron`, defaults to the local time zone
+	Location *time.Location
+
+	// Queue - the name of the queue, as passed to Application.Queue
+	Queue string
+	// Type - the type of the queued jobs
+	Type int
+	// Payload - a text/template of the payload, executed with the ScheduledRun
+	Payload string
+	// Priority - the priority of the queued jobs
+	Priority int
+
+	// Missed - one of the Missed* policies, defaults to MissedSkip
+	Missed string
+	// MaxCatchUp - the number of missed runs fired with MissedCatchUp, defaults to 10
+	MaxCatchUp int
+	// Tolerance - how late a run still counts as on time rather than missed, defaults to a minute
+	Tolerance time.Duration
+
+	schedule Schedule
+	payload  *template.Template
+}
+
+// ScheduledRun - a run of a recurring job, passed to its payload template
+type ScheduledRun struct {
+	Name string
+	At   time.Time
+}
+
+// Scheduler queues recurring jobs on time. It runs as a daemon in every
+// process of a fleet, but only the process holding the leader lock in the
+// cache fires the runs; the time of the last run is kept in the cache too,
+// so that a new leader picks up where the previous one stopped.
+//
+//	scheduler := jotto.NewScheduler("default", "default")
+//	scheduler.Register(&jotto.RecurringJob{
+//		Name:    "daily-report",
+//		Cron:    "0 6 * * mon-fri",
+//		Queue:   "default:main",
+//		Type:    JobDailyReport,
+//		Payload: `{"date": "{{.At.Format "2006-01-02"}}"}`,
+//	})
+//	app.RegisterDaemon("scheduler", scheduler.Run)
+type Scheduler struct {
+	name  string
+	cache string
+
+	mutex sync.Mutex
+	jobs  map[string]*RecurringJob
+
+	// TTL - the lease of the leader lock, renewed every tick
+	TTL time.Duration
+	// Interval - how often the leader checks for due runs
+	Interval time.Duration
+}
+
+// NewScheduler - create a scheduler named `name` keeping its lock and state in the cache named `cache`
+func NewScheduler(name string, cache string) *Scheduler {
+	return &Scheduler{
+		name:     name,
+		cache:    cache,
+		jobs:     make(map[string]*RecurringJob),
+		TTL:      time.Second * 10,
+		Interval: time.Second,
+	}
+}
+
+// Register - add a recurring job, replacing any job of the same name
+func (s *Scheduler) Register(job *RecurringJob) (err error) {
+	switch {
+	case job.Cron != "":
+		if job.schedule, err = ParseCron(job.Cron); err != nil {
+			return
+		}
+	case job.Every > 0:
+		job.schedule = Every(job.Every)
+	default:
+		return fmt.Errorf("recurring job `%s` has no schedule", job.Name)
+	}
+
+	if job.payload, err = template.New(job.Name).Parse(job.Payload); err != nil {
+		return
+	}
+
+	switch job.Missed {
+	case "":
+		job.Missed = MissedSkip
+	case MissedSkip, MissedRunOnce, MissedCatchUp:
+	default:
+		return fmt.Errorf("unknown missed run policy: %s", job.Missed)
+	}
+	if job.MaxCatchUp <= 0 {
+		job.MaxCatchUp = 10
+	}
+	if job.Tolerance <= 0 {
+		job.Tolerance = time.Minute
+	}
+	if job.Location == nil {
+		job.Location = time.Local
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.jobs[job.Name] = job
+
+	return
+}
+
+// Run - the DaemonWorker of the scheduler, competing for the leader lock
+// and firing due runs while holding it
+func (s *Scheduler) Run(app Application, cancel <-chan struct{}, args ...interface{}) {
+	lock := NewAppLock(app, s.cache, s.key("leader"), &LockOptions{TTL: s.TTL})
+	leader := false
+
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	logger := app.MakeLogger(nil)
+
+	for {
+		select {
+		case <-cancel:
+			if leader {
+				lock.Release()
+			}
+			return
+		case now := <-ticker.C:
+			if leader {
+				leader = lock.Extend(s.TTL) == nil
+			} else {
+				leader, _ = lock.TryAcquire()
+			}
+
+			if leader {
+				if err := s.Tick(app, now); err != nil {
+					logger.Errorf("motto|scheduler|tick_failed|scheduler=%s,err=%v", s.name, err)
+				}
+			}
+		}
+	}
+}
+
+// Tick - fire the runs due at `now`. Only the leader calls it, it is exported to fire runs by hand.
+func (s *Scheduler) Tick(app Application, now time.Time) (err error) {
+	s.mutex.Lock()
+	jobs := make([]*RecurringJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	s.mutex.Unlock()
+
+	for _, job := range jobs {
+		if er := s.fire(app, job, now); er != nil && err == nil {
+			err = er
+		}
+	}
+
+	return
+}
+
+// fire - queue the due runs of `job` and remember the time of this check
+func (s *Scheduler) fire(app Application, job *RecurringJob, now time.Time) error {
+	cache := app.Cache(s.cache)
+	key := s.key("last:" + job.Name)
+
+	now = now.In(job.Location)
+
+	value, err := cache.Get(key)
+	if IsCacheMiss(err) {
+		// First time the job is seen, runs start from now
+		return cache.Set(key, strconv.FormatInt(now.UnixNano(), 10), 0)
+	} else if err != nil {
+		return err
+	}
+
+	nanos, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	runs := job.due(time.Unix(0, nanos).In(job.Location), now)
+
+	for _, at := range runs {
+		if err = s.enqueue(app, job, at); err != nil {
+			return err
+		}
+	}
+
+	return cache.Set(key, strconv.FormatInt(now.UnixNano(), 10), 0)
+}
+
+// due - the runs to fire among those after `last` until `now`, following the missed run policy
+func (job *RecurringJob) due(last, now time.Time) (runs []time.Time) {
+	var missed []time.Time
+
+	for at := job.schedule.Next(last); !at.IsZero() && !at.After(now); at = job.schedule.Next(at) {
+		if now.Sub(at) <= job.Tolerance {
+			runs = append(runs, at)
+			continue
+		}
+
+		missed = append(missed, at)
+		if len(missed) > job.MaxCatchUp {
+			missed = missed[1:]
+		}
+	}
+
+	switch {
+	case len(missed) == 0, job.Missed == MissedSkip:
+		return runs
+	case job.Missed == MissedRunOnce:
+		if len(runs) > 0 {
+			return runs
+		}
+		return missed[len(missed)-1:]
+	}
+
+	return append(missed, runs...)
+}
+
+// enqueue - queue the job of a run, the run time makes it unique in case two leaders overlap
+func (s *Scheduler) enqueue(app Application, job *RecurringJob, at time.Time) error {
+	payload := &bytes.Buffer{}
+	if err := job.payload.Execute(payload, &ScheduledRun{Name: job.Name, At: at}); err != nil {
+		return err
+	}
+
+	err := app.Queue(job.Queue).Enqueue(&Job{
+		Type:      job.Type,
+		Payload:   payload.String(),
+		Priority:  job.Priority,
+		UniqueKey: fmt.Sprintf("%s:%s:%d", s.key("run"), job.Name, at.UnixNano()),
+		UniqueFor: int64(job.Tolerance / time.Second),
+	})
+
+	if err == ErrorJobDuplicate {
+		return nil
+	}
+	return err
+}
+
+// key - the cache key of `name` in the scheduler
+func (s *Scheduler) key(name string) string {
+	return "scheduler:" + s.name + ":" + name
+}
@@ -0,0 +1,126 @@
+package motto_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.garena.com/duanzy/motto/motto"
+)
+
+func TestParseCron(t *testing.T) {
+	from := time.Date(2024, time.January, 31, 10, 30, 15, 0, time.UTC) // a Wednesday
+
+	cases := []struct {
+		expression string
+		next       time.Time
+	}{
+		{"* * * * *", time.Date(2024, time.January, 31, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.January, 31, 10, 45, 0, 0, time.UTC)},
+		{"0 6 * * mon-fri", time.Date(2024, time.February, 1, 6, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 7", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 9,17 * * *", time.Date(2024, time.January, 31, 17, 30, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"@every 1h", time.Date(2024, time.January, 31, 11, 0, 0, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		schedule, err := motto.ParseCron(c.expression)
+		assert.Nil(t, err, c.expression)
+		assert.Equal(t, c.next, schedule.Next(from), c.expression)
+	}
+
+	for _, expression := range []string{"* * * *", "60 * * * *", "* * * * mon-sun-", "5-1 * * * *", "@every -1s"} {
+		_, err := motto.ParseCron(expression)
+		assert.NotNil(t, err, expression)
+	}
+}
+
+func TestSchedulerMissedRuns(t *testing.T) {
+	cfg := motto.NewDefaultSettings()
+	cfg.Motto().Cache = []*motto.CacheSettings{{Name: "default", Driver: "memory"}}
+	cfg.Motto().Queue = []*motto.QueueSettings{{Name: "default", Driver: "memory", Queues: []string{motto.MissedSkip, motto.MissedRunOnce, motto.MissedCatchUp}}}
+	app := motto.NewApplication(cfg, nil, nil, nil)
+	defer app.Close()
+	assert.Nil(t, app.Boot())
+
+	scheduler := motto.NewScheduler("test", "default")
+	for _, policy := range []string{motto.MissedSkip, motto.MissedRunOnce, motto.MissedCatchUp} {
+		assert.Nil(t, scheduler.Register(&motto.RecurringJob{
+			Name:       policy,
+			Every:      time.Minute,
+			Location:   time.UTC,
+			Queue:      "default:" + policy,
+			Payload:    `{{.Name}}@{{.At.Format "15:04"}}`,
+			Missed:     policy,
+			MaxCatchUp: 3,
+			Tolerance:  time.Second * 30,
+		}))
+	}
+	assert.NotNil(t, scheduler.Register(&motto.RecurringJob{Name: "never"}))
+
+	start := time.Date(2024, time.January, 1, 12, 0, 10, 0, time.UTC)
+
+	// The first tick only records the time, the next one fires the run on time
+	assert.Nil(t, scheduler.Tick(app, start))
+	assert.Nil(t, scheduler.Tick(app, start.Add(time.Minute)))
+	assert.Nil(t, scheduler.Tick(app, start.Add(time.Minute)))
+
+	// Down for ten minutes
+	assert.Nil(t, scheduler.Tick(app, start.Add(11*time.Minute)))
+
+	payloads := func(queue string) (payloads []string) {
+		for {
+			job, err := app.Queue("default:" + queue).Dequeue()
+			if err != nil {
+				return
+			}
+			payloads = append(payloads, job.Payload)
+		}
+	}
+
+	assert.Equal(t, []string{"skip@12:01", "skip@12:11"}, payloads(motto.MissedSkip))
+	assert.Equal(t, []string{"run-once@12:01", "run-once@12:11"}, payloads(motto.MissedRunOnce))
+	assert.Equal(t, []string{"catch-up@12:01", "catch-up@12:08", "catch-up@12:09", "catch-up@12:10", "catch-up@12:11"}, payloads(motto.MissedCatchUp))
+
+	// Down for ten minutes again, waking up between runs
+	assert.Nil(t, scheduler.Tick(app, start.Add(21*time.Minute+40*time.Second)))
+
+	assert.Empty(t, payloads(motto.MissedSkip))
+	assert.Equal(t, []string{"run-once@12:21"}, payloads(motto.MissedRunOnce))
+	assert.Equal(t, []string{"catch-up@12:19", "catch-up@12:20", "catch-up@12:21"}, payloads(motto.MissedCatchUp))
+}
+
+func TestSchedulerLeaderElection(t *testing.T) {
+	cfg := motto.NewDefaultSettings()
+	cfg.Motto().Cache = []*motto.CacheSettings{{Name: "default", Driver: "memory"}}
+	cfg.Motto().Queue = []*motto.QueueSettings{{Name: "default", Driver: "memory", Queues: []string{"main"}}}
+	app := motto.NewApplication(cfg, nil, nil, nil)
+	defer app.Close()
+	assert.Nil(t, app.Boot())
+
+	cancel := make(chan struct{})
+	done := make(chan struct{})
+
+	for i := 0; i < 3; i++ {
+		scheduler := motto.NewScheduler("fleet", "default")
+		scheduler.Interval = 10 * time.Millisecond
+		assert.Nil(t, scheduler.Register(&motto.RecurringJob{Name: "tick", Every: 100 * time.Millisecond, Queue: "default:main"}))
+
+		go func() {
+			scheduler.Run(app, cancel)
+			done <- struct{}{}
+		}()
+	}
+
+	time.Sleep(time.Millisecond * 550)
+	close(cancel)
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+
+	stats, _ := app.Queue("default:main").Stats()
+	assert.True(t, stats.Pending >= 2 && stats.Pending <= 6, stats.Pending)
+}
@@ -1,5 +1,12 @@
 package jotto
 
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
 // Configuration is an interface that application's custom settings struct must conform to.
 type Configuration interface {
 	Motto() *Settings
@@ -32,22 +39,36 @@ type Settings struct {
 	ReadTimeout  int `json:"read-timeout" xml:"ReadTimeout"`
 	IdleTimeout  int `json:"idle-timeout" xml:"IdleTimeout"`
 
+	// MetricsPath - the HTTP runner serves the cache metrics at this path when set
+	MetricsPath string `json:"metrics-path,omitempty" xml:"MetricsPath,omitempty"`
+
+	// DrainTimeout - in seconds, how long a reload waits for the operations running on
+	// replaced cache and queue drivers before closing them, defaults to 30
+	DrainTimeout int `json:"drain-timeout,omitempty" xml:"DrainTimeout,omitempty"`
+
 	Cache []*CacheSettings `json:"cache,omitempty" xml:"Cache>Instance,omitempty"`
 	Queue []*QueueSettings `json:"queue,omitempty" xml:"Queue>Instance,omitempty"`
 }
 
 type CacheSettings struct {
-	Name      string             `json:"name" xml:"Name"`
-	Driver    string             `json:"driver" xml:"Driver"`
-	Redis     *RedisSettings     `json:"redis,omitempty" xml:"Redis,omitempty"`
-	Memcached *MemcachedSettings `json:"memcached,omitempty" xml:"Memcached,omitempty"`
+	Name      string              `json:"name" xml:"Name"`
+	Driver    string              `json:"driver" xml:"Driver"`
+	Prefix    string              `json:"prefix,omitempty" xml:"Prefix,omitempty"`
+	Redis     *RedisSettings      `json:"redis,omitempty" xml:"Redis,omitempty"`
+	Memcached *MemcachedSettings  `json:"memcached,omitempty" xml:"Memcached,omitempty"`
+	Memory    *MemorySettings     `json:"memory,omitempty" xml:"Memory,omitempty"`
+	GetVia    *GetViaSettings     `json:"get-via,omitempty" xml:"GetVia,omitempty"`
+	Local     *LocalCacheSettings `json:"local,omitempty" xml:"Local,omitempty"`
+
+	CircuitBreaker *CircuitBreakerSettings `json:"circuit-breaker,omitempty" xml:"CircuitBreaker,omitempty"`
 }
 
 type QueueSettings struct {
-	Name   string         `json:"name" xml:"Name"`
-	Queues []string       `json:"queues" xml:"Queues>Name,omitempty"`
-	Driver string         `json:"driver" xml:"Driver"`
-	Redis  *RedisSettings `json:"redis,omitempty" xml:"Redis,omitempty"`
+	Name   string          `json:"name" xml:"Name"`
+	Queues []string        `json:"queues" xml:"Queues>Name,omitempty"`
+	Driver string          `json:"driver" xml:"Driver"`
+	Redis  *RedisSettings  `json:"redis,omitempty" xml:"Redis,omitempty"`
+	Memory *MemorySettings `json:"memory,omitempty" xml:"Memory,omitempty"`
 }
 
 type RedisSettings struct {
@@ -58,8 +79,97 @@ type RedisSettings struct {
 	ReadTimeout  int    `json:"read-timeout,omitempty" xml:"ReadTimeout,omitempty"`
 	WriteTimeout int    `json:"write-timeout,omitempty" xml:"WriteTimeout,omitempty"`
 	Blocking     bool   `json:"blocking,omitempty" xml:"Blocking,omitempty"`
+	MasterName   string `json:"master-name,omitempty" xml:"MasterName,omitempty"` // Sentinel master name, `Address` then lists the sentinels
+	Username     string `json:"username,omitempty" xml:"Username,omitempty"`      // ACL user, Redis 6 and above
+	PoolSize     int    `json:"pool-size,omitempty" xml:"PoolSize,omitempty"`     // Defaults to 10 connections per CPU
+	MinIdleConns int    `json:"min-idle-conns,omitempty" xml:"MinIdleConns,omitempty"`
+
+	// VisibilityTimeout - in seconds, how long a dequeued job is leased to its worker before
+	// it is handed out again, defaults to 300, negative to disable
+	VisibilityTimeout int `json:"visibility-timeout,omitempty" xml:"VisibilityTimeout,omitempty"`
+
+	TLS *TLSSettings `json:"tls,omitempty" xml:"TLS,omitempty"`
+}
+
+type TLSSettings struct {
+	CAFile             string `json:"ca-file,omitempty" xml:"CAFile,omitempty"`
+	CertFile           string `json:"cert-file,omitempty" xml:"CertFile,omitempty"`
+	KeyFile            string `json:"key-file,omitempty" xml:"KeyFile,omitempty"`
+	ServerName         string `json:"server-name,omitempty" xml:"ServerName,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure-skip-verify,omitempty" xml:"InsecureSkipVerify,omitempty"`
 }
 
 type MemcachedSettings struct {
-	Address []string `json:"address" xml:"Address"`
+	Address      []string `json:"address" xml:"Address"`
+	DialTimeout  int      `json:"dial-timeout,omitempty" xml:"DialTimeout,omitempty"`
+	ReadTimeout  int      `json:"read-timeout,omitempty" xml:"ReadTimeout,omitempty"`
+	WriteTimeout int      `json:"write-timeout,omitempty" xml:"WriteTimeout,omitempty"`
+	MaxIdleConns int      `json:"max-idle-conns,omitempty" xml:"MaxIdleConns,omitempty"`
+}
+
+type MemorySettings struct {
+	ReadTimeout       int   `json:"read-timeout,omitempty" xml:"ReadTimeout,omitempty"`
+	Blocking          bool  `json:"blocking,omitempty" xml:"Blocking,omitempty"`
+	MaxEntries        int   `json:"max-entries,omitempty" xml:"MaxEntries,omitempty"`
+	MaxBytes          int64 `json:"max-bytes,omitempty" xml:"MaxBytes,omitempty"`
+	JanitorInterval   int   `json:"janitor-interval,omitempty" xml:"JanitorInterval,omitempty"`     // In seconds, defaults to 60, negative to disable
+	VisibilityTimeout int   `json:"visibility-timeout,omitempty" xml:"VisibilityTimeout,omitempty"` // Queues only, same as RedisSettings.VisibilityTimeout
+}
+
+type GetViaSettings struct {
+	Lock                 bool `json:"lock,omitempty" xml:"Lock,omitempty"`
+	LockTimeout          int  `json:"lock-timeout,omitempty" xml:"LockTimeout,omitempty"`                    // In seconds, defaults to 10
+	LockWait             int  `json:"lock-wait,omitempty" xml:"LockWait,omitempty"`                          // In milliseconds, defaults to 3000
+	StaleWhileRevalidate int  `json:"stale-while-revalidate,omitempty" xml:"StaleWhileRevalidate,omitempty"` // In seconds
+}
+
+type LocalCacheSettings struct {
+	MaxEntries int    `json:"max-entries,omitempty" xml:"MaxEntries,omitempty"`
+	MaxBytes   int64  `json:"max-bytes,omitempty" xml:"MaxBytes,omitempty"`
+	TTL        int    `json:"ttl,omitempty" xml:"TTL,omitempty"`         // In milliseconds, defaults to 1000
+	Channel    string `json:"channel,omitempty" xml:"Channel,omitempty"` // Pub/sub channel for cross-instance invalidation
+}
+
+type CircuitBreakerSettings struct {
+	Window           int     `json:"window,omitempty" xml:"Window,omitempty"`                       // In seconds, defaults to 10
+	MinRequests      int     `json:"min-requests,omitempty" xml:"MinRequests,omitempty"`            // Defaults to 20
+	ErrorRate        float64 `json:"error-rate,omitempty" xml:"ErrorRate,omitempty"`                // Between 0 and 1, defaults to 0.5
+	SlowCall         int     `json:"slow-call,omitempty" xml:"SlowCall,omitempty"`                  // In milliseconds, slower calls count as failures, 0 to disable
+	OpenTimeout      int     `json:"open-timeout,omitempty" xml:"OpenTimeout,omitempty"`            // In milliseconds, defaults to 5000
+	HalfOpenRequests int     `json:"half-open-requests,omitempty" xml:"HalfOpenRequests,omitempty"` // Defaults to 1
+	Fallback         string  `json:"fallback,omitempty" xml:"Fallback,omitempty"`                   // "miss" (default), "local" or "error"
+
+	Local    *MemorySettings `json:"local,omitempty" xml:"Local,omitempty"`        // Sizing of the local fallback cache
+	LocalTTL int             `json:"local-ttl,omitempty" xml:"LocalTTL,omitempty"` // In seconds, how long the local fallback keeps its copies, defaults to 60
+}
+
+// config - build the TLS configuration described by the settings
+func (ts *TLSSettings) config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         ts.ServerName,
+		InsecureSkipVerify: ts.InsecureSkipVerify,
+	}
+
+	if ts.CAFile != "" {
+		ca, err := ioutil.ReadFile(ts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", ts.CAFile)
+		}
+	}
+
+	if ts.CertFile != "" || ts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(ts.CertFile, ts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
 }
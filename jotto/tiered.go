@@ -0,0 +1,457 @@
+package jotto
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// PubSub is implemented by drivers that can broadcast messages to every
+// process connected to the same backend.
+type PubSub interface {
+	// Publish - send `message` to all subscribers of `channel`
+	Publish(channel, message string) error
+	// Subscribe - call `handler` for each message on `channel` until the returned closer is closed
+	Subscribe(channel string, handler func(message string)) io.Closer
+}
+
+// TieredDriver layers a small in-process cache in front of a remote driver.
+// Reads are served locally when possible; writes go through to the remote
+// driver and drop the local copy. When a pub/sub channel is configured and
+// the remote driver supports it, writes are also broadcast so that other
+// processes drop their local copies too.
+type TieredDriver struct {
+	name     string
+	local    *MemoryDriver
+	remote   CacheDriver
+	ttl      time.Duration
+	channel  string
+	pubsub   PubSub
+	origin   string
+	listener io.Closer
+	flight   flightGroup
+}
+
+// tieredInvalidation is the message broadcast on the invalidation channel
+type tieredInvalidation struct {
+	Origin string   `json:"origin"`
+	Keys   []string `json:"keys,omitempty"`
+	Flush  bool     `json:"flush,omitempty"`
+}
+
+// NewTieredDriver - put a local cache described by `settings` in front of `remote`
+func NewTieredDriver(name string, remote CacheDriver, settings *LocalCacheSettings) *TieredDriver {
+	ttl := time.Duration(settings.TTL) * time.Millisecond
+	if ttl <= 0 {
+		ttl = time.Second
+	}
+
+	td := &TieredDriver{
+		name: name,
+		local: NewMemoryDriver(name, &MemorySettings{
+			MaxEntries: settings.MaxEntries,
+			MaxBytes:   settings.MaxBytes,
+		}),
+		remote:  remote,
+		ttl:     ttl,
+		channel: settings.Channel,
+		origin:  GenerateTraceID(),
+	}
+
+	if pubsub, ok := remote.(PubSub); ok && td.channel != "" {
+		td.pubsub = pubsub
+		td.listener = pubsub.Subscribe(td.channel, td.receive)
+	}
+
+	return td
+}
+
+// Local - the in-process layer
+func (td *TieredDriver) Local() CacheDriver {
+	return td.local
+}
+
+// Remote - the remote layer
+func (td *TieredDriver) Remote() CacheDriver {
+	return td.remote
+}
+
+// Close - stop listening for invalidations and close both layers
+func (td *TieredDriver) Close() error {
+	if td.listener != nil {
+		td.listener.Close()
+	}
+
+	td.local.Close()
+
+	if closer, ok := td.remote.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// receive - drop local copies invalidated by another process
+func (td *TieredDriver) receive(message string) {
+	invalidation := &tieredInvalidation{}
+
+	if err := json.Unmarshal([]byte(message), invalidation); err != nil || invalidation.Origin == td.origin {
+		return
+	}
+
+	if invalidation.Flush {
+		td.local.Flush()
+	} else {
+		td.local.MDel(invalidation.Keys...)
+	}
+}
+
+// invalidate - drop local copies of `keys` here and in other processes
+func (td *TieredDriver) invalidate(keys ...string) {
+	td.local.MDel(keys...)
+	td.broadcast(&tieredInvalidation{Keys: keys})
+}
+
+func (td *TieredDriver) broadcast(invalidation *tieredInvalidation) {
+	if td.pubsub == nil {
+		return
+	}
+
+	invalidation.Origin = td.origin
+	message, _ := json.Marshal(invalidation)
+
+	td.pubsub.Publish(td.channel, string(message))
+}
+
+// localTTL - keep local copies no longer than the configured TTL
+func (td *TieredDriver) localTTL(expiration time.Duration) time.Duration {
+	if expiration > 0 && expiration < td.ttl {
+		return expiration
+	}
+	return td.ttl
+}
+
+// Get - retrieve `key` locally, falling back to the remote driver
+func (td *TieredDriver) Get(key string) (string, error) {
+	if value, err := td.local.Get(key); err == nil {
+		return value, nil
+	}
+
+	value, err := td.remote.Get(key)
+
+	if err != nil {
+		return "", err
+	}
+
+	td.local.Set(key, value, td.ttl)
+
+	return value, nil
+}
+
+// GetVia - retrieve `key`, call `handler` to fill it in on a miss
+func (td *TieredDriver) GetVia(key string, handler func() (string, time.Duration, error)) (string, error) {
+	return getVia(td, &td.flight, key, handler)
+}
+
+// Set - write `key` through to the remote driver
+func (td *TieredDriver) Set(key, value string, expiration time.Duration) error {
+	if err := td.remote.Set(key, value, expiration); err != nil {
+		td.invalidate(key)
+		return err
+	}
+
+	td.broadcast(&tieredInvalidation{Keys: []string{key}})
+	td.local.Set(key, value, td.localTTL(expiration))
+
+	return nil
+}
+
+// SetNX - put `key` into the remote driver if `key` is not exist
+func (td *TieredDriver) SetNX(key, value string, expiration time.Duration) (bool, error) {
+	stored, err := td.remote.SetNX(key, value, expiration)
+
+	if stored {
+		td.invalidate(key)
+	}
+
+	return stored, err
+}
+
+// Has - check if `key` exists locally or remotely
+func (td *TieredDriver) Has(key string) (bool, error) {
+	if has, _ := td.local.Has(key); has {
+		return true, nil
+	}
+
+	return td.remote.Has(key)
+}
+
+// Del - delete `keys` from both layers
+func (td *TieredDriver) Del(keys ...string) (bool, error) {
+	defer td.invalidate(keys...)
+
+	return td.remote.Del(keys...)
+}
+
+// Flush - flush both layers
+func (td *TieredDriver) Flush() (bool, error) {
+	defer func() {
+		td.local.Flush()
+		td.broadcast(&tieredInvalidation{Flush: true})
+	}()
+
+	return td.remote.Flush()
+}
+
+// Incr - increase the value of `key` remotely
+func (td *TieredDriver) Incr(key string) (int64, error) {
+	defer td.invalidate(key)
+
+	return td.remote.Incr(key)
+}
+
+// Decr - decrease the value of `key` remotely
+func (td *TieredDriver) Decr(key string) (int64, error) {
+	defer td.invalidate(key)
+
+	return td.remote.Decr(key)
+}
+
+// Expire - set the expire time of `key` remotely
+func (td *TieredDriver) Expire(key string, expiry time.Duration) (bool, error) {
+	defer td.invalidate(key)
+
+	return td.remote.Expire(key, expiry)
+}
+
+// Guard - guard the execution of `handler` with a lock
+func (td *TieredDriver) Guard(key string, expiration time.Duration, handler func() error) error {
+	return guard(td, key, expiration, handler)
+}
+
+// CompareAndDelete - delete `key` remotely if it holds `value`
+func (td *TieredDriver) CompareAndDelete(key, value string) (bool, error) {
+	defer td.invalidate(key)
+
+	return td.remote.CompareAndDelete(key, value)
+}
+
+// CompareAndExpire - set the expire time of `key` remotely if it holds `value`
+func (td *TieredDriver) CompareAndExpire(key, value string, expiry time.Duration) (bool, error) {
+	defer td.invalidate(key)
+
+	return td.remote.CompareAndExpire(key, value, expiry)
+}
+
+// MGet - retrieve multiple keys, only asking the remote driver for local misses
+func (td *TieredDriver) MGet(keys ...string) (map[string]string, error) {
+	values, _ := td.local.MGet(keys...)
+
+	missing := []string{}
+	for _, key := range keys {
+		if _, ok := values[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+
+	if len(missing) == 0 {
+		return values, nil
+	}
+
+	found, err := td.remote.MGet(missing...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*CacheItem, 0, len(found))
+	for key, value := range found {
+		values[key] = value
+		items = append(items, &CacheItem{Key: key, Value: value, Expiration: td.ttl})
+	}
+	td.local.MSet(items...)
+
+	return values, nil
+}
+
+// MSet - write multiple items through to the remote driver
+func (td *TieredDriver) MSet(items ...*CacheItem) error {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+
+	if err := td.remote.MSet(items...); err != nil {
+		td.invalidate(keys...)
+		return err
+	}
+
+	td.broadcast(&tieredInvalidation{Keys: keys})
+
+	for _, item := range items {
+		td.local.Set(item.Key, item.Value, td.localTTL(item.Expiration))
+	}
+
+	return nil
+}
+
+// MDel - delete multiple keys from both layers
+func (td *TieredDriver) MDel(keys ...string) (int64, error) {
+	defer td.invalidate(keys...)
+
+	return td.remote.MDel(keys...)
+}
+
+/* Data structures, passed through to the remote driver */
+
+// HGet - get `field` of the hash at `key` remotely
+func (td *TieredDriver) HGet(key, field string) (string, error) {
+	return td.remote.HGet(key, field)
+}
+
+// HSet - set `field` of the hash at `key` remotely
+func (td *TieredDriver) HSet(key, field, value string) error {
+	return td.remote.HSet(key, field, value)
+}
+
+// HDel - delete `fields` of the hash at `key` remotely
+func (td *TieredDriver) HDel(key string, fields ...string) (int64, error) {
+	return td.remote.HDel(key, fields...)
+}
+
+// HGetAll - get all fields of the hash at `key` remotely
+func (td *TieredDriver) HGetAll(key string) (map[string]string, error) {
+	return td.remote.HGetAll(key)
+}
+
+// HIncrBy - add `delta` to `field` of the hash at `key` remotely
+func (td *TieredDriver) HIncrBy(key, field string, delta int64) (int64, error) {
+	return td.remote.HIncrBy(key, field, delta)
+}
+
+// ZAdd - add `members` to the sorted set at `key` remotely
+func (td *TieredDriver) ZAdd(key string, members ...ZMember) (int64, error) {
+	return td.remote.ZAdd(key, members...)
+}
+
+// ZRange - members of the sorted set at `key` by ascending score remotely
+func (td *TieredDriver) ZRange(key string, start, stop int64) ([]ZMember, error) {
+	return td.remote.ZRange(key, start, stop)
+}
+
+// ZRevRange - members of the sorted set at `key` by descending score remotely
+func (td *TieredDriver) ZRevRange(key string, start, stop int64) ([]ZMember, error) {
+	return td.remote.ZRevRange(key, start, stop)
+}
+
+// ZRank - the rank of `member` in the sorted set at `key` remotely
+func (td *TieredDriver) ZRank(key, member string) (int64, error) {
+	return td.remote.ZRank(key, member)
+}
+
+// LPush - prepend `values` to the list at `key` remotely
+func (td *TieredDriver) LPush(key string, values ...string) (int64, error) {
+	return td.remote.LPush(key, values...)
+}
+
+// RPush - append `values` to the list at `key` remotely
+func (td *TieredDriver) RPush(key string, values ...string) (int64, error) {
+	return td.remote.RPush(key, values...)
+}
+
+// LPop - remove and return the first element of the list at `key` remotely
+func (td *TieredDriver) LPop(key string) (string, error) {
+	return td.remote.LPop(key)
+}
+
+// RPop - remove and return the last element of the list at `key` remotely
+func (td *TieredDriver) RPop(key string) (string, error) {
+	return td.remote.RPop(key)
+}
+
+// LRange - elements of the list at `key` from `start` to `stop` remotely
+func (td *TieredDriver) LRange(key string, start, stop int64) ([]string, error) {
+	return td.remote.LRange(key, start, stop)
+}
+
+// LTrim - keep only the elements of the list at `key` from `start` to `stop` remotely
+func (td *TieredDriver) LTrim(key string, start, stop int64) error {
+	return td.remote.LTrim(key, start, stop)
+}
+
+// Throttle - count a request against the rate limit at `key` remotely
+func (td *TieredDriver) Throttle(key string, limit *RateLimit) (*RateLimitResult, error) {
+	return td.remote.Throttle(key, limit)
+}
+
+// Batch - start a batch on the remote driver, written keys are invalidated on Exec
+func (td *TieredDriver) Batch() CacheBatch {
+	return &tieredBatch{driver: td, remote: td.remote.Batch()}
+}
+
+// Publish - publish through the remote layer, if it supports pub/sub
+func (td *TieredDriver) Publish(channel, message string) error {
+	pubsub, ok := td.remote.(PubSub)
+	if !ok {
+		return fmt.Errorf("cache driver %T does not support pub/sub", td.remote)
+	}
+
+	return pubsub.Publish(channel, message)
+}
+
+// Subscribe - subscribe through the remote layer, if it supports pub/sub
+func (td *TieredDriver) Subscribe(channel string, handler func(message string)) io.Closer {
+	if pubsub, ok := td.remote.(PubSub); ok {
+		return pubsub.Subscribe(channel, handler)
+	}
+
+	return ioutil.NopCloser(nil)
+}
+
+type tieredBatch struct {
+	driver  *TieredDriver
+	remote  CacheBatch
+	written []string
+}
+
+func (b *tieredBatch) Get(key string) *CacheResult {
+	return b.remote.Get(key)
+}
+
+func (b *tieredBatch) Set(key, value string, expiration time.Duration) *CacheResult {
+	b.written = append(b.written, key)
+	return b.remote.Set(key, value, expiration)
+}
+
+func (b *tieredBatch) Del(key string) *CacheResult {
+	b.written = append(b.written, key)
+	return b.remote.Del(key)
+}
+
+func (b *tieredBatch) Incr(key string) *CacheResult {
+	b.written = append(b.written, key)
+	return b.remote.Incr(key)
+}
+
+func (b *tieredBatch) Decr(key string) *CacheResult {
+	b.written = append(b.written, key)
+	return b.remote.Decr(key)
+}
+
+func (b *tieredBatch) Expire(key string, expiry time.Duration) *CacheResult {
+	b.written = append(b.written, key)
+	return b.remote.Expire(key, expiry)
+}
+
+func (b *tieredBatch) Exec() error {
+	defer func() {
+		if len(b.written) > 0 {
+			b.driver.invalidate(b.written...)
+			b.written = nil
+		}
+	}()
+
+	return b.remote.Exec()
+}
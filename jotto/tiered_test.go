@@ -0,0 +1,92 @@
+package motto_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.garena.com/duanzy/motto/motto"
+)
+
+func TestTieredDriverServesReadsLocally(t *testing.T) {
+	remote := motto.NewMemoryDriver("remote", &motto.MemorySettings{JanitorInterval: -1})
+	cache := motto.NewTieredDriver("default", remote, &motto.LocalCacheSettings{TTL: 50})
+	defer cache.Close()
+
+	remote.Set("key", "v1", 0)
+
+	value, err := cache.Get("key")
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", value)
+
+	// Changed behind our back: the local copy is served until it expires
+	remote.Set("key", "v2", 0)
+	value, _ = cache.Get("key")
+	assert.Equal(t, "v1", value)
+
+	time.Sleep(time.Millisecond * 60)
+	value, _ = cache.Get("key")
+	assert.Equal(t, "v2", value)
+
+	// Writes go through and replace the local copy
+	assert.Nil(t, cache.Set("key", "v3", 0))
+	value, _ = remote.Get("key")
+	assert.Equal(t, "v3", value)
+
+	cache.Del("key")
+	_, err = cache.Get("key")
+	assert.True(t, motto.IsCacheMiss(err))
+}
+
+func TestTieredDriverInvalidatesOtherInstances(t *testing.T) {
+	remote := motto.NewMemoryDriver("remote", &motto.MemorySettings{JanitorInterval: -1})
+	settings := &motto.LocalCacheSettings{TTL: 60000, Channel: "invalidate"}
+
+	first := motto.NewTieredDriver("default", remote, settings)
+	defer first.Close()
+	second := motto.NewTieredDriver("default", remote, settings)
+	defer second.Close()
+
+	first.Set("key", "v1", 0)
+
+	value, _ := second.Get("key")
+	assert.Equal(t, "v1", value)
+
+	first.Set("key", "v2", 0)
+	value, _ = second.Get("key")
+	assert.Equal(t, "v2", value)
+
+	first.Incr("counter")
+	second.Get("counter")
+	first.Incr("counter")
+	value, _ = second.Get("counter")
+	assert.Equal(t, "2", value)
+
+	first.Flush()
+	has, _ := second.Local().Has("counter")
+	assert.False(t, has)
+}
+
+func TestTieredDriverMGetFillsLocalMisses(t *testing.T) {
+	remote := motto.NewMemoryDriver("remote", &motto.MemorySettings{JanitorInterval: -1})
+	cache := motto.NewTieredDriver("default", remote, &motto.LocalCacheSettings{})
+	defer cache.Close()
+
+	remote.MSet(&motto.CacheItem{Key: "a", Value: "1"}, &motto.CacheItem{Key: "b", Value: "2"})
+	cache.Get("a")
+
+	values, err := cache.MGet("a", "b", "c")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, values)
+
+	has, _ := cache.Local().Has("b")
+	assert.True(t, has)
+
+	batch := cache.Batch()
+	batch.Set("b", "3", 0)
+	assert.Nil(t, batch.Exec())
+
+	value, _ := cache.Get("b")
+	assert.Equal(t, "3", value)
+}